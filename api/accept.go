@@ -0,0 +1,94 @@
+package api
+
+import (
+	"mime"
+	"strconv"
+	"strings"
+)
+
+// mediaRange is one entry of an Accept header, such as "text/*;q=0.5".
+type mediaRange struct {
+	Type, Subtype string
+	Quality       float64
+}
+
+// specificity ranks how closely the range names an offer that it matches: "*/*" is 0, "text/*" is 1 and "text/csv" is
+// 2. RFC 9110 says the most specific range that matches an offer sets its quality.
+func (r mediaRange) specificity() int {
+	switch {
+	case r.Type == "*":
+		return 0
+	case r.Subtype == "*":
+		return 1
+	default:
+		return 2 //nolint:gomnd // See above
+	}
+}
+
+func (r mediaRange) matches(mediaType, subtype string) bool {
+	return (r.Type == "*" || r.Type == mediaType) && (r.Subtype == "*" || r.Subtype == subtype)
+}
+
+/*
+parseAccept parses the media ranges of an Accept header. Ranges that cannot be parsed are skipped, and so is a bad q
+parameter. An empty header accepts anything.
+*/
+func parseAccept(header string) []mediaRange {
+	if strings.TrimSpace(header) == "" {
+		return []mediaRange{{Type: "*", Subtype: "*", Quality: 1}}
+	}
+
+	ranges := []mediaRange{}
+
+	for _, part := range strings.Split(header, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+
+		rangeType, subtype, found := strings.Cut(mediaType, "/")
+		if !found || rangeType == "*" && subtype != "*" {
+			continue
+		}
+
+		quality := 1.0
+
+		if q, hasQ := params["q"]; hasQ {
+			if quality, err = strconv.ParseFloat(q, 64); err != nil || quality < 0 || quality > 1 {
+				continue
+			}
+		}
+
+		ranges = append(ranges, mediaRange{Type: rangeType, Subtype: subtype, Quality: quality})
+	}
+
+	return ranges
+}
+
+/*
+bestOffer returns the offer with the highest quality in the Accept header, or "" if the client accepts none of them.
+The quality of an offer comes from the most specific range that matches it, so "text/*;q=0, text/csv" accepts CSV and
+nothing else under text/. Offers that are accepted equally are picked in the order they are given. q=0 means not
+acceptable.
+*/
+func bestOffer(header string, offers ...string) string {
+	ranges := parseAccept(header)
+	best, bestQuality := "", 0.0
+
+	for _, offer := range offers {
+		mediaType, subtype, _ := strings.Cut(offer, "/")
+		quality, specificity := 0.0, -1
+
+		for _, r := range ranges {
+			if r.matches(mediaType, subtype) && r.specificity() > specificity {
+				quality, specificity = r.Quality, r.specificity()
+			}
+		}
+
+		if quality > bestQuality {
+			best, bestQuality = offer, quality
+		}
+	}
+
+	return best
+}
@@ -0,0 +1,106 @@
+package api
+
+import (
+	"fmt"
+
+	"github.com/m-kuzmin/simple-rest-api/db"
+	"github.com/m-kuzmin/simple-rest-api/phone"
+)
+
+// PhoneCountryPolicy decides what an import does with users whose phone number belongs to a different country.
+type PhoneCountryPolicy string
+
+const (
+	// PhoneCountryWarn imports the user as is and reports the mismatch.
+	PhoneCountryWarn PhoneCountryPolicy = "warn"
+	// PhoneCountryReject fails the import and reports every mismatching row.
+	PhoneCountryReject PhoneCountryPolicy = "reject"
+	// PhoneCountryCorrect replaces the country with the one of the phone number and reports the change. If the
+	// number does not say which of the countries of its calling code it belongs to, it falls back to warning.
+	PhoneCountryCorrect PhoneCountryPolicy = "correct"
+)
+
+// ParsePhoneCountryPolicy returns the policy with this name.
+func ParsePhoneCountryPolicy(name string) (PhoneCountryPolicy, error) {
+	switch policy := PhoneCountryPolicy(name); policy {
+	case PhoneCountryWarn, PhoneCountryReject, PhoneCountryCorrect:
+		return policy, nil
+	default:
+		return "", unknownPolicyError{Name: name, Valid: []string{
+			string(PhoneCountryWarn), string(PhoneCountryReject), string(PhoneCountryCorrect),
+		}}
+	}
+}
+
+type unknownPolicyError struct {
+	Name  string
+	Valid []string
+}
+
+func (e unknownPolicyError) Error() string {
+	return fmt.Sprintf("unknown policy %q, expected one of %q", e.Name, e.Valid)
+}
+
+/*
+checkPhoneCountries compares the country of every user with the calling code of their phone number. Countries that
+share the calling code all match, because numbers move between them: +44 is used by the UK, Guernsey, Jersey and the
+Isle of Man, and +1 by the US, Canada and many Caribbean countries. Mismatches are handled according to the policy and
+reported as one item per row.
+
+If the policy is PhoneCountryReject and there are mismatches, ok is false and the items are errors. Otherwise users
+are updated in place and the items are warnings.
+*/
+func checkPhoneCountries(users []db.User, policy PhoneCountryPolicy) (items []ProblemItem, ok bool) {
+	for i := range users {
+		user := &users[i]
+
+		number, err := phone.Parse(user.PhoneNumber, user.Country)
+		if err != nil { // Already validated by ParseUsersCSV, so this is a user that came from elsewhere.
+			continue
+		}
+
+		expected, consistent := phoneRegion(number, user.Country)
+		if consistent {
+			continue
+		}
+
+		item := ProblemItem{
+			Code:  CodePhoneCountryMismatch,
+			Field: "country",
+			Row:   i + 1,
+			Detail: fmt.Sprintf("Phone number %s belongs to %s, but the country is %s", user.PhoneNumber,
+				expected, user.Country),
+		}
+
+		// The country is impossible for the number here, so the number's own region is the better guess
+		if policy == PhoneCountryCorrect && number.Region != "" {
+			item.Code = CodePhoneCountryCorrected
+			item.Detail = fmt.Sprintf("Country changed from %s to %s to match phone number %s", user.Country,
+				number.Region, user.PhoneNumber)
+			user.Country = number.Region
+		}
+
+		items = append(items, item)
+	}
+
+	return items, policy != PhoneCountryReject || len(items) == 0
+}
+
+/*
+phoneRegion reports whether the number can belong to the country, that is whether the country uses the calling code of
+the number. If not, it also returns a description of the region(s) the number does belong to.
+*/
+func phoneRegion(number phone.Number, alpha2 string) (string, bool) {
+	regions := number.Regions()
+	for _, region := range regions {
+		if region == alpha2 {
+			return "", true
+		}
+	}
+
+	if number.Region != "" {
+		return number.Region, false
+	}
+
+	return fmt.Sprintf("one of %v", regions), false
+}
@@ -0,0 +1,20 @@
+package api
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/m-kuzmin/simple-rest-api/country"
+)
+
+// @Summary List countries
+// @Description List all ISO 3166-1 countries. User.Country is always one of their alpha-2 codes.
+// @Produce json
+// @Success 200
+// @Router /countries [get]
+func (s *Server) ListCountries(ctx *gin.Context) {
+	ctx.JSON(http.StatusOK, gin.H{
+		"ok":        true,
+		"countries": country.All(),
+	})
+}
@@ -0,0 +1,136 @@
+package api
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/m-kuzmin/simple-rest-api/db"
+	"github.com/m-kuzmin/simple-rest-api/logging"
+)
+
+// DiffStatus is what an import would do with an uploaded user.
+type DiffStatus string
+
+const (
+	// DiffNew means there is no saved user with the same ID, or the uploaded user has no ID.
+	DiffNew DiffStatus = "new"
+	// DiffChanged means the saved user with the same ID has different fields.
+	DiffChanged DiffStatus = "changed"
+	// DiffUnchanged means the saved user with the same ID is exactly the same.
+	DiffUnchanged DiffStatus = "unchanged"
+)
+
+// FieldChange is a field of a saved user that an import would change.
+type FieldChange struct {
+	Field  string `json:"field"`
+	Before string `json:"before"`
+	After  string `json:"after"`
+}
+
+// UserDiff compares an uploaded user with the saved one.
+type UserDiff struct {
+	Row     int           `json:"row"` // 1-based record number in the uploaded file
+	Status  DiffStatus    `json:"status"`
+	User    db.User       `json:"user"` // The uploaded user as it would be saved
+	Changes []FieldChange `json:"changes,omitempty"`
+}
+
+// ImportDiff is the response of POST /users/diff.
+type ImportDiff struct {
+	OK        bool       `json:"ok"`
+	New       int        `json:"new"`
+	Changed   int        `json:"changed"`
+	Unchanged int        `json:"unchanged"`
+	Users     []UserDiff `json:"users"`
+}
+
+// diffUsers compares every uploaded user with the saved user with the same ID. saved may contain other users as well.
+func diffUsers(uploaded, saved []db.User) ImportDiff {
+	byID := make(map[int64]db.User, len(saved))
+	for _, user := range saved {
+		byID[user.ID] = user
+	}
+
+	diff := ImportDiff{OK: true, Users: make([]UserDiff, len(uploaded))}
+
+	for i, user := range uploaded {
+		userDiff := UserDiff{Row: i + 1, Status: DiffNew, User: user}
+
+		if before, found := byID[user.ID]; found && user.ID != 0 {
+			userDiff.Status = DiffUnchanged
+
+			for _, column := range userColumns {
+				if column.Value(before) != column.Value(user) {
+					userDiff.Status = DiffChanged
+					userDiff.Changes = append(userDiff.Changes, FieldChange{
+						Field:  column.Name,
+						Before: column.Value(before),
+						After:  column.Value(user),
+					})
+				}
+			}
+		}
+
+		switch userDiff.Status {
+		case DiffNew:
+			diff.New++
+		case DiffChanged:
+			diff.Changed++
+		case DiffUnchanged:
+			diff.Unchanged++
+		}
+
+		diff.Users[i] = userDiff
+	}
+
+	return diff
+}
+
+// @Summary Preview an import
+// @Description Compare an upload with the saved users without saving anything. Every uploaded user is reported as
+// @Description new, changed (with the old and new value of every changed field) or unchanged, matched by ID. The upload
+// @Description is parsed and normalized like in PUT /users, but the phone country and duplicate policies are not
+// @Description applied.
+// @Accept text/csv,json
+// @Produce json
+// @Param profile query string false "Name of the import profile to read the CSV file with"
+// @Success 200
+// @Failure 404,415,422
+// @Router /users/diff [post]
+func (s *Server) DiffUsers(ctx *gin.Context) {
+	tape := logging.NewTape(
+		logging.DebugLevel,
+		logging.NewPrefixedLogger(logging.GlobalLogger, "(Tape (APICall POST /users/diff))"),
+		logging.ErrorLevel,
+		logging.NewPrefixedLogger(logging.GlobalLogger, "(APICall POST /users/diff)"),
+	)
+
+	users, ok := s.readUploadedUsers(ctx, tape)
+	if !ok {
+		return
+	}
+
+	queryCtx, cancel := queryContext(ctx, s.timeouts.Import)
+	defer cancel()
+
+	ids := make([]int64, 0, len(users))
+
+	for _, user := range users {
+		if user.ID != 0 {
+			ids = append(ids, user.ID)
+		}
+	}
+
+	saved, err := s.db.GetUsersByIDs(queryCtx, ids)
+	if err != nil {
+		tape.Errorf("DB error while calling GetUsersByIDs: %s", err)
+		dbProblemResponse(ctx, err)
+
+		return
+	}
+
+	diff := diffUsers(users, saved)
+
+	tape.Infof("Returning diff: %d new, %d changed, %d unchanged", diff.New, diff.Changed, diff.Unchanged)
+	ctx.JSON(http.StatusOK, diff)
+}
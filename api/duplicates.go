@@ -0,0 +1,266 @@
+package api
+
+import (
+	"fmt"
+
+	"github.com/m-kuzmin/simple-rest-api/db"
+)
+
+// DuplicatePolicy decides what an import does with users that are already in the file or in the database.
+type DuplicatePolicy string
+
+const (
+	// DuplicatesFail fails the import and reports every duplicate row.
+	DuplicatesFail DuplicatePolicy = "fail"
+	// DuplicatesKeepFirst skips rows that duplicate an earlier row or a saved user.
+	DuplicatesKeepFirst DuplicatePolicy = "keep-first"
+	/*
+		DuplicatesKeepLast drops earlier rows with the same ID and overwrites saved users with the duplicate row. A saved user
+		is only overwritten once, later rows that duplicate it are skipped and reported as a conflict.
+	*/
+	DuplicatesKeepLast DuplicatePolicy = "keep-last"
+	// DuplicatesFlag imports duplicates and reports them. Rows with the same ID as an earlier row get a new ID.
+	DuplicatesFlag DuplicatePolicy = "flag"
+)
+
+// ParseConflictPolicy returns the db.ConflictPolicy with this name.
+func ParseConflictPolicy(name string) (db.ConflictPolicy, error) {
+	switch policy := db.ConflictPolicy(name); policy {
+	case db.ConflictFail, db.ConflictSkip, db.ConflictOverwrite:
+		return policy, nil
+	default:
+		return "", unknownPolicyError{Name: name, Valid: []string{
+			string(db.ConflictFail), string(db.ConflictSkip), string(db.ConflictOverwrite),
+		}}
+	}
+}
+
+/*
+idConflicts reports every row with the ID of a saved user. Used to point at the rows when the import fails because of
+db.ConflictFail.
+*/
+func idConflicts(users, saved []db.User) []ProblemItem {
+	savedIDs := make(map[int64]bool, len(saved))
+	for _, user := range saved {
+		savedIDs[user.ID] = true
+	}
+
+	items := []ProblemItem{}
+
+	for i, user := range users {
+		if user.ID != 0 && savedIDs[user.ID] {
+			items = append(items, ProblemItem{
+				Code:   CodeConflict,
+				Detail: fmt.Sprintf("User %d already exists", user.ID),
+				Field:  "id",
+				Row:    i + 1,
+			})
+		}
+	}
+
+	return items
+}
+
+// ParseDuplicatePolicy returns the policy with this name.
+func ParseDuplicatePolicy(name string) (DuplicatePolicy, error) {
+	switch policy := DuplicatePolicy(name); policy {
+	case DuplicatesFail, DuplicatesKeepFirst, DuplicatesKeepLast, DuplicatesFlag:
+		return policy, nil
+	default:
+		return "", unknownPolicyError{Name: name, Valid: []string{
+			string(DuplicatesFail), string(DuplicatesKeepFirst), string(DuplicatesKeepLast), string(DuplicatesFlag),
+		}}
+	}
+}
+
+// importEntry is a user that an import will save, together with where it came from.
+type importEntry struct {
+	User    db.User
+	Row     int  // 1-based record number in the uploaded file
+	Update  bool // Overwrite the saved user with the same ID instead of creating one
+	Dropped bool // Replaced by a later row
+}
+
+// importPlan is what is left of an upload after duplicates are resolved.
+type importPlan struct {
+	Entries []importEntry
+	Items   []ProblemItem
+}
+
+// Create returns the users to create and the row each of them came from.
+func (p importPlan) Create() ([]db.User, []int) {
+	return p.users(false)
+}
+
+// Update returns the saved users to overwrite and the row each of them came from.
+func (p importPlan) Update() ([]db.User, []int) {
+	return p.users(true)
+}
+
+func (p importPlan) users(update bool) ([]db.User, []int) {
+	users, rows := []db.User{}, []int{}
+
+	for _, entry := range p.Entries {
+		if !entry.Dropped && entry.Update == update {
+			users = append(users, entry.User)
+			rows = append(rows, entry.Row)
+		}
+	}
+
+	return users, rows
+}
+
+/*
+resolveDuplicates finds rows that have the same ID as an earlier row, and rows that are probable duplicates of a saved
+user with a different ID according to db.ProbableDuplicates. saved must contain every such user, see
+db.UserQuerier.MatchUsers. Duplicates are handled according to the policy and reported as one item per row. Rows with
+the ID of a saved user are left to the db.ConflictPolicy of the import.
+
+If the policy is DuplicatesFail and there are duplicates, ok is false and the items are errors. Otherwise the items are
+warnings.
+*/
+func resolveDuplicates(users, saved []db.User, policy DuplicatePolicy) (plan importPlan, ok bool) {
+	rowOfID := make(map[int64]int, len(users)) // ID to index in plan.Entries
+	index := newSavedIndex(saved)
+
+	for i, user := range users {
+		entry := importEntry{User: user, Row: i + 1}
+
+		if first, found := rowOfID[user.ID]; found && user.ID != 0 {
+			item, keep := resolveInFile(&plan, first, &entry, policy)
+			plan.Items = append(plan.Items, item)
+
+			if !keep {
+				continue
+			}
+		}
+
+		if match, found := index.Duplicate(entry.User); found {
+			claimedBy := 0 // Row of an earlier entry that already saves match
+			if first, found := rowOfID[match.ID]; found && !plan.Entries[first].Dropped {
+				claimedBy = plan.Entries[first].Row
+			}
+
+			item, keep := resolveSaved(match, claimedBy, &entry, policy)
+			plan.Items = append(plan.Items, item)
+
+			if !keep {
+				continue
+			}
+		}
+
+		if entry.User.ID != 0 {
+			rowOfID[entry.User.ID] = len(plan.Entries)
+		}
+
+		plan.Entries = append(plan.Entries, entry)
+	}
+
+	return plan, policy != DuplicatesFail || len(plan.Items) == 0
+}
+
+// resolveInFile handles an entry with the same ID as plan.Entries[first]. Returns false if the entry is skipped.
+func resolveInFile(plan *importPlan, first int, entry *importEntry, policy DuplicatePolicy) (ProblemItem, bool) {
+	firstRow := plan.Entries[first].Row
+	item := ProblemItem{
+		Code:   CodeDuplicateUser,
+		Field:  "id",
+		Row:    entry.Row,
+		Detail: fmt.Sprintf("ID %d is also used by row %d", entry.User.ID, firstRow),
+	}
+
+	switch policy {
+	case DuplicatesFail:
+		return item, false
+	case DuplicatesKeepFirst:
+		item.Detail = fmt.Sprintf("Skipped because row %d has the same ID %d", firstRow, entry.User.ID)
+
+		return item, false
+	case DuplicatesKeepLast:
+		plan.Entries[first].Dropped = true
+		item.Detail = fmt.Sprintf("Replaces row %d, which has the same ID %d", firstRow, entry.User.ID)
+	case DuplicatesFlag:
+		item.Detail = fmt.Sprintf("Imported under a new ID because row %d has the same ID %d", firstRow, entry.User.ID)
+		entry.User.ID = 0
+	}
+
+	return item, true
+}
+
+/*
+resolveSaved handles an entry that duplicates the saved user match. claimedBy is the row of an earlier entry that
+already saves match, or 0. Returns false if the entry is skipped.
+*/
+func resolveSaved(match db.User, claimedBy int, entry *importEntry, policy DuplicatePolicy) (ProblemItem, bool) {
+	item := ProblemItem{
+		Code:   CodeDuplicateUser,
+		Row:    entry.Row,
+		Detail: fmt.Sprintf("Probably the same person as user %d", match.ID),
+	}
+
+	switch policy {
+	case DuplicatesFail:
+		return item, false
+	case DuplicatesKeepFirst:
+		item.Detail += ", skipped"
+
+		return item, false
+	case DuplicatesKeepLast:
+		if claimedBy != 0 {
+			// Overwriting the user again would silently lose row claimedBy
+			item.Code = CodeConflict
+			item.Detail += fmt.Sprintf(", skipped because row %d already overwrites it", claimedBy)
+
+			return item, false
+		}
+
+		item.Detail += fmt.Sprintf(", user %d is overwritten", match.ID)
+		entry.User.ID = match.ID
+		entry.Update = true
+	case DuplicatesFlag: // Imported as is
+	}
+
+	return item, true
+}
+
+// nameCity is the folded name and city of a user, which db.ProbableDuplicates compares.
+type nameCity struct {
+	Name, City string
+}
+
+// savedIndex groups saved users the way db.ProbableDuplicates compares them, so that rows are not compared to all.
+type savedIndex struct {
+	byPhone    map[string][]db.User
+	byNameCity map[nameCity][]db.User
+}
+
+func newSavedIndex(saved []db.User) savedIndex {
+	index := savedIndex{
+		byPhone:    make(map[string][]db.User, len(saved)),
+		byNameCity: make(map[nameCity][]db.User, len(saved)),
+	}
+
+	for _, user := range saved {
+		key := nameCity{Name: db.FoldText(user.Name), City: db.FoldText(user.City)}
+		index.byPhone[user.PhoneNumber] = append(index.byPhone[user.PhoneNumber], user)
+		index.byNameCity[key] = append(index.byNameCity[key], user)
+	}
+
+	return index
+}
+
+// Duplicate returns the saved user with the lowest ID that has a different ID and is a probable duplicate of user.
+func (i savedIndex) Duplicate(user db.User) (db.User, bool) {
+	key := nameCity{Name: db.FoldText(user.Name), City: db.FoldText(user.City)}
+	match, found := db.User{}, false
+
+	for _, group := range [][]db.User{i.byPhone[user.PhoneNumber], i.byNameCity[key]} {
+		for _, candidate := range group {
+			if candidate.ID != user.ID && (!found || candidate.ID < match.ID) {
+				match, found = candidate, true
+			}
+		}
+	}
+
+	return match, found
+}
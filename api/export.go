@@ -0,0 +1,179 @@
+package api
+
+import (
+	"encoding/csv"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/m-kuzmin/simple-rest-api/db"
+	"github.com/m-kuzmin/simple-rest-api/logging"
+)
+
+// userColumn is a column of the users CSV file.
+type userColumn struct {
+	Name  string
+	Value func(db.User) string
+	// Optional columns are only exported when requested by name.
+	Optional bool
+}
+
+/*
+userColumns lists all columns. The non-optional ones are in the order ParseUsersCSV expects them, so an export with
+default settings can be uploaded back as is.
+*/
+var userColumns = []userColumn{ //nolint:gochecknoglobals // Read-only table of columns
+	{Name: "id", Value: func(u db.User) string { return strconv.FormatInt(u.ID, 10) }},
+	{Name: "name", Value: func(u db.User) string { return u.Name }},
+	{Name: "phoneNumber", Value: func(u db.User) string { return u.PhoneNumber }},
+	{Name: "country", Value: func(u db.User) string { return u.Country }},
+	{Name: "city", Value: func(u db.User) string { return u.City }},
+	{Name: "phoneNumberRaw", Value: func(u db.User) string { return u.PhoneNumberRaw }, Optional: true},
+}
+
+type unknownColumnError struct {
+	Column string
+}
+
+func (e unknownColumnError) Error() string {
+	return fmt.Sprintf("unknown column %q", e.Column)
+}
+
+/*
+parseUserColumns turns a comma separated list of column names into columns. An empty list selects all non-optional
+columns in the default order.
+*/
+func parseUserColumns(list string) ([]userColumn, error) {
+	if list == "" {
+		columns := make([]userColumn, 0, len(userColumns))
+
+		for _, column := range userColumns {
+			if !column.Optional {
+				columns = append(columns, column)
+			}
+		}
+
+		return columns, nil
+	}
+
+	names := strings.Split(list, ",")
+	columns := make([]userColumn, 0, len(names))
+
+	for _, name := range names {
+		found := false
+
+		for _, column := range userColumns {
+			if column.Name == strings.TrimSpace(name) {
+				columns = append(columns, column)
+				found = true
+
+				break
+			}
+		}
+
+		if !found {
+			return nil, unknownColumnError{Column: name}
+		}
+	}
+
+	return columns, nil
+}
+
+// csvUserStream writes users as CSV records. See userColumns for the available columns.
+type csvUserStream struct {
+	ctx        *gin.Context
+	writer     *csv.Writer
+	columns    []userColumn
+	record     []string
+	withHeader bool
+}
+
+/*
+newCSVUserStream reads the CSV options from the query: "columns" is a comma separated list of columns to include and
+"header" enables the header row.
+*/
+func newCSVUserStream(ctx *gin.Context) (*csvUserStream, error) {
+	columns, err := parseUserColumns(ctx.Query("columns"))
+	if err != nil {
+		return nil, fmt.Errorf("bad column list: %w", err)
+	}
+
+	withHeader, err := strconv.ParseBool(ctx.DefaultQuery("header", "false"))
+	if err != nil {
+		return nil, fmt.Errorf(`expected "header" to be true or false: %w`, err)
+	}
+
+	return &csvUserStream{
+		ctx:        ctx,
+		writer:     csv.NewWriter(ctx.Writer),
+		columns:    columns,
+		record:     make([]string, len(columns)),
+		withHeader: withHeader,
+	}, nil
+}
+
+// Start implements userStream.
+func (s *csvUserStream) Start(httpCode int) error {
+	s.ctx.Header("Content-Type", mimeCSV+"; charset=utf-8")
+	s.ctx.Status(httpCode)
+
+	if !s.withHeader {
+		return nil
+	}
+
+	for i, column := range s.columns {
+		s.record[i] = column.Name
+	}
+
+	if err := s.writer.Write(s.record); err != nil {
+		return fmt.Errorf("writing CSV header: %w", err)
+	}
+
+	return nil
+}
+
+// Write implements userStream.
+func (s *csvUserStream) Write(user db.User) error {
+	for i, column := range s.columns {
+		s.record[i] = column.Value(user)
+	}
+
+	if err := s.writer.Write(s.record); err != nil {
+		return fmt.Errorf("writing CSV record: %w", err)
+	}
+
+	return nil
+}
+
+// Flush implements userStream.
+func (s *csvUserStream) Flush() error {
+	s.writer.Flush()
+
+	if err := s.writer.Error(); err != nil {
+		return fmt.Errorf("flushing CSV: %w", err)
+	}
+
+	return nil
+}
+
+// @Summary Export users as CSV
+// @Description Stream users as a CSV file in the same format PUT /users accepts. Same as GET /users with
+// @Description `Accept: text/csv`.
+// @Produce text/csv
+// @Param name query string false "Part of the user's name"
+// @Param country query string false "Country code or name"
+// @Param columns query string false "Comma separated list of columns to include, all by default"
+// @Param header query bool false "Include a header row"
+// @Success 200
+// @Router /users.csv [get]
+func (s *Server) ExportUsersCSV(ctx *gin.Context) {
+	tape := logging.NewTape(
+		logging.DebugLevel,
+		logging.NewPrefixedLogger(logging.GlobalLogger, "(Tape (APICall GET /users.csv))"),
+		logging.ErrorLevel,
+		logging.NewPrefixedLogger(logging.GlobalLogger, "(APICall GET /users.csv)"),
+	)
+
+	s.listUsers(ctx, tape, mimeCSV)
+}
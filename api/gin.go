@@ -7,10 +7,47 @@ import (
 
 func NewGinRouter(server *Server) *gin.Engine {
 	router := gin.New()
+	router.HandleMethodNotAllowed = true
+	router.NoRoute(noRouteHandler)
+	router.NoMethod(noMethodHandler)
+	router.Use(gin.CustomRecovery(recoveryHandler))
 
 	router.PUT("/users", server.CreateOrUpdateUsers)
+	router.GET("/users", server.SearchUsers)
+	router.GET("/users.csv", server.ExportUsersCSV)
+	router.GET("/users/duplicates", server.ListDuplicates)
+	router.GET("/users/merges", server.ListMerges)
+	router.POST("/users/merge", server.MergeUsers)
+	router.POST("/users/diff", server.DiffUsers)
+	router.GET("/users/:id", server.GetUser)
+	router.PATCH("/users/:id", server.UpdateUser)
+	router.GET("/countries", server.ListCountries)
+	router.POST("/import-profiles", server.CreateImportProfile)
+	router.GET("/import-profiles", server.ListImportProfiles)
+	router.GET("/import-profiles/:name", server.GetImportProfile)
+	router.PUT("/import-profiles/:name", server.UpdateImportProfile)
+	router.DELETE("/import-profiles/:name", server.DeleteImportProfile)
 
 	logging.Infof("Gin router is set-up.")
 
 	return router
 }
+
+/*
+NewAdminRouter serves the operator endpoints: pool stats and metrics. They are not on the NewGinRouter router, because
+they have no authentication and show how the server is used. Serve it on an address only operators can reach.
+*/
+func NewAdminRouter(server *Server) *gin.Engine {
+	router := gin.New()
+	router.HandleMethodNotAllowed = true
+	router.NoRoute(noRouteHandler)
+	router.NoMethod(noMethodHandler)
+	router.Use(gin.CustomRecovery(recoveryHandler))
+
+	router.GET("/admin/db/stats", server.DBStats)
+	router.GET("/metrics", server.Metrics)
+
+	logging.Infof("Admin router is set-up.")
+
+	return router
+}
@@ -2,15 +2,23 @@ package api_test
 
 import (
 	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"strings"
 	"testing"
+	"testing/iotest"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/m-kuzmin/simple-rest-api/api"
+	"github.com/m-kuzmin/simple-rest-api/country"
 	"github.com/m-kuzmin/simple-rest-api/db"
 	"github.com/m-kuzmin/simple-rest-api/logging"
 	"github.com/stretchr/testify/assert"
@@ -60,7 +68,14 @@ func TestShouldSaveUsersToDatabase(t *testing.T) {
 	// Send the request and check the DB
 	ginRouter.ServeHTTP(recorder, req)
 	assert.Equal(t, http.StatusCreated, recorder.Code)
-	assert.Equal(t, users, database.Users)
+
+	// Phone numbers are stored in E.164 and the uploaded value is kept as is
+	for i := range users {
+		users[i].PhoneNumberRaw = users[i].PhoneNumber
+		users[i].PhoneNumber = "+" + users[i].PhoneNumber
+	}
+
+	assert.Equal(t, users, savedUsers(t, database))
 }
 
 func TestShouldRejectCreateUsersWrongContentType(t *testing.T) {
@@ -92,6 +107,469 @@ func TestShouldRejectCreateUsersBadCSV(t *testing.T) {
 	ginRouter := api.NewGinRouter(api.NewServer(db.NewInMemoryDB()))
 	ginRouter.ServeHTTP(recorder, req)
 	assert.Equal(t, http.StatusUnprocessableEntity, recorder.Code)
+
+	problem := decodeProblem(t, recorder)
+	assert.Equal(t, api.CodeInvalidField, problem.Code)
+	assert.Equal(t, []api.ProblemItem{{
+		Code:   api.CodeInvalidField,
+		Detail: `ID is not a number: strconv.ParseInt: parsing "notid": invalid syntax`,
+		Field:  "id",
+		Row:    1,
+	}}, problem.Errors)
+}
+
+func TestShouldRejectCreateUsersWrongFieldCount(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, "/users", strings.NewReader("1,John Doe\n"))
+	assert.Nil(t, err)
+	req.Header.Set("content-type", "text/csv")
+
+	recorder := httptest.NewRecorder()
+
+	ginRouter := api.NewGinRouter(api.NewServer(db.NewInMemoryDB()))
+	ginRouter.ServeHTTP(recorder, req)
+	assert.Equal(t, http.StatusUnprocessableEntity, recorder.Code)
+	assert.Equal(t, api.CodeInvalidField, decodeProblem(t, recorder).Code)
+}
+
+func TestShouldRejectCreateUsersInvalidPhoneNumber(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, "/users",
+		strings.NewReader("1,John Doe,18001234567,US,New York City\n2,Jane Doe,12,US,Boston\n"))
+	assert.Nil(t, err)
+	req.Header.Set("content-type", "text/csv")
+
+	recorder := httptest.NewRecorder()
+
+	database := db.NewInMemoryDB()
+	ginRouter := api.NewGinRouter(api.NewServer(database))
+	ginRouter.ServeHTTP(recorder, req)
+	assert.Equal(t, http.StatusUnprocessableEntity, recorder.Code)
+	assert.Empty(t, savedUsers(t, database))
+
+	problem := decodeProblem(t, recorder)
+	assert.Len(t, problem.Errors, 1)
+	assert.Equal(t, "phoneNumber", problem.Errors[0].Field)
+	assert.Equal(t, 2, problem.Errors[0].Row)
+}
+
+func TestShouldCanonicalizeCountries(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, "/users",
+		strings.NewReader("1,John Doe,18001234567,United States,New York City\n"+
+			"2,Hans Müller,030 1234567,Deutschland,Berlin\n"))
+	assert.Nil(t, err)
+	req.Header.Set("content-type", "text/csv")
+
+	recorder := httptest.NewRecorder()
+
+	database := db.NewInMemoryDB()
+	ginRouter := api.NewGinRouter(api.NewServer(database))
+	ginRouter.ServeHTTP(recorder, req)
+	assert.Equal(t, http.StatusCreated, recorder.Code)
+	assert.Equal(t, "US", savedUsers(t, database)[0].Country)
+	assert.Equal(t, "DE", savedUsers(t, database)[1].Country)
+	assert.Equal(t, "+49301234567", savedUsers(t, database)[1].PhoneNumber, "national numbers use the user's country")
+}
+
+func TestShouldRejectCreateUsersUnknownCountry(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, "/users",
+		strings.NewReader("1,John Doe,18001234567,Atlantis,Poseidonia\n"))
+	assert.Nil(t, err)
+	req.Header.Set("content-type", "text/csv")
+
+	recorder := httptest.NewRecorder()
+
+	ginRouter := api.NewGinRouter(api.NewServer(db.NewInMemoryDB()))
+	ginRouter.ServeHTTP(recorder, req)
+	assert.Equal(t, http.StatusUnprocessableEntity, recorder.Code)
+
+	problem := decodeProblem(t, recorder)
+	assert.Len(t, problem.Errors, 1)
+	assert.Equal(t, "country", problem.Errors[0].Field)
+}
+
+func TestShouldListCountries(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "/countries", nil)
+	assert.Nil(t, err)
+
+	recorder := httptest.NewRecorder()
+
+	ginRouter := api.NewGinRouter(api.NewServer(db.NewInMemoryDB()))
+	ginRouter.ServeHTTP(recorder, req)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+
+	var body struct {
+		Countries []country.Country `json:"countries"`
+	}
+
+	assert.Nil(t, json.Unmarshal(recorder.Body.Bytes(), &body))
+	assert.Len(t, body.Countries, 249)
+	assert.Contains(t, body.Countries, country.Country{Alpha2: "US", Alpha3: "USA", Numeric: "840", Name: "United States"})
+}
+
+func TestShouldHandlePhoneCountryMismatchPerPolicy(t *testing.T) {
+	t.Parallel()
+
+	// Row 2 has a British number but says it is from Germany
+	const users = "1,John Doe,18002234567,US,New York City\n2,Jane Doe,+44 20 7946 0958,DE,London\n"
+
+	tests := []struct {
+		query   string
+		code    int
+		country string
+		item    api.ErrorCode
+	}{
+		{query: "", code: http.StatusCreated, country: "DE", item: api.CodePhoneCountryMismatch},
+		{query: "?phoneCountry=warn", code: http.StatusCreated, country: "DE", item: api.CodePhoneCountryMismatch},
+		{query: "?phoneCountry=correct", code: http.StatusCreated, country: "GB", item: api.CodePhoneCountryCorrected},
+		{query: "?phoneCountry=reject", code: http.StatusUnprocessableEntity, item: api.CodePhoneCountryMismatch},
+		{query: "?phoneCountry=maybe", code: http.StatusBadRequest},
+	}
+
+	for _, test := range tests {
+		req, err := http.NewRequestWithContext(context.Background(), http.MethodPut, "/users"+test.query,
+			strings.NewReader(users))
+		assert.Nil(t, err)
+		req.Header.Set("content-type", "text/csv")
+
+		recorder := httptest.NewRecorder()
+
+		database := db.NewInMemoryDB()
+		ginRouter := api.NewGinRouter(api.NewServer(database))
+		ginRouter.ServeHTTP(recorder, req)
+		assert.Equal(t, test.code, recorder.Code, test.query)
+
+		var items []api.ProblemItem
+
+		switch test.code {
+		case http.StatusCreated:
+			var report api.ImportReport
+
+			assert.Nil(t, json.Unmarshal(recorder.Body.Bytes(), &report))
+			assert.Equal(t, test.country, savedUsers(t, database)[1].Country, test.query)
+
+			items = report.Warnings
+		case http.StatusUnprocessableEntity:
+			assert.Empty(t, savedUsers(t, database), test.query)
+
+			items = decodeProblem(t, recorder).Errors
+		default:
+			continue
+		}
+
+		assert.Len(t, items, 1, test.query)
+		assert.Equal(t, test.item, items[0].Code, test.query)
+		assert.Equal(t, 2, items[0].Row, test.query)
+	}
+}
+
+func TestShouldAcceptCountriesSharingTheCallingCode(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		number, country, corrected string
+	}{
+		// +44 7911 is a Guernsey range, but the UK, Jersey and the Isle of Man share +44
+		{number: "+44 7911 123456", country: "GB", corrected: "GB"},
+		{number: "+44 7911 123456", country: "GG", corrected: "GG"},
+		{number: "+44 7911 123456", country: "JE", corrected: "JE"},
+		{number: "+44 7911 123456", country: "IM", corrected: "IM"},
+		{number: "+44 7624 123456", country: "GB", corrected: "GB"},
+		{number: "+44 7911 123456", country: "DE", corrected: "GG"},
+		// +1 is shared by the US and Canada
+		{number: "+1 613 555 0123", country: "US", corrected: "US"},
+		{number: "+1 212 555 0123", country: "CA", corrected: "CA"},
+		{number: "+1 212 555 0123", country: "DE", corrected: "US"},
+	}
+
+	for _, test := range tests {
+		req, err := http.NewRequestWithContext(context.Background(), http.MethodPut, "/users?phoneCountry=correct",
+			strings.NewReader("1,Jane Doe,"+test.number+","+test.country+",Somewhere\n"))
+		assert.Nil(t, err)
+		req.Header.Set("content-type", "text/csv")
+
+		recorder := httptest.NewRecorder()
+
+		database := db.NewInMemoryDB()
+		api.NewGinRouter(api.NewServer(database)).ServeHTTP(recorder, req)
+		assert.Equal(t, http.StatusCreated, recorder.Code, test)
+
+		var report api.ImportReport
+
+		assert.Nil(t, json.Unmarshal(recorder.Body.Bytes(), &report))
+		assert.Equal(t, test.corrected, savedUsers(t, database)[0].Country, test)
+		assert.Equal(t, test.country != test.corrected, len(report.Warnings) == 1, test)
+	}
+}
+
+func TestShouldUseServerPhoneCountryPolicy(t *testing.T) {
+	t.Parallel()
+
+	req, err := http.NewRequestWithContext(context.Background(), http.MethodPut, "/users",
+		strings.NewReader("1,Jane Doe,+44 20 7946 0958,DE,London\n"))
+	assert.Nil(t, err)
+	req.Header.Set("content-type", "text/csv")
+
+	recorder := httptest.NewRecorder()
+
+	server := api.NewServer(db.NewInMemoryDB(), api.WithPhoneCountryPolicy(api.PhoneCountryReject))
+	api.NewGinRouter(server).ServeHTTP(recorder, req)
+	assert.Equal(t, http.StatusUnprocessableEntity, recorder.Code)
+}
+
+func TestShouldHandleDuplicatesPerPolicy(t *testing.T) {
+	t.Parallel()
+
+	saved := db.User{
+		Name: "John Doe", PhoneNumber: "+18001234567", PhoneNumberRaw: "18001234567", Country: "US",
+		City: "New York City", ID: 1,
+	}
+
+	// Row 2 has the same ID as row 1, row 3 has the same phone number as the saved user
+	const users = "2,Jane Doe,18002234567,US,Boston\n" +
+		"2,Jane Roe,18003234567,US,Boston\n" +
+		"3,Johnny Doe,+1 800 123 4567,US,Newark\n"
+
+	tests := []struct {
+		query string
+		code  int
+		users map[int64]string // ID to name of every user in the DB after the import
+	}{
+		{query: "", code: http.StatusConflict, users: map[int64]string{1: "John Doe"}},
+		{query: "?duplicates=fail", code: http.StatusConflict, users: map[int64]string{1: "John Doe"}},
+		{
+			query: "?duplicates=keep-first",
+			code:  http.StatusCreated,
+			users: map[int64]string{1: "John Doe", 2: "Jane Doe"},
+		},
+		{
+			query: "?duplicates=keep-last",
+			code:  http.StatusCreated,
+			users: map[int64]string{1: "Johnny Doe", 2: "Jane Roe"},
+		},
+		{
+			query: "?duplicates=flag",
+			code:  http.StatusCreated,
+			users: map[int64]string{1: "John Doe", 2: "Jane Doe", 3: "Johnny Doe", 4: "Jane Roe"},
+		},
+		{query: "?duplicates=maybe", code: http.StatusBadRequest, users: map[int64]string{1: "John Doe"}},
+	}
+
+	for _, test := range tests {
+		database := db.NewInMemoryDB()
+		assert.Nil(t, database.CreateUsers(context.Background(), []db.User{saved}))
+
+		req, err := http.NewRequestWithContext(context.Background(), http.MethodPut, "/users"+test.query,
+			strings.NewReader(users))
+		assert.Nil(t, err)
+		req.Header.Set("content-type", "text/csv")
+
+		recorder := httptest.NewRecorder()
+		api.NewGinRouter(api.NewServer(database)).ServeHTTP(recorder, req)
+		assert.Equal(t, test.code, recorder.Code, test.query)
+
+		names := map[int64]string{}
+		for _, user := range savedUsers(t, database) {
+			names[user.ID] = user.Name
+		}
+
+		assert.Equal(t, test.users, names, test.query)
+
+		var items []api.ProblemItem
+
+		switch test.code {
+		case http.StatusCreated:
+			var report api.ImportReport
+
+			assert.Nil(t, json.Unmarshal(recorder.Body.Bytes(), &report))
+
+			items = report.Warnings
+		case http.StatusConflict:
+			items = decodeProblem(t, recorder).Errors
+		default:
+			continue
+		}
+
+		rows := []int{}
+		for _, item := range items {
+			assert.Equal(t, api.CodeDuplicateUser, item.Code, test.query)
+
+			rows = append(rows, item.Row)
+		}
+
+		assert.Equal(t, []int{2, 3}, rows, test.query)
+	}
+}
+
+func TestShouldResolveIDConflictsPerPolicy(t *testing.T) {
+	t.Parallel()
+
+	saved := db.User{
+		Name: "John Doe", PhoneNumber: "+18001234567", PhoneNumberRaw: "18001234567", Country: "US", City: "Denver", ID: 1,
+	}
+
+	const users = "1,Johnny Doe,18001234567,US,Boston\n,Jane Doe,18002234567,US,Los Angeles\n"
+
+	tests := []struct {
+		query  string
+		code   int
+		name   string
+		city   string
+		counts db.ImportCounts
+	}{
+		{query: "", code: http.StatusConflict, name: "John Doe", city: "Denver"},
+		{query: "?conflict=fail", code: http.StatusConflict, name: "John Doe", city: "Denver"},
+		{
+			query:  "?conflict=skip",
+			code:   http.StatusCreated,
+			name:   "John Doe",
+			city:   "Denver",
+			counts: db.ImportCounts{Created: 1, Skipped: 1},
+		},
+		{
+			query:  "?conflict=overwrite",
+			code:   http.StatusCreated,
+			name:   "Johnny Doe",
+			city:   "Boston",
+			counts: db.ImportCounts{Created: 1, Updated: 1},
+		},
+		{query: "?conflict=fill-empty", code: http.StatusBadRequest, name: "John Doe", city: "Denver"},
+		{query: "?conflict=maybe", code: http.StatusBadRequest, name: "John Doe", city: "Denver"},
+	}
+
+	for _, test := range tests {
+		database := db.NewInMemoryDB()
+		assert.Nil(t, database.CreateUsers(context.Background(), []db.User{saved}))
+
+		req, err := http.NewRequestWithContext(context.Background(), http.MethodPut, "/users"+test.query,
+			strings.NewReader(users))
+		assert.Nil(t, err)
+		req.Header.Set("content-type", "text/csv")
+
+		recorder := httptest.NewRecorder()
+		api.NewGinRouter(api.NewServer(database)).ServeHTTP(recorder, req)
+		assert.Equal(t, test.code, recorder.Code, test.query)
+
+		user, err := database.GetUserByID(context.Background(), 1)
+		assert.Nil(t, err)
+		assert.Equal(t, test.name, user.Name, test.query)
+		assert.Equal(t, test.city, user.City, test.query)
+
+		switch test.code {
+		case http.StatusCreated:
+			var report api.ImportReport
+
+			assert.Nil(t, json.Unmarshal(recorder.Body.Bytes(), &report))
+			assert.Equal(t, test.counts, report.Counts, test.query)
+			assert.Len(t, savedUsers(t, database), 2, test.query)
+		case http.StatusConflict:
+			problem := decodeProblem(t, recorder)
+			assert.Equal(t, api.CodeConflict, problem.Code, test.query)
+			assert.Equal(t, []api.ProblemItem{{
+				Code: api.CodeConflict, Detail: "User 1 already exists", Field: "id", Row: 1,
+			}}, problem.Errors, test.query)
+			assert.Len(t, savedUsers(t, database), 1, test.query)
+		}
+	}
+}
+
+func TestShouldOverwriteASavedDuplicateOnlyOnce(t *testing.T) {
+	t.Parallel()
+
+	saved := db.User{
+		Name: "John Doe", PhoneNumber: "+18001234567", PhoneNumberRaw: "18001234567", Country: "US",
+		City: "New York City", ID: 1,
+	}
+
+	// Row 1 has the phone number and row 2 the name and city of the saved user
+	const users = "2,Johnny Doe,+1 800 123 4567,US,Newark\n" +
+		"3,John Doe,18002234567,US,New York City\n"
+
+	database := db.NewInMemoryDB()
+	assert.Nil(t, database.CreateUsers(context.Background(), []db.User{saved}))
+
+	req, err := http.NewRequestWithContext(context.Background(), http.MethodPut, "/users?duplicates=keep-last",
+		strings.NewReader(users))
+	assert.Nil(t, err)
+	req.Header.Set("content-type", "text/csv")
+
+	recorder := httptest.NewRecorder()
+	api.NewGinRouter(api.NewServer(database)).ServeHTTP(recorder, req)
+	assert.Equal(t, http.StatusCreated, recorder.Code)
+
+	var report api.ImportReport
+
+	assert.Nil(t, json.Unmarshal(recorder.Body.Bytes(), &report))
+	assert.Equal(t, db.ImportCounts{Created: 0, Updated: 1, Skipped: 1}, report.Counts)
+
+	if assert.Len(t, report.Warnings, 2) {
+		assert.Equal(t, api.CodeDuplicateUser, report.Warnings[0].Code)
+		assert.Equal(t, api.CodeConflict, report.Warnings[1].Code)
+		assert.Equal(t, 2, report.Warnings[1].Row)
+	}
+
+	if users := savedUsers(t, database); assert.Len(t, users, 1) {
+		assert.Equal(t, "Johnny Doe", users[0].Name)
+	}
+}
+
+func TestShouldTellUnreadableInputFromInternalErrors(t *testing.T) {
+	t.Parallel()
+
+	database := db.NewInMemoryDB()
+	assert.Nil(t, database.CreateImportProfile(context.Background(), db.ImportProfile{
+		Name: "broken", Columns: []string{"name", "phoneNumber", "country", "city"}, Delimiter: ",",
+		Encoding: "no-such-encoding", Header: false, Defaults: nil,
+	}))
+
+	ginRouter := api.NewGinRouter(api.NewServer(database))
+
+	tests := []struct {
+		target string
+		body   io.Reader
+		code   int
+		item   api.ErrorCode
+	}{
+		{
+			target: "/users",
+			body:   io.MultiReader(strings.NewReader("John Doe,"), iotest.ErrReader(io.ErrUnexpectedEOF)),
+			code:   http.StatusBadRequest,
+			item:   api.CodeBadInput,
+		},
+		{
+			target: "/users?profile=broken",
+			body:   strings.NewReader("John Doe,18001234567,US,New York City\n"),
+			code:   http.StatusInternalServerError,
+			item:   api.CodeInternal,
+		},
+	}
+
+	for _, test := range tests {
+		req, err := http.NewRequestWithContext(context.Background(), http.MethodPut, test.target, test.body)
+		assert.Nil(t, err)
+		req.Header.Set("content-type", "text/csv")
+
+		recorder := httptest.NewRecorder()
+		ginRouter.ServeHTTP(recorder, req)
+		assert.Equal(t, test.code, recorder.Code, test.target)
+
+		problem := decodeProblem(t, recorder)
+		assert.Equal(t, test.item, problem.Code, test.target)
+		assert.NotContains(t, problem.Detail, "no-such-encoding", "internal errors must not be shown to the client")
+	}
 }
 
 func TestShouldRejectCreateUsersNilBody(t *testing.T) {
@@ -133,17 +611,967 @@ func TestShouldRejectCreateUsersBadMethod(t *testing.T) {
 
 	recorder := httptest.NewRecorder()
 
+	ginRouter := api.NewGinRouter(api.NewServer(db.NewInMemoryDB()))
+	ginRouter.ServeHTTP(recorder, req)
+	assert.Equal(t, http.StatusMethodNotAllowed, recorder.Code)
+	assert.Equal(t, api.CodeMethodNotAllowed, decodeProblem(t, recorder).Code)
+}
+
+func TestShouldRespondWithProblemForUnknownRoute(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "/nothing-here", nil)
+	assert.Nil(t, err)
+
+	recorder := httptest.NewRecorder()
+
 	ginRouter := api.NewGinRouter(api.NewServer(db.NewInMemoryDB()))
 	ginRouter.ServeHTTP(recorder, req)
 	assert.Equal(t, http.StatusNotFound, recorder.Code)
+
+	problem := decodeProblem(t, recorder)
+	assert.Equal(t, api.CodeRouteNotFound, problem.Code)
+	assert.Equal(t, http.StatusNotFound, problem.Status)
+	assert.Equal(t, "/nothing-here", problem.Instance)
 }
 
-func dbUsersToCSV(users []db.User) io.Reader {
-	final := ""
+func TestShouldSearchUsersIgnoringAccentsAndCase(t *testing.T) {
+	t.Parallel()
 
-	for _, user := range users {
-		final += fmt.Sprintf("%d,%s,%s,%s,%s\n", user.ID, user.Name, user.PhoneNumber, user.Country, user.City)
+	database := db.NewInMemoryDB()
+	err := database.CreateUsers(context.Background(), []db.User{
+		{Name: "José Müller", PhoneNumber: "491701234567", Country: "DE", City: "München", ID: 1},
+		{Name: "John Doe", PhoneNumber: "18001234567", Country: "US", City: "New York City", ID: 2},
+	})
+	assert.Nil(t, err)
+
+	ctx := context.Background()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "/users?name=jose+MULLER", nil)
+	assert.Nil(t, err)
+
+	recorder := httptest.NewRecorder()
+
+	ginRouter := api.NewGinRouter(api.NewServer(database))
+	ginRouter.ServeHTTP(recorder, req)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+
+	var body struct {
+		Users []db.User `json:"users"`
 	}
 
-	return strings.NewReader(final)
+	assert.Nil(t, json.Unmarshal(recorder.Body.Bytes(), &body))
+	assert.Equal(t, []db.User{savedUsers(t, database)[0]}, body.Users)
+}
+
+func TestShouldFilterUsersByCountry(t *testing.T) {
+	t.Parallel()
+
+	database := db.NewInMemoryDB()
+	err := database.CreateUsers(context.Background(), []db.User{
+		{Name: "José Müller", PhoneNumber: "491701234567", Country: "DE", City: "München", ID: 1},
+		{Name: "John Doe", PhoneNumber: "18001234567", Country: "US", City: "New York City", ID: 2},
+	})
+	assert.Nil(t, err)
+
+	ginRouter := api.NewGinRouter(api.NewServer(database))
+
+	req, err := http.NewRequestWithContext(context.Background(), http.MethodGet, "/users?country=Germany", nil)
+	assert.Nil(t, err)
+
+	recorder := httptest.NewRecorder()
+	ginRouter.ServeHTTP(recorder, req)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+
+	var body struct {
+		Users []db.User `json:"users"`
+	}
+
+	assert.Nil(t, json.Unmarshal(recorder.Body.Bytes(), &body))
+	assert.Equal(t, []db.User{savedUsers(t, database)[0]}, body.Users)
+
+	req, err = http.NewRequestWithContext(context.Background(), http.MethodGet, "/users?country=Atlantis", nil)
+	assert.Nil(t, err)
+
+	recorder = httptest.NewRecorder()
+	ginRouter.ServeHTTP(recorder, req)
+	assert.Equal(t, http.StatusBadRequest, recorder.Code)
+	assert.Equal(t, api.CodeBadParameter, decodeProblem(t, recorder).Code)
+}
+
+func TestParseUsersCSVShouldNormalizeToNFC(t *testing.T) {
+	t.Parallel()
+
+	const decomposed = "Jose\u0301 Mu\u0308ller" // "José Müller" with combining accents
+
+	users, err := api.ParseUsersCSV(csv.NewReader(strings.NewReader("1," + decomposed + ",18001234567,US,NYC\n")))
+	assert.Nil(t, err)
+	assert.Equal(t, "José Müller", users[0].Name)
+}
+
+func TestShouldExportUsersAsCSV(t *testing.T) {
+	t.Parallel()
+
+	users := []db.User{
+		{Name: "John Doe", PhoneNumber: "18001234567", Country: "US", City: "New York City", ID: 1},
+		{Name: "Florida Man", PhoneNumber: "18002234567", Country: "US", City: "Florida City", ID: 2},
+	}
+
+	database := db.NewInMemoryDB()
+	assert.Nil(t, database.CreateUsers(context.Background(), users))
+
+	ginRouter := api.NewGinRouter(api.NewServer(database))
+
+	ctx := context.Background()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "/users.csv", nil)
+	assert.Nil(t, err)
+
+	recorder := httptest.NewRecorder()
+	ginRouter.ServeHTTP(recorder, req)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+
+	exported, err := io.ReadAll(dbUsersToCSV(users))
+	assert.Nil(t, err)
+	assert.Equal(t, string(exported), recorder.Body.String())
+
+	req, err = http.NewRequestWithContext(ctx, http.MethodGet, "/users.csv?header=true&columns=city,id&name=florida", nil)
+	assert.Nil(t, err)
+
+	recorder = httptest.NewRecorder()
+	ginRouter.ServeHTTP(recorder, req)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Equal(t, "city,id\nFlorida City,2\n", recorder.Body.String())
+}
+
+func TestShouldRejectExportUnknownColumn(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "/users.csv?columns=id,password", nil)
+	assert.Nil(t, err)
+
+	recorder := httptest.NewRecorder()
+
+	ginRouter := api.NewGinRouter(api.NewServer(db.NewInMemoryDB()))
+	ginRouter.ServeHTTP(recorder, req)
+	assert.Equal(t, http.StatusBadRequest, recorder.Code)
+}
+
+func TestShouldNegotiateUserListFormat(t *testing.T) {
+	t.Parallel()
+
+	users := []db.User{
+		{Name: "John Doe", PhoneNumber: "18001234567", Country: "US", City: "New York City", ID: 1},
+		{Name: "Florida Man", PhoneNumber: "18002234567", Country: "US", City: "Florida City", ID: 2},
+	}
+
+	database := db.NewInMemoryDB()
+	assert.Nil(t, database.CreateUsers(context.Background(), users))
+
+	ginRouter := api.NewGinRouter(api.NewServer(database))
+
+	tests := []struct {
+		accept      string
+		code        int
+		contentType string
+		body        string
+	}{
+		{
+			accept:      "application/x-ndjson",
+			code:        http.StatusOK,
+			contentType: "application/x-ndjson",
+			body: `{"name":"John Doe","phoneNumber":"18001234567","phoneNumberRaw":"","country":"US","city":"New York City",` +
+				`"id":1}` + "\n" +
+				`{"name":"Florida Man","phoneNumber":"18002234567","phoneNumberRaw":"","country":"US","city":"Florida City",` +
+				`"id":2}` + "\n",
+		},
+		{
+			accept:      "text/html, text/csv",
+			code:        http.StatusOK,
+			contentType: "text/csv; charset=utf-8",
+			body:        "1,John Doe,18001234567,US,New York City\n2,Florida Man,18002234567,US,Florida City\n",
+		},
+		{
+			accept:      "application/xml",
+			code:        http.StatusOK,
+			contentType: "application/xml; charset=utf-8",
+			body: "<users>" +
+				"<user><name>John Doe</name><phoneNumber>18001234567</phoneNumber><phoneNumberRaw></phoneNumberRaw>" +
+				"<country>US</country>" +
+				"<city>New York City</city><id>1</id></user>" +
+				"<user><name>Florida Man</name><phoneNumber>18002234567</phoneNumber><phoneNumberRaw></phoneNumberRaw>" +
+				"<country>US</country>" +
+				"<city>Florida City</city><id>2</id></user>" +
+				"</users>",
+		},
+		{
+			accept: "image/png",
+			code:   http.StatusNotAcceptable,
+		},
+		{
+			accept:      "text/csv;q=0.1, application/json",
+			code:        http.StatusOK,
+			contentType: "application/json; charset=utf-8",
+			body: `{"ok":true,"users":[` +
+				`{"name":"John Doe","phoneNumber":"18001234567","phoneNumberRaw":"","country":"US",` +
+				`"city":"New York City","id":1},` +
+				`{"name":"Florida Man","phoneNumber":"18002234567","phoneNumberRaw":"","country":"US",` +
+				`"city":"Florida City","id":2}]}`,
+		},
+		{
+			accept: "application/json;q=0",
+			code:   http.StatusNotAcceptable,
+		},
+		{
+			accept:      "*/*;q=0.5, text/*;q=0, text/csv",
+			code:        http.StatusOK,
+			contentType: "text/csv; charset=utf-8",
+			body:        "1,John Doe,18001234567,US,New York City\n2,Florida Man,18002234567,US,Florida City\n",
+		},
+		{
+			accept:      "application/*;q=0.9, application/x-ndjson;q=0.2",
+			code:        http.StatusOK,
+			contentType: "application/json; charset=utf-8",
+			body: `{"ok":true,"users":[` +
+				`{"name":"John Doe","phoneNumber":"18001234567","phoneNumberRaw":"","country":"US",` +
+				`"city":"New York City","id":1},` +
+				`{"name":"Florida Man","phoneNumber":"18002234567","phoneNumberRaw":"","country":"US",` +
+				`"city":"Florida City","id":2}]}`,
+		},
+	}
+
+	for _, test := range tests {
+		req, err := http.NewRequestWithContext(context.Background(), http.MethodGet, "/users", nil)
+		assert.Nil(t, err)
+		req.Header.Set("Accept", test.accept)
+
+		recorder := httptest.NewRecorder()
+		ginRouter.ServeHTTP(recorder, req)
+		assert.Equal(t, test.code, recorder.Code, test.accept)
+
+		if test.code == http.StatusOK {
+			assert.Equal(t, test.contentType, recorder.Header().Get("Content-Type"), test.accept)
+			assert.Equal(t, test.body, recorder.Body.String(), test.accept)
+		}
+	}
+}
+
+func TestShouldGetUserByID(t *testing.T) {
+	t.Parallel()
+
+	user := db.User{Name: "John Doe", PhoneNumber: "18001234567", Country: "US", City: "New York City", ID: 1}
+
+	database := db.NewInMemoryDB()
+	assert.Nil(t, database.CreateUsers(context.Background(), []db.User{user}))
+
+	ginRouter := api.NewGinRouter(api.NewServer(database))
+
+	req, err := http.NewRequestWithContext(context.Background(), http.MethodGet, "/users/1", nil)
+	assert.Nil(t, err)
+
+	recorder := httptest.NewRecorder()
+	ginRouter.ServeHTTP(recorder, req)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+
+	var body struct {
+		User db.User `json:"user"`
+	}
+
+	assert.Nil(t, json.Unmarshal(recorder.Body.Bytes(), &body))
+	assert.Equal(t, user, body.User)
+
+	req, err = http.NewRequestWithContext(context.Background(), http.MethodGet, "/users/2", nil)
+	assert.Nil(t, err)
+
+	recorder = httptest.NewRecorder()
+	ginRouter.ServeHTTP(recorder, req)
+	assert.Equal(t, http.StatusNotFound, recorder.Code)
+}
+
+// brokenStreamQuerier yields Users from EachUser and then fails with Err.
+type brokenStreamQuerier struct {
+	*db.InMemoryDB
+	Users []db.User
+	Err   error
+}
+
+func (q brokenStreamQuerier) EachUser(_ context.Context, _ db.UserFilter, fn func(db.User) error) error {
+	for _, user := range q.Users {
+		if err := fn(user); err != nil {
+			return err
+		}
+	}
+
+	return q.Err
+}
+
+func TestShouldNotStreamCompleteLookingResponseOnError(t *testing.T) {
+	t.Parallel()
+
+	failed := &db.Error{Kind: db.ErrUnavailable, Err: io.EOF}
+
+	// Nothing is sent before the first page, so the error is still a problem
+	ginRouter := api.NewGinRouter(api.NewServer(brokenStreamQuerier{InMemoryDB: db.NewInMemoryDB(), Err: failed}))
+
+	req, err := http.NewRequestWithContext(context.Background(), http.MethodGet, "/users.csv?header=true", nil)
+	assert.Nil(t, err)
+
+	recorder := httptest.NewRecorder()
+	ginRouter.ServeHTTP(recorder, req)
+	assert.Equal(t, http.StatusServiceUnavailable, recorder.Code)
+	assert.Equal(t, api.CodeDatabaseUnavailable, decodeProblem(t, recorder).Code)
+
+	// Past the first page the connection is closed mid-response
+	ginRouter = api.NewGinRouter(api.NewServer(brokenStreamQuerier{InMemoryDB: db.NewInMemoryDB(), Users: []db.User{
+		{ID: 1, Name: "John Doe", PhoneNumber: "18001234567", Country: "US", City: "New York City"},
+	}, Err: failed}))
+	server := httptest.NewServer(ginRouter)
+	defer server.Close()
+
+	req, err = http.NewRequestWithContext(context.Background(), http.MethodGet, server.URL+"/users.csv", nil)
+	assert.Nil(t, err)
+
+	resp, err := server.Client().Do(req)
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer resp.Body.Close()
+
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	body, err := io.ReadAll(resp.Body)
+	assert.NotNil(t, err, "the client must see that the response was cut short")
+	assert.Equal(t, "1,John Doe,18001234567,US,New York City\n", string(body))
+}
+
+func TestShouldSaveUsersFromJSON(t *testing.T) {
+	t.Parallel()
+
+	const body = `[{"id":1,"name":"John Doe","phoneNumber":"+1 800 123 4567","country":"USA","city":"New York City"}]`
+
+	req, err := http.NewRequestWithContext(context.Background(), http.MethodPut, "/users", strings.NewReader(body))
+	assert.Nil(t, err)
+	req.Header.Set("content-type", "application/json")
+
+	recorder := httptest.NewRecorder()
+
+	database := db.NewInMemoryDB()
+	api.NewGinRouter(api.NewServer(database)).ServeHTTP(recorder, req)
+	assert.Equal(t, http.StatusCreated, recorder.Code)
+	assert.Equal(t, []db.User{{
+		Name:           "John Doe",
+		PhoneNumber:    "+18001234567",
+		PhoneNumberRaw: "+1 800 123 4567",
+		Country:        "US",
+		City:           "New York City",
+		ID:             1,
+	}}, savedUsers(t, database))
+}
+
+func TestShouldAssignMissingIDs(t *testing.T) {
+	t.Parallel()
+
+	const csvFile = "7,John Doe,18001234567,US,New York City\n" +
+		",Jane Doe,18002234567,US,Boston\n" +
+		"Florida Man,18003234567,US,Florida City\n"
+
+	req, err := http.NewRequestWithContext(context.Background(), http.MethodPut, "/users", strings.NewReader(csvFile))
+	assert.Nil(t, err)
+	req.Header.Set("content-type", "text/csv")
+
+	recorder := httptest.NewRecorder()
+
+	database := db.NewInMemoryDB()
+	api.NewGinRouter(api.NewServer(database)).ServeHTTP(recorder, req)
+	assert.Equal(t, http.StatusCreated, recorder.Code)
+
+	var report api.ImportReport
+
+	assert.Nil(t, json.Unmarshal(recorder.Body.Bytes(), &report))
+	assert.Equal(t, []api.AssignedID{{Row: 2, ID: 8}, {Row: 3, ID: 9}}, report.AssignedIDs)
+
+	ids := make([]int64, len(savedUsers(t, database)))
+	for i, user := range savedUsers(t, database) {
+		ids[i] = user.ID
+	}
+
+	assert.Equal(t, []int64{7, 8, 9}, ids)
+}
+
+func TestShouldRejectCreateUsersBadJSON(t *testing.T) {
+	t.Parallel()
+
+	req, err := http.NewRequestWithContext(context.Background(), http.MethodPut, "/users", strings.NewReader(`[{"id":`))
+	assert.Nil(t, err)
+	req.Header.Set("content-type", "application/json")
+
+	recorder := httptest.NewRecorder()
+
+	api.NewGinRouter(api.NewServer(db.NewInMemoryDB())).ServeHTTP(recorder, req)
+	assert.Equal(t, http.StatusUnprocessableEntity, recorder.Code)
+	assert.Equal(t, api.CodeJSONSyntax, decodeProblem(t, recorder).Code)
+}
+
+func TestShouldReportEveryValidationViolation(t *testing.T) {
+	t.Parallel()
+
+	csvFile := "1,John Doe,18001234567,US,New York City\n-1,R2-D2,18002234567,US," + strings.Repeat("a", 129) + "\n"
+
+	req, err := http.NewRequestWithContext(context.Background(), http.MethodPut, "/users", strings.NewReader(csvFile))
+	assert.Nil(t, err)
+	req.Header.Set("content-type", "text/csv")
+
+	recorder := httptest.NewRecorder()
+
+	database := db.NewInMemoryDB()
+	api.NewGinRouter(api.NewServer(database)).ServeHTTP(recorder, req)
+	assert.Equal(t, http.StatusUnprocessableEntity, recorder.Code)
+	assert.Empty(t, savedUsers(t, database))
+
+	problem := decodeProblem(t, recorder)
+	assert.Equal(t, api.CodeInvalidField, problem.Code)
+	assert.Equal(t, []api.ProblemItem{
+		{
+			Code:   api.CodeInvalidField,
+			Detail: "name must contain letters and only spaces, apostrophes, hyphens and dots besides them",
+			Field:  "name",
+			Row:    2,
+		},
+		{Code: api.CodeInvalidField, Detail: "city must be at most 128 characters long", Field: "city", Row: 2},
+		{Code: api.CodeInvalidField, Detail: "id must be greater than 0", Field: "id", Row: 2},
+	}, problem.Errors)
+}
+
+func TestShouldPatchUser(t *testing.T) {
+	t.Parallel()
+
+	database := db.NewInMemoryDB()
+	assert.Nil(t, database.CreateUsers(context.Background(), []db.User{{
+		Name:           "John Doe",
+		PhoneNumber:    "+16135550123",
+		PhoneNumberRaw: "613 555 0123",
+		Country:        "CA",
+		City:           "Ottawa",
+		ID:             1,
+	}}))
+
+	ginRouter := api.NewGinRouter(api.NewServer(database))
+
+	tests := []struct {
+		body string
+		code int
+		user db.User
+	}{
+		{
+			body: `{"city":"Toronto"}`,
+			code: http.StatusOK,
+			user: db.User{
+				Name: "John Doe", PhoneNumber: "+16135550123", PhoneNumberRaw: "613 555 0123", Country: "CA",
+				City: "Toronto", ID: 1,
+			},
+		},
+		{
+			body: `{"name":"J0hn"}`,
+			code: http.StatusUnprocessableEntity,
+		},
+		{
+			body: `{"name":`,
+			code: http.StatusUnprocessableEntity,
+		},
+	}
+
+	for _, test := range tests {
+		req, err := http.NewRequestWithContext(context.Background(), http.MethodPatch, "/users/1",
+			strings.NewReader(test.body))
+		assert.Nil(t, err)
+		req.Header.Set("content-type", "application/json")
+
+		recorder := httptest.NewRecorder()
+		ginRouter.ServeHTTP(recorder, req)
+		assert.Equal(t, test.code, recorder.Code, test.body)
+
+		if test.code == http.StatusOK {
+			var body struct {
+				User db.User `json:"user"`
+			}
+
+			assert.Nil(t, json.Unmarshal(recorder.Body.Bytes(), &body))
+			assert.Equal(t, test.user, body.User, test.body)
+		}
+	}
+
+	user, err := database.GetUserByID(context.Background(), 1)
+	assert.Nil(t, err)
+	assert.Equal(t, "Toronto", user.City, "failed patches must not change the user")
+
+	req, err := http.NewRequestWithContext(context.Background(), http.MethodPatch, "/users/2",
+		strings.NewReader(`{"city":"Toronto"}`))
+	assert.Nil(t, err)
+	req.Header.Set("content-type", "application/json")
+
+	recorder := httptest.NewRecorder()
+	ginRouter.ServeHTTP(recorder, req)
+	assert.Equal(t, http.StatusNotFound, recorder.Code)
+}
+
+func TestShouldFindAndMergeDuplicates(t *testing.T) {
+	t.Parallel()
+
+	users := []db.User{
+		{Name: "John Doe", PhoneNumber: "+18001234567", Country: "US", City: "New York City", ID: 1},
+		{Name: "Jon Doe", PhoneNumber: "+18002234567", Country: "US", City: "new york city", ID: 2},
+		{Name: "J. Doe", PhoneNumber: "+18001234567", Country: "US", City: "Boston", ID: 3},
+		{Name: "Jane Roe", PhoneNumber: "+18003234567", Country: "US", City: "New York City", ID: 4},
+		{Name: "Jim Roe", PhoneNumber: "+18004234567", Country: "US", City: "", ID: 5}, // Saved before validation
+	}
+
+	database := db.NewInMemoryDB()
+	assert.Nil(t, database.CreateUsers(context.Background(), append([]db.User{}, users...)))
+
+	ginRouter := api.NewGinRouter(api.NewServer(database))
+
+	req, err := http.NewRequestWithContext(context.Background(), http.MethodGet, "/users/duplicates", nil)
+	assert.Nil(t, err)
+
+	recorder := httptest.NewRecorder()
+	ginRouter.ServeHTTP(recorder, req)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+
+	var duplicates struct {
+		Clusters [][]db.User `json:"clusters"`
+	}
+
+	assert.Nil(t, json.Unmarshal(recorder.Body.Bytes(), &duplicates))
+	assert.Equal(t, [][]db.User{users[:3]}, duplicates.Clusters)
+
+	tests := []struct {
+		body string
+		code int
+	}{
+		{body: `{"survivor":1,"ids":[2,3],"fields":{"city":3,"age":2}}`, code: http.StatusUnprocessableEntity},
+		{body: `{"survivor":1,"ids":[2,6]}`, code: http.StatusNotFound},
+		{body: `{"survivor":4,"ids":[5],"fields":{"city":5}}`, code: http.StatusUnprocessableEntity},
+		{body: `{"survivor":1,"ids":[2,3],"fields":{"city":3}}`, code: http.StatusOK},
+	}
+
+	for _, test := range tests {
+		req, err = http.NewRequestWithContext(context.Background(), http.MethodPost, "/users/merge",
+			strings.NewReader(test.body))
+		assert.Nil(t, err)
+		req.Header.Set("content-type", "application/json")
+
+		recorder = httptest.NewRecorder()
+		ginRouter.ServeHTTP(recorder, req)
+		assert.Equal(t, test.code, recorder.Code, test.body)
+	}
+
+	survivor := users[0]
+	survivor.City = "Boston"
+
+	assert.Equal(t, []db.User{survivor, users[3], users[4]}, savedUsers(t, database))
+
+	req, err = http.NewRequestWithContext(context.Background(), http.MethodGet, "/users/merges", nil)
+	assert.Nil(t, err)
+
+	recorder = httptest.NewRecorder()
+	ginRouter.ServeHTTP(recorder, req)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+
+	var audit struct {
+		Merges []db.Merge `json:"merges"`
+	}
+
+	assert.Nil(t, json.Unmarshal(recorder.Body.Bytes(), &audit))
+
+	if assert.Len(t, audit.Merges, 1) {
+		assert.Equal(t, survivor, audit.Merges[0].Survivor)
+		assert.Equal(t, users[1:3], audit.Merges[0].Merged)
+		assert.Equal(t, map[string]int64{"name": 1, "phoneNumber": 1, "country": 1, "city": 3}, audit.Merges[0].Fields)
+	}
+}
+
+func TestShouldDiffUploadAgainstSavedUsers(t *testing.T) {
+	t.Parallel()
+
+	database := db.NewInMemoryDB()
+	assert.Nil(t, database.CreateUsers(context.Background(), []db.User{
+		{Name: "John Doe", PhoneNumber: "+18001234567", PhoneNumberRaw: "18001234567", Country: "US", City: "NYC", ID: 1},
+		{Name: "Jane Doe", PhoneNumber: "+18002234567", PhoneNumberRaw: "18002234567", Country: "US", City: "LA", ID: 2},
+	}))
+
+	const csvFile = "1,John Doe,18001234567,US,Boston\n2,Jane Doe,18002234567,US,LA\n,Jim Doe,18003234567,US,LA\n"
+
+	req, err := http.NewRequestWithContext(context.Background(), http.MethodPost, "/users/diff",
+		strings.NewReader(csvFile))
+	assert.Nil(t, err)
+	req.Header.Set("content-type", "text/csv")
+
+	recorder := httptest.NewRecorder()
+	api.NewGinRouter(api.NewServer(database)).ServeHTTP(recorder, req)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+
+	var diff api.ImportDiff
+
+	assert.Nil(t, json.Unmarshal(recorder.Body.Bytes(), &diff))
+	assert.Equal(t, 1, diff.New)
+	assert.Equal(t, 1, diff.Changed)
+	assert.Equal(t, 1, diff.Unchanged)
+
+	if assert.Len(t, diff.Users, 3) {
+		assert.Equal(t, api.DiffChanged, diff.Users[0].Status)
+		assert.Equal(t, []api.FieldChange{{Field: "city", Before: "NYC", After: "Boston"}}, diff.Users[0].Changes)
+		assert.Equal(t, api.DiffUnchanged, diff.Users[1].Status)
+		assert.Equal(t, api.DiffNew, diff.Users[2].Status)
+		assert.Equal(t, 3, diff.Users[2].Row)
+	}
+
+	assert.Len(t, savedUsers(t, database), 2, "a diff must not save anything")
+	assert.Equal(t, "NYC", savedUsers(t, database)[0].City, "a diff must not save anything")
+}
+
+func TestShouldImportWithProfile(t *testing.T) {
+	t.Parallel()
+
+	database := db.NewInMemoryDB()
+	ginRouter := api.NewGinRouter(api.NewServer(database))
+
+	send := func(method, target, contentType, body string) *httptest.ResponseRecorder {
+		req, err := http.NewRequestWithContext(context.Background(), method, target, strings.NewReader(body))
+		assert.Nil(t, err)
+		req.Header.Set("content-type", contentType)
+
+		recorder := httptest.NewRecorder()
+		ginRouter.ServeHTTP(recorder, req)
+
+		return recorder
+	}
+
+	const profile = `{"name":"acme","columns":["city","name","","phoneNumber"],"delimiter":";",` +
+		`"encoding":"windows-1252","header":true,"defaults":{"country":"DE"}}`
+
+	assert.Equal(t, http.StatusUnprocessableEntity,
+		send(http.MethodPost, "/import-profiles", "application/json", `{"name":"acme","columns":["age"]}`).Code)
+
+	recorder := send(http.MethodPost, "/import-profiles", "application/json", `{"name":"acme","colums":["name"]}`)
+	assert.Equal(t, http.StatusBadRequest, recorder.Code, "a misspelled field must not be ignored")
+	assert.Contains(t, recorder.Body.String(), `"code":"unknown-field"`)
+	assert.Contains(t, recorder.Body.String(), `"field":"colums"`)
+
+	assert.Equal(t, http.StatusCreated, send(http.MethodPost, "/import-profiles", "application/json", profile).Code)
+	assert.Equal(t, http.StatusConflict, send(http.MethodPost, "/import-profiles", "application/json", profile).Code)
+
+	// "München;Jürgen Müller" in Windows-1252
+	const csvFile = "Stadt;Name;Notiz;Telefon\nM\xfcnchen;J\xfcrgen M\xfcller;-;030 1234567\n"
+
+	assert.Equal(t, http.StatusNotFound, send(http.MethodPut, "/users?profile=globex", "text/csv", csvFile).Code)
+	assert.Equal(t, http.StatusCreated, send(http.MethodPut, "/users?profile=acme", "text/csv", csvFile).Code)
+	assert.Equal(t, []db.User{{
+		Name:           "Jürgen Müller",
+		PhoneNumber:    "+49301234567",
+		PhoneNumberRaw: "030 1234567",
+		Country:        "DE",
+		City:           "München",
+		ID:             1,
+	}}, savedUsers(t, database))
+
+	recorder = send(http.MethodPut, "/import-profiles/acme", "application/json",
+		`{"columns":["name","phoneNumber","country","city"]}`)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+
+	recorder = send(http.MethodGet, "/import-profiles/acme", "", "")
+	assert.Equal(t, http.StatusOK, recorder.Code)
+
+	var body struct {
+		Profile db.ImportProfile `json:"profile"`
+	}
+
+	assert.Nil(t, json.Unmarshal(recorder.Body.Bytes(), &body))
+	assert.Equal(t, db.ImportProfile{
+		Name:      "acme",
+		Columns:   []string{"name", "phoneNumber", "country", "city"},
+		Delimiter: ",",
+		Encoding:  "utf-8",
+		Defaults:  map[string]string{},
+	}, body.Profile)
+
+	assert.Equal(t, http.StatusNoContent, send(http.MethodDelete, "/import-profiles/acme", "", "").Code)
+	assert.Equal(t, http.StatusNotFound, send(http.MethodGet, "/import-profiles/acme", "", "").Code)
+}
+
+// failingQuerier fails every ImportUsers call with Err.
+type failingQuerier struct {
+	*db.InMemoryDB
+	Err error
+}
+
+func (q failingQuerier) ImportUsers(context.Context, []db.User, db.ConflictPolicy, []db.User) (db.ImportCounts, error) {
+	return db.ImportCounts{}, q.Err
+}
+
+func TestShouldMapDatabaseErrorsToStatusCodes(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		err  error
+		code int
+	}{
+		{err: &db.Error{Kind: db.ErrConflict, Err: io.EOF}, code: http.StatusConflict},
+		{err: &db.Error{Kind: db.ErrConstraint, Err: io.EOF, Column: "name"}, code: http.StatusUnprocessableEntity},
+		{err: &db.Error{Kind: db.ErrTimeout, Err: io.EOF}, code: http.StatusGatewayTimeout},
+		{err: &db.Error{Kind: db.ErrUnavailable, Err: io.EOF}, code: http.StatusServiceUnavailable},
+		{err: db.ErrNotFound, code: http.StatusNotFound},
+		{err: io.EOF, code: http.StatusInternalServerError},
+	}
+
+	for _, test := range tests {
+		req, err := http.NewRequestWithContext(context.Background(), http.MethodPut, "/users",
+			strings.NewReader("1,John Doe,18001234567,US,New York City\n"))
+		assert.Nil(t, err)
+		req.Header.Set("content-type", "text/csv")
+
+		recorder := httptest.NewRecorder()
+
+		ginRouter := api.NewGinRouter(api.NewServer(failingQuerier{InMemoryDB: db.NewInMemoryDB(), Err: test.err}))
+		ginRouter.ServeHTTP(recorder, req)
+		assert.Equal(t, test.code, recorder.Code, test.err.Error())
+
+		problem := decodeProblem(t, recorder)
+		assert.NotContains(t, problem.Detail, io.EOF.Error(), "driver errors must not be shown to the client")
+	}
+}
+
+// blockingQuerier blocks every SearchUsers call until the context is done.
+type blockingQuerier struct {
+	*db.InMemoryDB
+}
+
+func (q blockingQuerier) SearchUsers(ctx context.Context, _ db.UserFilter) ([]db.User, error) {
+	<-ctx.Done()
+
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return nil, &db.Error{Kind: db.ErrTimeout, Err: ctx.Err()}
+	}
+
+	return nil, fmt.Errorf("interrupted: %w", ctx.Err())
+}
+
+func TestShouldStopQueriesOnTimeoutAndCancel(t *testing.T) {
+	t.Parallel()
+
+	server := api.NewServer(blockingQuerier{InMemoryDB: db.NewInMemoryDB()},
+		api.WithTimeouts(api.Timeouts{Read: 10 * time.Millisecond, Write: 0, Import: 0, Export: 0}))
+	ginRouter := api.NewGinRouter(server)
+
+	req, err := http.NewRequestWithContext(context.Background(), http.MethodGet, "/users", nil)
+	assert.Nil(t, err)
+
+	recorder := httptest.NewRecorder()
+	ginRouter.ServeHTTP(recorder, req)
+	assert.Equal(t, http.StatusGatewayTimeout, recorder.Code)
+	assert.Equal(t, api.CodeDatabaseTimeout, decodeProblem(t, recorder).Code)
+
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	req, err = http.NewRequestWithContext(canceled, http.MethodGet, "/users", nil)
+	assert.Nil(t, err)
+
+	recorder = httptest.NewRecorder()
+	ginRouter.ServeHTTP(recorder, req)
+	assert.Equal(t, 499, recorder.Code, "the client disconnected")
+	assert.Equal(t, api.CodeRequestCanceled, decodeProblem(t, recorder).Code)
+
+	shutdown, cancelCause := context.WithCancelCause(context.Background())
+	cancelCause(api.ErrShuttingDown)
+
+	req, err = http.NewRequestWithContext(shutdown, http.MethodGet, "/users", nil)
+	assert.Nil(t, err)
+
+	recorder = httptest.NewRecorder()
+	ginRouter.ServeHTTP(recorder, req)
+	assert.Equal(t, http.StatusServiceUnavailable, recorder.Code, "the server canceled the request")
+	assert.Equal(t, api.CodeShuttingDown, decodeProblem(t, recorder).Code)
+}
+
+// slowReader returns the bytes of Reader after waiting Delay.
+type slowReader struct {
+	io.Reader
+	Delay time.Duration
+}
+
+func (r slowReader) Read(p []byte) (int, error) {
+	time.Sleep(r.Delay)
+
+	return r.Reader.Read(p) //nolint:wrapcheck // Passed through to the request body
+}
+
+func TestShouldStartTimeoutsAfterRequestIsRead(t *testing.T) {
+	t.Parallel()
+
+	server := api.NewServer(db.NewInMemoryDB(), api.WithTimeouts(api.Timeouts{
+		Read:   20 * time.Millisecond,
+		Write:  20 * time.Millisecond,
+		Import: 20 * time.Millisecond,
+		Export: 0,
+	}))
+	ginRouter := api.NewGinRouter(server)
+
+	const profile = `{"name":"acme","columns":["id","name","phoneNumber","country","city"]}`
+
+	tests := []struct {
+		method, path, contentType, body string
+		code                            int
+	}{
+		{http.MethodPut, "/users", "text/csv", "1,John Doe,18001234567,US,New York City\n", http.StatusCreated},
+		{http.MethodPatch, "/users/1", "application/json", `{"name":"Jane Doe"}`, http.StatusOK},
+		{http.MethodPost, "/users/merge", "application/json", `{"survivor":1,"ids":[2]}`, http.StatusNotFound},
+		{http.MethodPost, "/import-profiles", "application/json", profile, http.StatusCreated},
+		{http.MethodPut, "/import-profiles/acme", "application/json", profile, http.StatusOK},
+	}
+
+	for _, test := range tests {
+		body := slowReader{Reader: strings.NewReader(test.body), Delay: 50 * time.Millisecond}
+
+		req, err := http.NewRequestWithContext(context.Background(), test.method, test.path, body)
+		assert.Nil(t, err)
+		req.Header.Set("content-type", test.contentType)
+
+		recorder := httptest.NewRecorder()
+		ginRouter.ServeHTTP(recorder, req)
+		assert.Equal(t, test.code, recorder.Code, "%s %s: a slow upload must not use up the time of the database",
+			test.method, test.path)
+	}
+}
+
+func TestShouldLoadSeedDirectory(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, "1-users.csv"), []byte(
+		"John Doe,18001234567,US,New York City\n"+
+			"5,Florida Man,18002234567,US,Florida City\n"), 0o600))
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, "2-users.json"), []byte(
+		`[{"name": "Jane Roe", "phoneNumber": "+442071234567", "country": "GB", "city": "London"}]`), 0o600))
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, "README.md"), []byte("Not a seed"), 0o600))
+
+	database := db.NewInMemoryDB()
+	server := api.NewServer(database)
+
+	counts, err := server.LoadSeed(context.Background(), dir, api.SeedStrict)
+	assert.Nil(t, err)
+	assert.Equal(t, db.ImportCounts{Created: 3, Updated: 0, Skipped: 0}, counts)
+	assert.Len(t, savedUsers(t, database), 3)
+
+	_, err = server.LoadSeed(context.Background(), dir, api.SeedStrict)
+	assert.NotNil(t, err, "strict seeds must not load users that already exist")
+
+	counts, err = server.LoadSeed(context.Background(), dir, api.SeedIdempotent)
+	assert.Nil(t, err)
+	assert.Equal(t, db.ImportCounts{Created: 0, Updated: 0, Skipped: 3}, counts)
+	assert.Len(t, savedUsers(t, database), 3)
+
+	_, err = server.LoadSeed(context.Background(), filepath.Join(dir, "README.md"), api.SeedIdempotent)
+	assert.NotNil(t, err, "only CSV and JSON files can be seeds")
+}
+
+func TestShouldShowConnectionPoolStats(t *testing.T) {
+	t.Parallel()
+
+	database, err := db.OpenStore(context.Background(), "sqlite://"+filepath.Join(t.TempDir(), "users.db"),
+		db.WithPool(db.PoolConfig{MaxOpenConns: 3, MaxIdleConns: 1, ConnMaxLifetime: 0, ConnMaxIdleTime: 0}))
+	assert.Nil(t, err)
+
+	ginRouter := api.NewAdminRouter(api.NewServer(database))
+
+	req, err := http.NewRequestWithContext(context.Background(), http.MethodGet, "/admin/db/stats", nil)
+	assert.Nil(t, err)
+
+	recorder := httptest.NewRecorder()
+	ginRouter.ServeHTTP(recorder, req)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+
+	var response struct {
+		OK    bool          `json:"ok"`
+		Stats api.PoolStats `json:"stats"`
+	}
+
+	assert.Nil(t, json.Unmarshal(recorder.Body.Bytes(), &response))
+	assert.True(t, response.OK)
+	assert.Equal(t, 3, response.Stats.MaxOpenConnections)
+	assert.LessOrEqual(t, response.Stats.Idle, 1)
+
+	req, err = http.NewRequestWithContext(context.Background(), http.MethodGet, "/metrics", nil)
+	assert.Nil(t, err)
+
+	recorder = httptest.NewRecorder()
+	ginRouter.ServeHTTP(recorder, req)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Contains(t, recorder.Header().Get("Content-Type"), "text/plain")
+	assert.Contains(t, recorder.Body.String(), "# TYPE users_db_open_connections gauge\n")
+	assert.Contains(t, recorder.Body.String(), "\nusers_db_max_open_connections 3\n")
+	assert.Nil(t, database.Close())
+
+	// The in-memory database has no pool
+	ginRouter = api.NewAdminRouter(api.NewServer(db.NewInMemoryDB()))
+
+	req, err = http.NewRequestWithContext(context.Background(), http.MethodGet, "/admin/db/stats", nil)
+	assert.Nil(t, err)
+
+	recorder = httptest.NewRecorder()
+	ginRouter.ServeHTTP(recorder, req)
+	assert.Equal(t, http.StatusNotFound, recorder.Code)
+	assert.Equal(t, api.CodeNotFound, decodeProblem(t, recorder).Code)
+}
+
+func TestShouldNotServeAdminEndpointsWithTheAPI(t *testing.T) {
+	t.Parallel()
+
+	database, err := db.OpenStore(context.Background(), "sqlite://"+filepath.Join(t.TempDir(), "users.db"))
+	assert.Nil(t, err)
+
+	ginRouter := api.NewGinRouter(api.NewServer(database))
+
+	for _, path := range []string{"/admin/db/stats", "/metrics"} {
+		req, err := http.NewRequestWithContext(context.Background(), http.MethodGet, path, nil)
+		assert.Nil(t, err)
+
+		recorder := httptest.NewRecorder()
+		ginRouter.ServeHTTP(recorder, req)
+		assert.Equal(t, http.StatusNotFound, recorder.Code, path)
+		assert.Equal(t, api.CodeRouteNotFound, decodeProblem(t, recorder).Code, path)
+	}
+
+	assert.Nil(t, database.Close())
+}
+
+func decodeProblem(t *testing.T, recorder *httptest.ResponseRecorder) api.Problem {
+	t.Helper()
+
+	assert.Equal(t, "application/problem+json", recorder.Header().Get("Content-Type"))
+
+	var problem api.Problem
+
+	assert.Nil(t, json.Unmarshal(recorder.Body.Bytes(), &problem))
+
+	return problem
+}
+
+func dbUsersToCSV(users []db.User) io.Reader {
+	final := ""
+
+	for _, user := range users {
+		final += fmt.Sprintf("%d,%s,%s,%s,%s\n", user.ID, user.Name, user.PhoneNumber, user.Country, user.City)
+	}
+
+	return strings.NewReader(final)
+}
+
+// savedUsers returns every user in the database ordered by ID.
+func savedUsers(t *testing.T, database db.Querier) []db.User {
+	t.Helper()
+
+	users, err := database.SearchUsers(context.Background(), db.UserFilter{})
+	assert.Nil(t, err)
+
+	return users
 }
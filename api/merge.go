@@ -0,0 +1,211 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+
+	"github.com/gin-gonic/gin"
+	"github.com/m-kuzmin/simple-rest-api/db"
+	"github.com/m-kuzmin/simple-rest-api/logging"
+)
+
+// MergeRequest is the body of POST /users/merge.
+type MergeRequest struct {
+	// Survivor is the ID of the user that is kept.
+	Survivor int64 `json:"survivor"`
+	// IDs are the users that are merged into Survivor and deleted.
+	IDs []int64 `json:"ids"`
+	// Fields picks the user each field of Survivor is taken from, by JSON field name. Missing fields are not changed.
+	Fields map[string]int64 `json:"fields"`
+}
+
+// problems returns one item for every mistake in the request.
+func (r MergeRequest) problems() []ProblemItem {
+	items := []ProblemItem{}
+	invalid := func(field, format string, a ...any) {
+		items = append(items, ProblemItem{Code: CodeInvalidField, Field: field, Detail: fmt.Sprintf(format, a...)})
+	}
+
+	if r.Survivor <= 0 {
+		invalid("survivor", "survivor must be a user ID")
+	}
+
+	if len(r.IDs) == 0 {
+		invalid("ids", "ids must list at least one user to merge")
+	}
+
+	involved := map[int64]bool{r.Survivor: true}
+
+	for _, id := range r.IDs {
+		if involved[id] {
+			invalid("ids", "user %d is listed more than once", id)
+		}
+
+		involved[id] = true
+	}
+
+	for field, id := range r.Fields {
+		if !db.IsMergeField(field) {
+			invalid("fields", "%q is not a field that can be merged", field)
+		} else if !involved[id] {
+			invalid("fields", "%s is taken from user %d, which is not part of the merge", field, id)
+		}
+	}
+
+	sort.SliceStable(items, func(i, j int) bool { return items[i].Detail < items[j].Detail })
+
+	return items
+}
+
+// @Summary Find duplicate users
+// @Description List clusters of users that are likely the same person: they have the same phone number, or they live
+// @Description in the same city and have nearly the same name.
+// @Produce json
+// @Success 200
+// @Router /users/duplicates [get]
+func (s *Server) ListDuplicates(ctx *gin.Context) {
+	tape := logging.NewTape(
+		logging.DebugLevel,
+		logging.NewPrefixedLogger(logging.GlobalLogger, "(Tape (APICall GET /users/duplicates))"),
+		logging.ErrorLevel,
+		logging.NewPrefixedLogger(logging.GlobalLogger, "(APICall GET /users/duplicates)"),
+	)
+
+	queryCtx, cancel := queryContext(ctx, s.timeouts.Read)
+	defer cancel()
+
+	clusters, err := s.db.DuplicateUsers(queryCtx)
+	if err != nil {
+		tape.Errorf("DB error while calling DuplicateUsers: %s", err)
+		dbProblemResponse(ctx, err)
+
+		return
+	}
+
+	tape.Infof("Returning %d clusters", len(clusters))
+	ctx.JSON(http.StatusOK, gin.H{
+		"ok":       true,
+		"clusters": clusters,
+	})
+}
+
+// @Summary Merge users
+// @Description Merge users into one survivor and delete them. Each field of the survivor can be taken from any of the
+// @Description merged users. The merge is recorded in the audit trail, see GET /users/merges.
+// @Accept json
+// @Produce json
+// @Success 200
+// @Failure 404,415,422
+// @Router /users/merge [post]
+func (s *Server) MergeUsers(ctx *gin.Context) {
+	tape := logging.NewTape(
+		logging.DebugLevel,
+		logging.NewPrefixedLogger(logging.GlobalLogger, "(Tape (APICall POST /users/merge))"),
+		logging.ErrorLevel,
+		logging.NewPrefixedLogger(logging.GlobalLogger, "(APICall POST /users/merge)"),
+	)
+
+	if ctx.ContentType() != mimeJSON {
+		tape.Errorf("Wrong content type: %q", ctx.ContentType())
+		problemResponse(ctx, CodeUnsupportedMediaType, `Expected Content-Type header to be "application/json"`)
+
+		return
+	}
+
+	if ctx.Request.Body == nil {
+		tape.Errorf("Empty body")
+		problemResponse(ctx, CodeEmptyBody, "Empty body not allowed")
+
+		return
+	}
+
+	var req MergeRequest
+
+	if err := json.NewDecoder(ctx.Request.Body).Decode(&req); err != nil {
+		tape.Errorf("Bad merge request: %s", err)
+		inputProblemResponse(ctx, jsonError{Err: err})
+
+		return
+	}
+
+	if items := req.problems(); len(items) != 0 {
+		tape.Errorf("Invalid merge request: %v", items)
+		problemResponse(ctx, CodeInvalidField, "Merge request is invalid", items...)
+
+		return
+	}
+
+	queryCtx, cancel := queryContext(ctx, s.timeouts.Write)
+	defer cancel()
+
+	merge, err := s.db.MergeUsers(queryCtx, db.MergeSpec{Survivor: req.Survivor, Merged: req.IDs, Fields: req.Fields})
+
+	var (
+		notFound db.UserNotFoundError
+		invalid  db.ValidationError
+	)
+
+	switch {
+	case errors.As(err, &notFound):
+		tape.Errorf("User %d not found", notFound.ID)
+		problemResponsef(ctx, CodeUserNotFound, "User %d not found", notFound.ID)
+
+		return
+	case errors.As(err, &invalid):
+		tape.Errorf("Merged user is invalid: %s", err)
+		problemResponse(ctx, CodeInvalidField, "Merged user is invalid",
+			fieldProblemItems(&FieldError{Field: "", Row: 0, Err: err})...)
+
+		return
+	case errors.Is(err, db.ErrNotFound):
+		tape.Errorf("Users were deleted during the merge")
+		problemResponse(ctx, CodeUserNotFound, "One of the users does not exist anymore")
+
+		return
+	case err != nil:
+		tape.Errorf("DB error while calling MergeUsers: %s", err)
+		dbProblemResponse(ctx, err)
+
+		return
+	}
+
+	tape.Infof("Merged %d users into %d", len(merge.Merged), merge.Survivor.ID)
+	ctx.JSON(http.StatusOK, gin.H{
+		"ok":    true,
+		"merge": merge,
+	})
+}
+
+// @Summary List merges
+// @Description List the audit trail of merged users, oldest first.
+// @Produce json
+// @Success 200
+// @Router /users/merges [get]
+func (s *Server) ListMerges(ctx *gin.Context) {
+	tape := logging.NewTape(
+		logging.DebugLevel,
+		logging.NewPrefixedLogger(logging.GlobalLogger, "(Tape (APICall GET /users/merges))"),
+		logging.ErrorLevel,
+		logging.NewPrefixedLogger(logging.GlobalLogger, "(APICall GET /users/merges)"),
+	)
+
+	queryCtx, cancel := queryContext(ctx, s.timeouts.Read)
+	defer cancel()
+
+	merges, err := s.db.ListMerges(queryCtx)
+	if err != nil {
+		tape.Errorf("DB error while calling ListMerges: %s", err)
+		dbProblemResponse(ctx, err)
+
+		return
+	}
+
+	tape.Infof("Returning %d merges", len(merges))
+	ctx.JSON(http.StatusOK, gin.H{
+		"ok":     true,
+		"merges": merges,
+	})
+}
@@ -0,0 +1,97 @@
+package api
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/m-kuzmin/simple-rest-api/db"
+)
+
+const mimePrometheusText = "text/plain; version=0.0.4; charset=utf-8"
+
+// PoolStats is sql.DBStats in the JSON naming of the API.
+type PoolStats struct {
+	MaxOpenConnections int     `json:"maxOpenConnections"` // 0 if unlimited
+	OpenConnections    int     `json:"openConnections"`
+	InUse              int     `json:"inUse"`
+	Idle               int     `json:"idle"`
+	WaitCount          int64   `json:"waitCount"`           // Requests that waited for a free connection
+	WaitDurationSecs   float64 `json:"waitDurationSeconds"` // Total time spent waiting for a free connection
+	MaxIdleClosed      int64   `json:"maxIdleClosed"`
+	MaxIdleTimeClosed  int64   `json:"maxIdleTimeClosed"`
+	MaxLifetimeClosed  int64   `json:"maxLifetimeClosed"`
+}
+
+func newPoolStats(stats sql.DBStats) PoolStats {
+	return PoolStats{
+		MaxOpenConnections: stats.MaxOpenConnections,
+		OpenConnections:    stats.OpenConnections,
+		InUse:              stats.InUse,
+		Idle:               stats.Idle,
+		WaitCount:          stats.WaitCount,
+		WaitDurationSecs:   stats.WaitDuration.Seconds(),
+		MaxIdleClosed:      stats.MaxIdleClosed,
+		MaxIdleTimeClosed:  stats.MaxIdleTimeClosed,
+		MaxLifetimeClosed:  stats.MaxLifetimeClosed,
+	}
+}
+
+// @Summary Connection pool stats
+// @Description Show how the database connections are used, to size the pool. Only SQL databases have a pool.
+// @Produce json
+// @Success 200
+// @Failure 404 {object} Problem "code: not-found"
+// @Router /admin/db/stats [get]
+func (s *Server) DBStats(ctx *gin.Context) {
+	pooled, isPooled := s.db.(db.Pooled)
+	if !isPooled {
+		problemResponse(ctx, CodeNotFound, "The database does not use a connection pool")
+		return
+	}
+
+	ctx.JSON(http.StatusOK, gin.H{
+		"ok":    true,
+		"stats": newPoolStats(pooled.Stats()),
+	})
+}
+
+// @Summary Metrics
+// @Description Show the connection pool stats in the Prometheus text format. Empty without a connection pool.
+// @Produce plain
+// @Success 200
+// @Router /metrics [get]
+func (s *Server) Metrics(ctx *gin.Context) {
+	var metrics strings.Builder
+
+	if pooled, isPooled := s.db.(db.Pooled); isPooled {
+		writePoolMetrics(&metrics, newPoolStats(pooled.Stats()))
+	}
+
+	ctx.Data(http.StatusOK, mimePrometheusText, []byte(metrics.String()))
+}
+
+// writePoolMetrics writes the stats in the Prometheus text exposition format.
+func writePoolMetrics(out *strings.Builder, stats PoolStats) {
+	metric := func(name, kind, help string, value any) {
+		fmt.Fprintf(out, "# HELP users_db_%s %s\n# TYPE users_db_%s %s\nusers_db_%s %v\n", name, help, name, kind, name,
+			value)
+	}
+
+	metric("max_open_connections", "gauge", "Maximum number of open connections, 0 if unlimited.",
+		stats.MaxOpenConnections)
+	metric("open_connections", "gauge", "Open connections, in use and idle.", stats.OpenConnections)
+	metric("in_use_connections", "gauge", "Connections in use.", stats.InUse)
+	metric("idle_connections", "gauge", "Idle connections.", stats.Idle)
+	metric("wait_count_total", "counter", "Requests that waited for a free connection.", stats.WaitCount)
+	metric("wait_duration_seconds_total", "counter", "Time spent waiting for a free connection.",
+		stats.WaitDurationSecs)
+	metric("max_idle_closed_total", "counter", "Connections closed because of the idle connection limit.",
+		stats.MaxIdleClosed)
+	metric("max_idle_time_closed_total", "counter", "Connections closed because they were idle for too long.",
+		stats.MaxIdleTimeClosed)
+	metric("max_lifetime_closed_total", "counter", "Connections closed because they were open for too long.",
+		stats.MaxLifetimeClosed)
+}
@@ -0,0 +1,219 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/m-kuzmin/simple-rest-api/db"
+)
+
+const mimeProblemJSON = "application/problem+json"
+
+// statusClientClosedRequest is the nginx status for requests whose client disconnected before the response was ready.
+const statusClientClosedRequest = 499
+
+// problemTypePrefix is prepended to an ErrorCode to build the RFC 7807 "type" URI.
+const problemTypePrefix = "urn:simple-rest-api:problem:"
+
+/*
+ErrorCode is a stable, machine readable identifier of an error. Unlike the "detail" message it never changes, so
+clients can branch on it.
+*/
+type ErrorCode string
+
+const (
+	CodeUnsupportedMediaType  ErrorCode = "unsupported-media-type"
+	CodeNotAcceptable         ErrorCode = "not-acceptable"
+	CodeEmptyBody             ErrorCode = "empty-body"
+	CodeCSVSyntax             ErrorCode = "csv-syntax"
+	CodeJSONSyntax            ErrorCode = "json-syntax"
+	CodeBadInput              ErrorCode = "bad-input"
+	CodeUnknownField          ErrorCode = "unknown-field"
+	CodeInvalidField          ErrorCode = "invalid-field"
+	CodeNoUsers               ErrorCode = "no-users"
+	CodePhoneCountryMismatch  ErrorCode = "phone-country-mismatch"
+	CodePhoneCountryCorrected ErrorCode = "phone-country-corrected"
+	CodeDuplicateUser         ErrorCode = "duplicate-user"
+	CodeBadParameter          ErrorCode = "bad-parameter"
+	CodeUserNotFound          ErrorCode = "user-not-found"
+	CodeProfileNotFound       ErrorCode = "profile-not-found"
+	CodeRouteNotFound         ErrorCode = "route-not-found"
+	CodeMethodNotAllowed      ErrorCode = "method-not-allowed"
+	CodeConflict              ErrorCode = "conflict"
+	CodeConstraintViolation   ErrorCode = "constraint-violation"
+	CodeDatabaseTimeout       ErrorCode = "database-timeout"
+	CodeRequestCanceled       ErrorCode = "request-canceled"
+	CodeShuttingDown          ErrorCode = "shutting-down"
+	CodeDatabaseUnavailable   ErrorCode = "database-unavailable"
+	CodeNotFound              ErrorCode = "not-found"
+	CodeDatabase              ErrorCode = "database-error"
+	CodeInternal              ErrorCode = "internal-error"
+)
+
+type problemInfo struct {
+	Title  string
+	Status int
+}
+
+// problemCatalog has the title and HTTP status of every ErrorCode that can be the code of a whole Problem. Codes that
+// only appear in ProblemItem and ImportReport warnings are not listed.
+var problemCatalog = map[ErrorCode]problemInfo{ //nolint:gochecknoglobals // Read-only lookup table
+	CodeUnsupportedMediaType: {"Unsupported media type", http.StatusUnsupportedMediaType},
+	CodeNotAcceptable:        {"No acceptable response format", http.StatusNotAcceptable},
+	CodeEmptyBody:            {"Request body is empty", http.StatusUnprocessableEntity},
+	CodeCSVSyntax:            {"CSV syntax error", http.StatusUnprocessableEntity},
+	CodeJSONSyntax:           {"JSON syntax error", http.StatusUnprocessableEntity},
+	CodeBadInput:             {"Request body cannot be read", http.StatusBadRequest},
+	CodeUnknownField:         {"Unknown field", http.StatusBadRequest},
+	CodeInvalidField:         {"Invalid field value", http.StatusUnprocessableEntity},
+	CodeNoUsers:              {"No users in request", http.StatusUnprocessableEntity},
+	CodePhoneCountryMismatch: {"Phone number is from a different country", http.StatusUnprocessableEntity},
+	CodeDuplicateUser:        {"Duplicate users", http.StatusConflict},
+	CodeBadParameter:         {"Bad request parameter", http.StatusBadRequest},
+	CodeUserNotFound:         {"User not found", http.StatusNotFound},
+	CodeProfileNotFound:      {"Import profile not found", http.StatusNotFound},
+	CodeRouteNotFound:        {"Route not found", http.StatusNotFound},
+	CodeMethodNotAllowed:     {"Method not allowed", http.StatusMethodNotAllowed},
+	CodeConflict:             {"Conflicts with existing data", http.StatusConflict},
+	CodeConstraintViolation:  {"Value rejected by the database", http.StatusUnprocessableEntity},
+	CodeDatabaseTimeout:      {"Database timed out", http.StatusGatewayTimeout},
+	CodeRequestCanceled:      {"Request canceled", statusClientClosedRequest},
+	CodeShuttingDown:         {"Server shutting down", http.StatusServiceUnavailable},
+	CodeDatabaseUnavailable:  {"Database unavailable", http.StatusServiceUnavailable},
+	CodeNotFound:             {"Not found", http.StatusNotFound},
+	CodeDatabase:             {"Database error", http.StatusInternalServerError},
+	CodeInternal:             {"Internal server error", http.StatusInternalServerError},
+}
+
+// Problem is an RFC 7807 "application/problem+json" error response.
+type Problem struct {
+	Type     string        `json:"type"`
+	Title    string        `json:"title"`
+	Status   int           `json:"status"`
+	Detail   string        `json:"detail,omitempty"`
+	Instance string        `json:"instance,omitempty"`
+	Code     ErrorCode     `json:"code"`
+	Errors   []ProblemItem `json:"errors,omitempty"`
+}
+
+// ProblemItem is one of possibly many errors that caused a Problem, for example a bad field in one CSV row.
+type ProblemItem struct {
+	Code   ErrorCode `json:"code"`
+	Detail string    `json:"detail"`
+	Field  string    `json:"field,omitempty"`
+	Row    int       `json:"row,omitempty"`  // 1-based record number in the uploaded file
+	Line   int       `json:"line,omitempty"` // 1-based line number in the uploaded file
+}
+
+// newProblem fills in the type, title and status for the code.
+func newProblem(code ErrorCode, detail string, items ...ProblemItem) Problem {
+	info, found := problemCatalog[code]
+	if !found {
+		info = problemCatalog[CodeInternal]
+	}
+
+	return Problem{
+		Type:   problemTypePrefix + string(code),
+		Title:  info.Title,
+		Status: info.Status,
+		Detail: detail,
+		Code:   code,
+		Errors: items,
+	}
+}
+
+// problemError is returned by code that does not respond to the client itself, so that the caller can.
+type problemError struct {
+	Problem Problem
+}
+
+func (e problemError) Error() string {
+	message := fmt.Sprintf("%s: %s", e.Problem.Title, e.Problem.Detail)
+
+	for _, item := range e.Problem.Errors {
+		message += "; "
+		if item.Row != 0 {
+			message += fmt.Sprintf("row %d: ", item.Row)
+		}
+
+		message += item.Detail
+	}
+
+	return message
+}
+
+// problemResponse aborts the request with an RFC 7807 error.
+func problemResponse(ctx *gin.Context, code ErrorCode, detail string, items ...ProblemItem) {
+	problem := newProblem(code, detail, items...)
+	problem.Instance = ctx.Request.URL.Path
+
+	ctx.Header("Content-Type", mimeProblemJSON)
+	ctx.AbortWithStatusJSON(problem.Status, problem)
+}
+
+func problemResponsef(ctx *gin.Context, code ErrorCode, fmtStr string, a ...any) {
+	problemResponse(ctx, code, fmt.Sprintf(fmtStr, a...))
+}
+
+/*
+dbProblemResponse responds with the problem that matches a db.Querier error. The driver message is only logged, the
+client gets a generic description so that internal details are not leaked.
+*/
+func dbProblemResponse(ctx *gin.Context, err error) {
+	code, detail := CodeDatabase, "The database failed to process the request"
+
+	switch {
+	case errors.Is(context.Cause(ctx.Request.Context()), ErrShuttingDown):
+		// The client did not go away, the server canceled the request and the client may retry it elsewhere
+		code, detail = CodeShuttingDown, "The server is shutting down, try again later"
+	case errors.Is(err, context.Canceled) || ctx.Request.Context().Err() != nil:
+		// Checked first, because some drivers report a canceled query as a timeout
+		code, detail = CodeRequestCanceled, "The request was canceled before the database finished"
+	case errors.Is(err, db.ErrConflict):
+		code, detail = CodeConflict, "A record with the same key already exists"
+	case errors.Is(err, db.ErrNotFound):
+		code, detail = CodeNotFound, "The record does not exist"
+	case errors.Is(err, db.ErrConstraint):
+		code, detail = CodeConstraintViolation, "A value is missing, too long or otherwise invalid"
+	case errors.Is(err, db.ErrTimeout), errors.Is(err, context.DeadlineExceeded):
+		code, detail = CodeDatabaseTimeout, "The database did not respond in time"
+	case errors.Is(err, db.ErrUnavailable):
+		code, detail = CodeDatabaseUnavailable, "The database is unavailable, try again later"
+	}
+
+	var (
+		dbErr *db.Error
+		items []ProblemItem
+	)
+
+	if errors.As(err, &dbErr) && dbErr.Column != "" {
+		items = append(items, ProblemItem{Code: code, Detail: detail, Field: dbErr.Column})
+	}
+
+	problemResponse(ctx, code, detail, items...)
+}
+
+// noRouteHandler responds to requests that do not match any route.
+func noRouteHandler(ctx *gin.Context) {
+	problemResponsef(ctx, CodeRouteNotFound, "There is nothing at %s", ctx.Request.URL.Path)
+}
+
+// noMethodHandler responds to requests to an existing route with a method the route does not support.
+func noMethodHandler(ctx *gin.Context) {
+	problemResponsef(ctx, CodeMethodNotAllowed, "%s is not supported at %s", ctx.Request.Method, ctx.Request.URL.Path)
+}
+
+/*
+recoveryHandler responds to requests whose handler panicked. The panic is logged by gin. http.ErrAbortHandler is
+panicked again, so that net/http drops the connection of a response that was cut short (see abortResponse).
+*/
+func recoveryHandler(ctx *gin.Context, recovered any) {
+	if err, isErr := recovered.(error); isErr && errors.Is(err, http.ErrAbortHandler) {
+		panic(err)
+	}
+
+	problemResponse(ctx, CodeInternal, "")
+}
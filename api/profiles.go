@@ -0,0 +1,428 @@
+package api
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+	"github.com/m-kuzmin/simple-rest-api/db"
+	"github.com/m-kuzmin/simple-rest-api/logging"
+	"golang.org/x/text/encoding/htmlindex"
+	"golang.org/x/text/transform"
+)
+
+// profileFields are the User fields a profile can map columns to, in the order ParseUsersCSV expects them.
+var profileFields = []string{"id", "name", "phoneNumber", "country", "city"} //nolint:gochecknoglobals // Read-only
+
+// requiredProfileFields must have a column or a default in every profile, otherwise no user could be imported.
+var requiredProfileFields = []string{"name", "phoneNumber", "country", "city"} //nolint:gochecknoglobals // Read-only
+
+var profileNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,63}$`) //nolint:gochecknoglobals // Read-only
+
+// withProfileDefaults fills in the dialect a profile gets if it does not say otherwise.
+func withProfileDefaults(profile db.ImportProfile) db.ImportProfile {
+	if profile.Delimiter == "" {
+		profile.Delimiter = ","
+	}
+
+	if profile.Encoding == "" {
+		profile.Encoding = "utf-8"
+	}
+
+	if profile.Defaults == nil {
+		profile.Defaults = map[string]string{}
+	}
+
+	return profile
+}
+
+// profileProblems returns one item for every mistake in the profile.
+func profileProblems(profile db.ImportProfile) []ProblemItem {
+	items := []ProblemItem{}
+	invalid := func(field, format string, a ...any) {
+		items = append(items, ProblemItem{Code: CodeInvalidField, Field: field, Detail: fmt.Sprintf(format, a...)})
+	}
+
+	if !profileNamePattern.MatchString(profile.Name) {
+		invalid("name", "name must be 1 to 64 lowercase letters, digits, dashes and underscores")
+	}
+
+	mapped := map[string]bool{}
+
+	for _, field := range profile.Columns {
+		switch {
+		case field == "":
+		case !isProfileField(field):
+			invalid("columns", "%q is not a user field", field)
+		case mapped[field]:
+			invalid("columns", "%q is mapped to more than one column", field)
+		}
+
+		mapped[field] = true
+	}
+
+	for field := range profile.Defaults {
+		if !isProfileField(field) || field == "id" {
+			invalid("defaults", "%q is not a user field that can have a default", field)
+		}
+	}
+
+	for _, field := range requiredProfileFields {
+		if _, hasDefault := profile.Defaults[field]; !mapped[field] && !hasDefault {
+			invalid("columns", "%q needs a column or a default", field)
+		}
+	}
+
+	if delimiter, size := utf8.DecodeRuneInString(profile.Delimiter); size != len(profile.Delimiter) ||
+		delimiter == utf8.RuneError || delimiter == '"' || delimiter == '\r' || delimiter == '\n' {
+		invalid("delimiter", "delimiter must be a single character other than a quote or a line break")
+	}
+
+	if _, err := htmlindex.Get(profile.Encoding); err != nil {
+		invalid("encoding", "unknown encoding %q", profile.Encoding)
+	}
+
+	sort.SliceStable(items, func(i, j int) bool { return items[i].Field < items[j].Field })
+
+	return items
+}
+
+func isProfileField(name string) bool {
+	for _, field := range profileFields {
+		if field == name {
+			return true
+		}
+	}
+
+	return false
+}
+
+/*
+profileRecords reads a CSV file as described by the profile and returns its records in the format ParseUsersCSV
+expects. The header, if any, is skipped, so record numbers in errors count data records only.
+*/
+func profileRecords(profile db.ImportProfile, body io.Reader) ([][]string, error) {
+	encoding, err := htmlindex.Get(profile.Encoding)
+	if err != nil {
+		return nil, fmt.Errorf("error reading CSV records: %w", err)
+	}
+
+	reader := csv.NewReader(transform.NewReader(body, encoding.NewDecoder()))
+	reader.Comma, _ = utf8.DecodeRuneInString(profile.Delimiter)
+	reader.FieldsPerRecord = len(profile.Columns)
+
+	records, err := reader.ReadAll()
+	if err != nil {
+		return nil, inputError{Err: fmt.Errorf("error reading CSV records: %w", err)}
+	}
+
+	if profile.Header && len(records) != 0 {
+		records = records[1:]
+	}
+
+	mapped := make([][]string, len(records))
+
+	for i, record := range records {
+		mapped[i] = make([]string, len(profileFields))
+
+		for j, field := range profileFields {
+			for column, name := range profile.Columns {
+				if name == field {
+					mapped[i][j] = record[column]
+				}
+			}
+
+			if mapped[i][j] == "" {
+				mapped[i][j] = profile.Defaults[field]
+			}
+		}
+	}
+
+	return mapped, nil
+}
+
+// getImportProfile fetches a profile. Responds with an error if not ok.
+func (s *Server) getImportProfile(queryCtx context.Context, ctx *gin.Context, tape logging.Logger,
+	name string,
+) (db.ImportProfile, bool) {
+	profile, err := s.db.GetImportProfile(queryCtx, name)
+	if errors.Is(err, db.ErrNotFound) {
+		tape.Errorf("Profile %q not found", name)
+		problemResponsef(ctx, CodeProfileNotFound, "Import profile %q not found", name)
+
+		return db.ImportProfile{}, false
+	}
+
+	if err != nil {
+		tape.Errorf("DB error while calling GetImportProfile: %s", err)
+		dbProblemResponse(ctx, err)
+
+		return db.ImportProfile{}, false
+	}
+
+	return profile, true
+}
+
+// readImportProfile parses and validates the profile in the request body. Responds with an error if not ok.
+func readImportProfile(ctx *gin.Context, tape logging.Logger) (db.ImportProfile, bool) {
+	if ctx.ContentType() != mimeJSON {
+		tape.Errorf("Wrong content type: %q", ctx.ContentType())
+		problemResponse(ctx, CodeUnsupportedMediaType, `Expected Content-Type header to be "application/json"`)
+
+		return db.ImportProfile{}, false
+	}
+
+	if ctx.Request.Body == nil {
+		tape.Errorf("Empty body")
+		problemResponse(ctx, CodeEmptyBody, "Empty body not allowed")
+
+		return db.ImportProfile{}, false
+	}
+
+	var profile db.ImportProfile
+
+	decoder := json.NewDecoder(ctx.Request.Body)
+	decoder.DisallowUnknownFields() // A misspelled field would silently fall back to its default
+
+	if err := decoder.Decode(&profile); err != nil {
+		tape.Errorf("Bad profile: %s", err)
+
+		if field, unknown := unknownJSONField(err); unknown {
+			problemResponse(ctx, CodeUnknownField, "Import profile has an unknown field", ProblemItem{
+				Code:   CodeUnknownField,
+				Detail: fmt.Sprintf("%q is not a field of an import profile", field),
+				Field:  field,
+			})
+		} else {
+			inputProblemResponse(ctx, jsonError{Err: err})
+		}
+
+		return db.ImportProfile{}, false
+	}
+
+	if name := ctx.Param("name"); name != "" && profile.Name == "" {
+		profile.Name = name
+	}
+
+	profile = withProfileDefaults(profile)
+
+	if items := profileProblems(profile); len(items) != 0 {
+		tape.Errorf("Invalid profile: %v", items)
+		problemResponse(ctx, CodeInvalidField, "Import profile is invalid", items...)
+
+		return db.ImportProfile{}, false
+	}
+
+	return profile, true
+}
+
+// @Summary Create an import profile
+// @Description Save how to read the CSV files of a partner: column order, delimiter, encoding, whether there is a
+// @Description header and default values. Use it with PUT /users?profile={name}.
+// @Accept json
+// @Produce json
+// @Success 201
+// @Failure 400,409,415,422
+// @Router /import-profiles [post]
+func (s *Server) CreateImportProfile(ctx *gin.Context) {
+	tape := logging.NewTape(
+		logging.DebugLevel,
+		logging.NewPrefixedLogger(logging.GlobalLogger, "(Tape (APICall POST /import-profiles))"),
+		logging.ErrorLevel,
+		logging.NewPrefixedLogger(logging.GlobalLogger, "(APICall POST /import-profiles)"),
+	)
+
+	profile, ok := readImportProfile(ctx, tape)
+	if !ok {
+		return
+	}
+
+	queryCtx, cancel := queryContext(ctx, s.timeouts.Write)
+	defer cancel()
+
+	if err := s.db.CreateImportProfile(queryCtx, profile); err != nil {
+		tape.Errorf("DB error while calling CreateImportProfile: %s", err)
+		dbProblemResponse(ctx, err)
+
+		return
+	}
+
+	ctx.JSON(http.StatusCreated, gin.H{
+		"ok":      true,
+		"profile": profile,
+	})
+}
+
+// @Summary List import profiles
+// @Produce json
+// @Success 200
+// @Router /import-profiles [get]
+func (s *Server) ListImportProfiles(ctx *gin.Context) {
+	tape := logging.NewTape(
+		logging.DebugLevel,
+		logging.NewPrefixedLogger(logging.GlobalLogger, "(Tape (APICall GET /import-profiles))"),
+		logging.ErrorLevel,
+		logging.NewPrefixedLogger(logging.GlobalLogger, "(APICall GET /import-profiles)"),
+	)
+
+	queryCtx, cancel := queryContext(ctx, s.timeouts.Read)
+	defer cancel()
+
+	profiles, err := s.db.ListImportProfiles(queryCtx)
+	if err != nil {
+		tape.Errorf("DB error while calling ListImportProfiles: %s", err)
+		dbProblemResponse(ctx, err)
+
+		return
+	}
+
+	ctx.JSON(http.StatusOK, gin.H{
+		"ok":       true,
+		"profiles": profiles,
+	})
+}
+
+// @Summary Get an import profile
+// @Produce json
+// @Param name path string true "Profile name"
+// @Success 200
+// @Failure 404
+// @Router /import-profiles/{name} [get]
+func (s *Server) GetImportProfile(ctx *gin.Context) {
+	tape := logging.NewTape(
+		logging.DebugLevel,
+		logging.NewPrefixedLogger(logging.GlobalLogger, "(Tape (APICall GET /import-profiles/:name))"),
+		logging.ErrorLevel,
+		logging.NewPrefixedLogger(logging.GlobalLogger, "(APICall GET /import-profiles/:name)"),
+	)
+
+	queryCtx, cancel := queryContext(ctx, s.timeouts.Read)
+	defer cancel()
+
+	profile, ok := s.getImportProfile(queryCtx, ctx, tape, ctx.Param("name"))
+	if !ok {
+		return
+	}
+
+	ctx.JSON(http.StatusOK, gin.H{
+		"ok":      true,
+		"profile": profile,
+	})
+}
+
+// @Summary Replace an import profile
+// @Accept json
+// @Produce json
+// @Param name path string true "Profile name"
+// @Success 200
+// @Failure 400,404,415,422
+// @Router /import-profiles/{name} [put]
+func (s *Server) UpdateImportProfile(ctx *gin.Context) {
+	tape := logging.NewTape(
+		logging.DebugLevel,
+		logging.NewPrefixedLogger(logging.GlobalLogger, "(Tape (APICall PUT /import-profiles/:name))"),
+		logging.ErrorLevel,
+		logging.NewPrefixedLogger(logging.GlobalLogger, "(APICall PUT /import-profiles/:name)"),
+	)
+
+	profile, ok := readImportProfile(ctx, tape)
+	if !ok {
+		return
+	}
+
+	if profile.Name != ctx.Param("name") {
+		tape.Errorf("Profile name %q does not match the path", profile.Name)
+		problemResponse(ctx, CodeInvalidField, "Profiles cannot be renamed", ProblemItem{
+			Code:   CodeInvalidField,
+			Detail: fmt.Sprintf("name must be %q or left out", ctx.Param("name")),
+			Field:  "name",
+		})
+
+		return
+	}
+
+	queryCtx, cancel := queryContext(ctx, s.timeouts.Write)
+	defer cancel()
+
+	err := s.db.UpdateImportProfile(queryCtx, profile)
+	if errors.Is(err, db.ErrNotFound) {
+		tape.Errorf("Profile %q not found", profile.Name)
+		problemResponsef(ctx, CodeProfileNotFound, "Import profile %q not found", profile.Name)
+
+		return
+	}
+
+	if err != nil {
+		tape.Errorf("DB error while calling UpdateImportProfile: %s", err)
+		dbProblemResponse(ctx, err)
+
+		return
+	}
+
+	ctx.JSON(http.StatusOK, gin.H{
+		"ok":      true,
+		"profile": profile,
+	})
+}
+
+// @Summary Delete an import profile
+// @Param name path string true "Profile name"
+// @Success 204
+// @Failure 404
+// @Router /import-profiles/{name} [delete]
+func (s *Server) DeleteImportProfile(ctx *gin.Context) {
+	tape := logging.NewTape(
+		logging.DebugLevel,
+		logging.NewPrefixedLogger(logging.GlobalLogger, "(Tape (APICall DELETE /import-profiles/:name))"),
+		logging.ErrorLevel,
+		logging.NewPrefixedLogger(logging.GlobalLogger, "(APICall DELETE /import-profiles/:name)"),
+	)
+
+	queryCtx, cancel := queryContext(ctx, s.timeouts.Write)
+	defer cancel()
+
+	err := s.db.DeleteImportProfile(queryCtx, ctx.Param("name"))
+	if errors.Is(err, db.ErrNotFound) {
+		tape.Errorf("Profile %q not found", ctx.Param("name"))
+		problemResponsef(ctx, CodeProfileNotFound, "Import profile %q not found", ctx.Param("name"))
+
+		return
+	}
+
+	if err != nil {
+		tape.Errorf("DB error while calling DeleteImportProfile: %s", err)
+		dbProblemResponse(ctx, err)
+
+		return
+	}
+
+	ctx.Status(http.StatusNoContent)
+}
+
+/*
+unknownJSONField returns the field that json.Decoder.DisallowUnknownFields rejected. encoding/json has no error type for
+this, so the message is matched.
+*/
+func unknownJSONField(err error) (string, bool) {
+	field, found := strings.CutPrefix(err.Error(), "json: unknown field ")
+	if !found {
+		return "", false
+	}
+
+	unquoted, err := strconv.Unquote(field)
+	if err != nil {
+		return field, true
+	}
+
+	return unquoted, true
+}
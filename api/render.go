@@ -0,0 +1,228 @@
+package api
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/m-kuzmin/simple-rest-api/db"
+	"github.com/m-kuzmin/simple-rest-api/logging"
+)
+
+const (
+	mimeJSON    = gin.MIMEJSON
+	mimeNDJSON  = "application/x-ndjson"
+	mimeCSV     = "text/csv"
+	mimeXML     = gin.MIMEXML
+	mimeXMLText = gin.MIMEXML2
+)
+
+// streamFlushEvery is how many users are written before the response is flushed to the client.
+const streamFlushEvery = 100
+
+// userFormats are the formats users can be rendered in. The first one is used when the client accepts anything.
+var userFormats = []string{mimeJSON, mimeNDJSON, mimeCSV, mimeXML, mimeXMLText} //nolint:gochecknoglobals // Constant
+
+type xmlUser struct {
+	XMLName xml.Name `xml:"user"`
+	db.User
+}
+
+type xmlUsers struct {
+	XMLName xml.Name  `xml:"users"`
+	Users   []db.User `xml:"user"`
+}
+
+/*
+negotiateFormat picks one of the offers based on the Accept header, see bestOffer. If the client does not accept any of
+them, responds with 406 Not Acceptable and returns false.
+*/
+func negotiateFormat(ctx *gin.Context, tape logging.Logger, offers ...string) (string, bool) {
+	format := bestOffer(ctx.GetHeader("Accept"), offers...)
+	if format == "" {
+		tape.Errorf("Nothing acceptable in %q", ctx.GetHeader("Accept"))
+		problemResponsef(ctx, CodeNotAcceptable, "Cannot respond with any of %q, available formats are %q",
+			ctx.GetHeader("Accept"), offers)
+
+		return "", false
+	}
+
+	return format, true
+}
+
+/*
+userStream writes users to the response one at a time, so that a listing never has to be held in memory. Streams are
+created by newUserStream before anything is sent, which gives them a chance to reject bad query parameters.
+*/
+type userStream interface {
+	// Start sends the status code, headers and anything that goes before the first user.
+	Start(httpCode int) error
+	Write(user db.User) error
+	Flush() error
+}
+
+// isStreamFormat reports whether users in this format can be written with a userStream.
+func isStreamFormat(format string) bool {
+	return format == mimeCSV || format == mimeNDJSON
+}
+
+// newUserStream creates a stream for a format that passes isStreamFormat.
+func newUserStream(ctx *gin.Context, format string) (userStream, error) {
+	if format == mimeCSV {
+		return newCSVUserStream(ctx)
+	}
+
+	return &ndjsonUserStream{ctx: ctx, encoder: json.NewEncoder(ctx.Writer)}, nil
+}
+
+/*
+streamUsers writes every user that each yields. The stream is only started with the first user (or when each returns
+without any), so an error before that, such as a failed query for the first page, is still answered with a problem.
+Once the first byte is sent the status code can no longer change, so later errors abort the connection: the client sees
+a broken response rather than a complete looking one.
+*/
+func streamUsers(ctx *gin.Context, tape logging.Logger, stream userStream, httpCode int,
+	each func(fn func(db.User) error) error,
+) {
+	started := false
+	start := func() error {
+		started = true
+
+		return stream.Start(httpCode)
+	}
+
+	written := 0
+	err := each(func(user db.User) error {
+		if !started {
+			if err := start(); err != nil {
+				return err
+			}
+		}
+
+		if err := stream.Write(user); err != nil {
+			return err
+		}
+
+		if written++; written%streamFlushEvery == 0 {
+			return stream.Flush()
+		}
+
+		return nil
+	})
+
+	if !started {
+		if err != nil {
+			tape.Errorf("Stream failed before the first user: %s", err)
+			dbProblemResponse(ctx, err)
+
+			return
+		}
+
+		err = start()
+	}
+
+	if flushErr := stream.Flush(); err == nil {
+		err = flushErr
+	}
+
+	if err != nil {
+		tape.Errorf("Stream stopped after %d users: %s", written, err)
+		abortResponse(ctx)
+
+		return
+	}
+
+	tape.Infof("Streamed %d users", written)
+}
+
+/*
+abortResponse closes the connection of a response that was cut short, so that the client does not take what it got for
+the whole response. Connections that cannot be hijacked (HTTP/2) are reset by net/http, see recoveryHandler.
+*/
+func abortResponse(ctx *gin.Context) {
+	ctx.Abort()
+	ctx.Writer.Flush() // Hijacking drops whatever net/http has not sent yet
+
+	conn, _, err := ctx.Writer.Hijack()
+	if err != nil {
+		panic(http.ErrAbortHandler)
+	}
+
+	conn.Close() //nolint:errcheck,gosec // The response is broken either way
+}
+
+// renderUser responds with a single user in the negotiated format.
+func renderUser(ctx *gin.Context, tape logging.Logger, httpCode int, format string, user db.User) {
+	switch format {
+	case mimeJSON:
+		ctx.JSON(httpCode, gin.H{"ok": true, "user": user})
+	case mimeXML, mimeXMLText:
+		ctx.XML(httpCode, xmlUser{User: user})
+	default:
+		renderUsers(ctx, tape, httpCode, format, []db.User{user})
+	}
+}
+
+// renderUsers responds with a list of users in the negotiated format.
+func renderUsers(ctx *gin.Context, tape logging.Logger, httpCode int, format string, users []db.User) {
+	switch format {
+	case mimeJSON:
+		ctx.JSON(httpCode, gin.H{"ok": true, "users": users})
+
+		return
+	case mimeXML, mimeXMLText:
+		ctx.XML(httpCode, xmlUsers{Users: users})
+
+		return
+	}
+
+	stream, err := newUserStream(ctx, format)
+	if err != nil {
+		tape.Errorf("Bad stream parameters: %s", err)
+		problemResponsef(ctx, CodeBadParameter, "Bad parameters: %s", err)
+
+		return
+	}
+
+	streamUsers(ctx, tape, stream, httpCode, func(fn func(db.User) error) error {
+		for _, user := range users {
+			if err := fn(user); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+// ndjsonUserStream writes one JSON object per line.
+type ndjsonUserStream struct {
+	ctx     *gin.Context
+	encoder *json.Encoder
+}
+
+// Start implements userStream.
+func (s *ndjsonUserStream) Start(httpCode int) error {
+	s.ctx.Header("Content-Type", mimeNDJSON)
+	s.ctx.Status(httpCode)
+
+	return nil
+}
+
+// Write implements userStream.
+func (s *ndjsonUserStream) Write(user db.User) error {
+	if err := s.encoder.Encode(user); err != nil {
+		return fmt.Errorf("writing NDJSON line: %w", err)
+	}
+
+	return nil
+}
+
+// Flush implements userStream.
+func (s *ndjsonUserStream) Flush() error {
+	s.ctx.Writer.Flush()
+
+	return nil
+}
@@ -1,22 +1,27 @@
 package api
 
 import (
-	"fmt"
-
 	"github.com/gin-gonic/gin"
+	"github.com/m-kuzmin/simple-rest-api/db"
 )
 
-func errorResponse(ctx *gin.Context, httpCode int, err string) {
-	ctx.JSON(httpCode, gin.H{
-		"ok":    false,
-		"error": err,
-	})
+// ImportReport is the response to a successful import.
+type ImportReport struct {
+	OK bool `json:"ok"`
+	// Counts says how many rows created, updated or skipped a user.
+	Counts db.ImportCounts `json:"counts"`
+	// Warnings are problems that did not stop the import, or changes made to the uploaded data, one per affected row.
+	Warnings []ProblemItem `json:"warnings,omitempty"`
+	// AssignedIDs are the IDs the database gave to users that were uploaded without one.
+	AssignedIDs []AssignedID `json:"assignedIds,omitempty"`
 }
 
-func errorResponsef(ctx *gin.Context, httpCode int, fmtStr string, a ...any) {
-	errorResponse(ctx, httpCode, fmt.Sprintf(fmtStr, a...))
+// AssignedID is the ID given to the user in a row of the uploaded file.
+type AssignedID struct {
+	Row int   `json:"row"` // 1-based record number in the uploaded file
+	ID  int64 `json:"id"`
 }
 
-func okResponse(ctx *gin.Context, httpCode int) {
-	ctx.JSON(httpCode, gin.H{"ok": true})
+func importResponse(ctx *gin.Context, httpCode int, report ImportReport) {
+	ctx.JSON(httpCode, report)
 }
@@ -0,0 +1,161 @@
+package api
+
+import (
+	"context"
+	"encoding/csv"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/m-kuzmin/simple-rest-api/db"
+	"github.com/m-kuzmin/simple-rest-api/logging"
+)
+
+// SeedMode decides what loading a seed does with users that are already in the database.
+type SeedMode string
+
+const (
+	// SeedStrict imports the seed like an upload with the policies of the server, so by default it fails if a user
+	// already exists.
+	SeedStrict SeedMode = "strict"
+	// SeedIdempotent skips users whose ID is taken or that are probable duplicates of a saved user, so the same seed
+	// can be loaded on every start.
+	SeedIdempotent SeedMode = "idempotent"
+)
+
+// ParseSeedMode returns the mode with this name.
+func ParseSeedMode(name string) (SeedMode, error) {
+	switch mode := SeedMode(name); mode {
+	case SeedStrict, SeedIdempotent:
+		return mode, nil
+	default:
+		return "", unknownPolicyError{Name: name, Valid: []string{string(SeedStrict), string(SeedIdempotent)}}
+	}
+}
+
+type seedFormatError struct {
+	Path string
+}
+
+func (e seedFormatError) Error() string {
+	return fmt.Sprintf("%s: expected a .csv or .json file", e.Path)
+}
+
+/*
+LoadSeed adds the users from a CSV or JSON file, or from every such file in a directory in name order, to the database.
+Each file is parsed and imported like an upload to PUT /users, so the users are validated, normalized and checked for
+duplicates the same way. Files are imported one by one and loading stops at the first one that fails.
+*/
+func (s *Server) LoadSeed(ctx context.Context, path string, mode SeedMode) (db.ImportCounts, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return db.ImportCounts{}, fmt.Errorf("error opening seed: %w", err)
+	}
+
+	files := []string{path}
+
+	if info.IsDir() {
+		if files, err = seedFiles(path); err != nil {
+			return db.ImportCounts{}, err
+		}
+	}
+
+	total := db.ImportCounts{}
+
+	for _, file := range files {
+		counts, err := s.loadSeedFile(ctx, file, mode)
+		if err != nil {
+			return total, fmt.Errorf("%s: %w", file, err)
+		}
+
+		logging.Infof("Seed %s: created %d, updated %d and skipped %d users", file, counts.Created, counts.Updated,
+			counts.Skipped)
+
+		total.Created += counts.Created
+		total.Updated += counts.Updated
+		total.Skipped += counts.Skipped
+	}
+
+	return total, nil
+}
+
+// seedFiles lists the CSV and JSON files in dir in name order. Other files are ignored.
+func seedFiles(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("error listing seed directory: %w", err)
+	}
+
+	files := []string{}
+
+	for _, entry := range entries {
+		switch strings.ToLower(filepath.Ext(entry.Name())) {
+		case ".csv", ".json":
+			if !entry.IsDir() {
+				files = append(files, filepath.Join(dir, entry.Name()))
+			}
+		}
+	}
+
+	sort.Strings(files)
+
+	return files, nil
+}
+
+func (s *Server) loadSeedFile(ctx context.Context, path string, mode SeedMode) (db.ImportCounts, error) {
+	tape := logging.NewTape(
+		logging.DebugLevel,
+		logging.NewPrefixedLogger(logging.GlobalLogger, "(Tape (Seed "+path+"))"),
+		logging.ErrorLevel,
+		logging.NewPrefixedLogger(logging.GlobalLogger, "(Seed "+path+")"),
+	)
+
+	file, err := os.Open(path) //nolint:gosec // The path is given by whoever starts the server
+	if err != nil {
+		return db.ImportCounts{}, fmt.Errorf("error opening seed file: %w", err)
+	}
+	defer file.Close() //nolint:errcheck // Only read from
+
+	var users []db.User
+
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".csv":
+		users, err = ParseUsersCSV(csv.NewReader(file))
+	case ".json":
+		users, err = ParseUsersJSON(file)
+	default:
+		return db.ImportCounts{}, seedFormatError{Path: path}
+	}
+
+	if err != nil {
+		tape.Errorf("Parsing error: %s", err)
+
+		return db.ImportCounts{}, err
+	}
+
+	policies := importPolicies{
+		PhoneCountry: s.phoneCountryPolicy,
+		Duplicates:   s.duplicatePolicy,
+		Conflict:     s.conflictPolicy,
+	}
+
+	if mode == SeedIdempotent {
+		policies.Duplicates, policies.Conflict = DuplicatesKeepFirst, db.ConflictSkip
+	}
+
+	report, err := s.importUsers(ctx, tape, users, policies)
+
+	return report.Counts, err
+}
+
+/*
+LoadSeedFile loads a seed with the default policies of NewServer. It is a db.SeedLoader, used for the seed parameter of
+memory:// databases.
+*/
+func LoadSeedFile(ctx context.Context, querier db.Querier, path string) error {
+	_, err := NewServer(querier).LoadSeed(ctx, path, SeedStrict)
+
+	return err
+}
@@ -3,28 +3,89 @@ package api
 import (
 	"context"
 	"encoding/csv"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"strconv"
 
 	"github.com/gin-gonic/gin"
+	"github.com/m-kuzmin/simple-rest-api/country"
 	"github.com/m-kuzmin/simple-rest-api/db"
 	"github.com/m-kuzmin/simple-rest-api/logging"
+	"golang.org/x/text/unicode/norm"
 )
 
 type Server struct {
-	db db.Querier
+	db                 db.Querier
+	phoneCountryPolicy PhoneCountryPolicy
+	duplicatePolicy    DuplicatePolicy
+	conflictPolicy     db.ConflictPolicy
+	timeouts           Timeouts
 }
 
-func NewServer(db db.Querier) *Server {
-	return &Server{db: db}
+// ServerOption changes the defaults of a Server.
+type ServerOption func(*Server)
+
+/*
+WithPhoneCountryPolicy sets what imports do with users whose phone number does not match their country. Defaults to
+PhoneCountryWarn. Clients can override it per request with the "phoneCountry" query parameter.
+*/
+func WithPhoneCountryPolicy(policy PhoneCountryPolicy) ServerOption {
+	return func(s *Server) {
+		s.phoneCountryPolicy = policy
+	}
+}
+
+/*
+WithDuplicatePolicy sets what imports do with users that are already in the file or in the database. Defaults to
+DuplicatesFail. Clients can override it per request with the "duplicates" query parameter.
+*/
+func WithDuplicatePolicy(policy DuplicatePolicy) ServerOption {
+	return func(s *Server) {
+		s.duplicatePolicy = policy
+	}
+}
+
+/*
+WithConflictPolicy sets what imports do with users whose ID is already taken. Defaults to db.ConflictFail. Clients can
+override it per request with the "conflict" query parameter.
+*/
+func WithConflictPolicy(policy db.ConflictPolicy) ServerOption {
+	return func(s *Server) {
+		s.conflictPolicy = policy
+	}
+}
+
+func NewServer(querier db.Querier, options ...ServerOption) *Server {
+	server := &Server{
+		db:                 querier,
+		phoneCountryPolicy: PhoneCountryWarn,
+		duplicatePolicy:    DuplicatesFail,
+		conflictPolicy:     db.ConflictFail,
+		timeouts:           DefaultTimeouts(),
+	}
+
+	for _, option := range options {
+		option(server)
+	}
+
+	return server
 }
 
 // @Summary Add users to database
-// @Description Add users to database by uploading a CSV file
-// @Accept text/csv
+// @Description Add users to database by uploading a CSV file or a JSON array. Rows whose phone number belongs to a
+// @Description different country than the one in the file are handled according to `phoneCountry`. Users without
+// @Description an ID get one from the database, and the response lists them by row. Users that are already in the file
+// @Description or the database are handled according to `duplicates`, users whose ID is taken according to `conflict`.
+// @Accept text/csv,json
 // @Produce json
+// @Param phoneCountry query string false "warn, reject or correct phone/country mismatches"
+// @Param duplicates query string false "fail, keep-first, keep-last or flag duplicate users"
+// @Param conflict query string false "fail, skip or overwrite users whose ID is taken"
+// @Param profile query string false "Name of the import profile to read the CSV file with"
 // @Success 201
+// @Failure 400,409,415,422
 // @Router /users [put]
 func (s *Server) CreateOrUpdateUsers(ctx *gin.Context) {
 	tape := logging.NewTape(
@@ -36,75 +97,539 @@ func (s *Server) CreateOrUpdateUsers(ctx *gin.Context) {
 
 	tape.Debugf("%#v", ctx.Request)
 
-	if ctx.ContentType() != "text/csv" {
+	phoneCountryPolicy := s.phoneCountryPolicy
+
+	if name := ctx.Query("phoneCountry"); name != "" {
+		policy, err := ParsePhoneCountryPolicy(name)
+		if err != nil {
+			tape.Errorf("Bad phoneCountry: %s", err)
+			problemResponsef(ctx, CodeBadParameter, "Bad phoneCountry parameter: %s", err)
+
+			return
+		}
+
+		phoneCountryPolicy = policy
+	}
+
+	duplicatePolicy := s.duplicatePolicy
+
+	if name := ctx.Query("duplicates"); name != "" {
+		policy, err := ParseDuplicatePolicy(name)
+		if err != nil {
+			tape.Errorf("Bad duplicates: %s", err)
+			problemResponsef(ctx, CodeBadParameter, "Bad duplicates parameter: %s", err)
+
+			return
+		}
+
+		duplicatePolicy = policy
+	}
+
+	conflictPolicy := s.conflictPolicy
+
+	if name := ctx.Query("conflict"); name != "" {
+		policy, err := ParseConflictPolicy(name)
+		if err != nil {
+			tape.Errorf("Bad conflict: %s", err)
+			problemResponsef(ctx, CodeBadParameter, "Bad conflict parameter: %s", err)
+
+			return
+		}
+
+		conflictPolicy = policy
+	}
+
+	users, ok := s.readUploadedUsers(ctx, tape)
+	if !ok {
+		return
+	}
+
+	queryCtx, cancel := queryContext(ctx, s.timeouts.Import)
+	defer cancel()
+
+	report, err := s.importUsers(queryCtx, tape, users, importPolicies{
+		PhoneCountry: phoneCountryPolicy,
+		Duplicates:   duplicatePolicy,
+		Conflict:     conflictPolicy,
+	})
+
+	var rejected problemError
+
+	switch {
+	case errors.As(err, &rejected):
+		problemResponse(ctx, rejected.Problem.Code, rejected.Problem.Detail, rejected.Problem.Errors...)
+
+		return
+	case err != nil:
+		dbProblemResponse(ctx, err)
+
+		return
+	}
+
+	tape.Infof("Returning StatusCreated with %d warnings, %d assigned IDs and counts %+v", len(report.Warnings),
+		len(report.AssignedIDs), report.Counts)
+	importResponse(ctx, http.StatusCreated, report)
+}
+
+// importPolicies are the policies of one import.
+type importPolicies struct {
+	PhoneCountry PhoneCountryPolicy
+	Duplicates   DuplicatePolicy
+	Conflict     db.ConflictPolicy
+}
+
+/*
+importUsers saves parsed users the way PUT /users does: phone numbers are checked against countries, duplicates and
+taken IDs are resolved according to the policies, and the rest is imported. Returns problemError if a policy rejects
+the import, or the db.Querier error.
+*/
+func (s *Server) importUsers(ctx context.Context, tape logging.Logger, users []db.User, policies importPolicies,
+) (ImportReport, error) {
+	warnings, ok := checkPhoneCountries(users, policies.PhoneCountry)
+	if !ok {
+		tape.Errorf("%d users have a phone number from a different country", len(warnings))
+
+		return ImportReport{}, problemError{
+			Problem: newProblem(CodePhoneCountryMismatch, "Phone numbers do not match the countries", warnings...),
+		}
+	}
+
+	saved, err := s.db.MatchUsers(ctx, users)
+	if err != nil {
+		tape.Errorf("DB error while calling MatchUsers: %s", err)
+
+		return ImportReport{}, err //nolint:wrapcheck // Classified by the caller
+	}
+
+	plan, ok := resolveDuplicates(users, saved, policies.Duplicates)
+	if !ok {
+		tape.Errorf("%d users are duplicates", len(plan.Items))
+
+		return ImportReport{}, problemError{
+			Problem: newProblem(CodeDuplicateUser, "Users are already in the file or in the database", plan.Items...),
+		}
+	}
+
+	warnings = append(warnings, plan.Items...)
+	create, rows := plan.Create()
+	needIDs := usersWithoutID(create)
+
+	if conflicts := idConflicts(create, saved); policies.Conflict == db.ConflictFail && len(conflicts) != 0 {
+		for i := range conflicts {
+			conflicts[i].Row = rows[conflicts[i].Row-1]
+		}
+
+		tape.Errorf("%d users already exist", len(conflicts))
+
+		return ImportReport{}, problemError{
+			Problem: newProblem(CodeConflict, "Users with these IDs already exist", conflicts...),
+		}
+	}
+
+	tape.Debugf("Users that will be added to DB: %v", create)
+
+	updates, _ := plan.Update()
+
+	counts, err := s.db.ImportUsers(ctx, create, policies.Conflict, updates)
+	if err != nil {
+		tape.Errorf("DB error while calling ImportUsers: %s", err)
+
+		return ImportReport{}, err //nolint:wrapcheck // Classified by the caller
+	}
+
+	counts.Skipped += len(users) - len(create) - len(updates)
+
+	assigned := make([]AssignedID, len(needIDs))
+	for i, index := range needIDs {
+		assigned[i] = AssignedID{Row: rows[index], ID: create[index].ID}
+	}
+
+	return ImportReport{
+		OK:          true,
+		Counts:      counts,
+		Warnings:    warnings,
+		AssignedIDs: assigned,
+	}, nil
+}
+
+/*
+readUploadedUsers parses the users in the request body, which is either a CSV file or a JSON array depending on the
+Content-Type. CSV files are read with the import profile named by the "profile" query parameter, if any. Responds with
+an error if not ok.
+*/
+func (s *Server) readUploadedUsers(ctx *gin.Context, tape logging.Logger) ([]db.User, bool) {
+	if contentType := ctx.ContentType(); contentType != mimeCSV && contentType != mimeJSON {
+		tape.Errorf("Wrong content type: %q", contentType)
+		problemResponse(ctx, CodeUnsupportedMediaType,
+			`Expected Content-Type header to be "text/csv" or "application/json"`)
+
+		return nil, false
+	}
+
+	if ctx.Request.Body == nil {
+		tape.Errorf("Empty body")
+		problemResponse(ctx, CodeEmptyBody, "Empty body not allowed")
+
+		return nil, false
+	}
+
+	var (
+		users []db.User
+		err   error
+	)
+
+	switch profileName := ctx.Query("profile"); {
+	case ctx.ContentType() == mimeJSON && profileName != "":
+		tape.Errorf("Profile %q used with JSON", profileName)
+		problemResponse(ctx, CodeBadParameter, "Import profiles can only be used with CSV files")
+
+		return nil, false
+	case ctx.ContentType() == mimeJSON:
+		users, err = ParseUsersJSON(ctx.Request.Body)
+	case profileName != "":
+		queryCtx, cancel := queryContext(ctx, s.timeouts.Read)
+		profile, ok := s.getImportProfile(queryCtx, ctx, tape, profileName)
+		cancel()
+
+		if !ok {
+			return nil, false
+		}
+
+		var records [][]string
+
+		if records, err = profileRecords(profile, ctx.Request.Body); err == nil {
+			users, err = parseUserRecords(records)
+		}
+	default:
+		users, err = ParseUsersCSV(csv.NewReader(ctx.Request.Body))
+	}
+
+	if err != nil {
+		tape.Errorf("Parsing error: %s", err)
+		inputProblemResponse(ctx, err)
+
+		return nil, false
+	}
+
+	if len(users) == 0 {
+		tape.Errorf("Empty users list")
+		problemResponse(ctx, CodeNoUsers, "Request must contain at least one user")
+
+		return nil, false
+	}
+
+	return users, true
+}
+
+// usersWithoutID returns the indexes of the users whose ID is to be assigned by the database.
+func usersWithoutID(users []db.User) []int {
+	indexes := []int{}
+
+	for i, user := range users {
+		if user.ID == 0 {
+			indexes = append(indexes, i)
+		}
+	}
+
+	return indexes
+}
+
+// @Summary Search users
+// @Description List users, optionally only those whose name contains `name` ignoring accents and case and those from
+// @Description `country`. The format is picked from the Accept header.
+// @Produce json,application/x-ndjson,text/csv,xml
+// @Param name query string false "Part of the user's name"
+// @Param country query string false "Country code or name"
+// @Param columns query string false "CSV only: comma separated list of columns to include, all by default"
+// @Param header query bool false "CSV only: include a header row"
+// @Success 200
+// @Failure 406
+// @Router /users [get]
+func (s *Server) SearchUsers(ctx *gin.Context) {
+	tape := logging.NewTape(
+		logging.DebugLevel,
+		logging.NewPrefixedLogger(logging.GlobalLogger, "(Tape (APICall GET /users))"),
+		logging.ErrorLevel,
+		logging.NewPrefixedLogger(logging.GlobalLogger, "(APICall GET /users)"),
+	)
+
+	format, ok := negotiateFormat(ctx, tape, userFormats...)
+	if !ok {
+		return
+	}
+
+	s.listUsers(ctx, tape, format)
+}
+
+// listUsers responds with users that match the filter in the query. CSV and NDJSON are streamed from the DB.
+func (s *Server) listUsers(ctx *gin.Context, tape logging.Logger, format string) {
+	filter := db.UserFilter{
+		Name: norm.NFC.String(ctx.Query("name")),
+	}
+
+	if name := ctx.Query("country"); name != "" {
+		userCountry, err := country.Lookup(norm.NFC.String(name))
+		if err != nil {
+			tape.Errorf("Bad country: %s", err)
+			problemResponsef(ctx, CodeBadParameter, "Bad country parameter: %s", err)
+
+			return
+		}
+
+		filter.Country = userCountry.Alpha2
+	}
+
+	tape.Debugf("Searching users in %s with filter %#v", format, filter)
+
+	if isStreamFormat(format) {
+		stream, err := newUserStream(ctx, format)
+		if err != nil {
+			tape.Errorf("Bad stream parameters: %s", err)
+			problemResponsef(ctx, CodeBadParameter, "Bad parameters: %s", err)
+
+			return
+		}
+
+		queryCtx, cancel := queryContext(ctx, s.timeouts.Export)
+		defer cancel()
+
+		streamUsers(ctx, tape, stream, http.StatusOK, func(fn func(db.User) error) error {
+			return s.db.EachUser(queryCtx, filter, fn) //nolint:wrapcheck // Only logged
+		})
+
+		return
+	}
+
+	queryCtx, cancel := queryContext(ctx, s.timeouts.Read)
+	defer cancel()
+
+	users, err := s.db.SearchUsers(queryCtx, filter)
+	if err != nil {
+		tape.Errorf("DB error while calling SearchUsers: %s", err)
+		dbProblemResponse(ctx, err)
+
+		return
+	}
+
+	tape.Infof("Returning %d users", len(users))
+	renderUsers(ctx, tape, http.StatusOK, format, users)
+}
+
+// @Summary Get a user
+// @Description Get a user by ID. The format is picked from the Accept header.
+// @Produce json,application/x-ndjson,text/csv,xml
+// @Param id path int true "User ID"
+// @Success 200
+// @Failure 400,404,406
+// @Router /users/{id} [get]
+func (s *Server) GetUser(ctx *gin.Context) {
+	tape := logging.NewTape(
+		logging.DebugLevel,
+		logging.NewPrefixedLogger(logging.GlobalLogger, "(Tape (APICall GET /users/:id))"),
+		logging.ErrorLevel,
+		logging.NewPrefixedLogger(logging.GlobalLogger, "(APICall GET /users/:id)"),
+	)
+
+	format, ok := negotiateFormat(ctx, tape, userFormats...)
+	if !ok {
+		return
+	}
+
+	id, err := strconv.ParseInt(ctx.Param("id"), 10, 0)
+	if err != nil {
+		tape.Errorf("Bad ID %q: %s", ctx.Param("id"), err)
+		problemResponse(ctx, CodeBadParameter, "User ID is not a number",
+			ProblemItem{Code: CodeInvalidField, Detail: err.Error(), Field: "id"})
+
+		return
+	}
+
+	queryCtx, cancel := queryContext(ctx, s.timeouts.Read)
+	defer cancel()
+
+	user, err := s.db.GetUserByID(queryCtx, id)
+	if errors.Is(err, db.ErrNotFound) {
+		tape.Errorf("User %d not found", id)
+		problemResponsef(ctx, CodeUserNotFound, "User %d not found", id)
+
+		return
+	}
+
+	if err != nil {
+		tape.Errorf("DB error while calling GetUserByID: %s", err)
+		dbProblemResponse(ctx, err)
+
+		return
+	}
+
+	renderUser(ctx, tape, http.StatusOK, format, user)
+}
+
+// @Summary Update a user
+// @Description Change some fields of a user. Fields missing from the body are kept. The user is validated with the same
+// @Description rules as uploads. The updated user is returned in the format picked from the Accept header.
+// @Accept json
+// @Produce json,application/x-ndjson,text/csv,xml
+// @Param id path int true "User ID"
+// @Success 200
+// @Failure 400,404,406,415,422
+// @Router /users/{id} [patch]
+func (s *Server) UpdateUser(ctx *gin.Context) {
+	tape := logging.NewTape(
+		logging.DebugLevel,
+		logging.NewPrefixedLogger(logging.GlobalLogger, "(Tape (APICall PATCH /users/:id))"),
+		logging.ErrorLevel,
+		logging.NewPrefixedLogger(logging.GlobalLogger, "(APICall PATCH /users/:id)"),
+	)
+
+	format, ok := negotiateFormat(ctx, tape, userFormats...)
+	if !ok {
+		return
+	}
+
+	if ctx.ContentType() != mimeJSON {
 		tape.Errorf("Wrong content type: %q", ctx.ContentType())
-		errorResponse(ctx, http.StatusUnsupportedMediaType, `Expected Content-Type header to be "text/csv"`)
+		problemResponse(ctx, CodeUnsupportedMediaType, `Expected Content-Type header to be "application/json"`)
+
+		return
+	}
+
+	id, err := strconv.ParseInt(ctx.Param("id"), 10, 0)
+	if err != nil {
+		tape.Errorf("Bad ID %q: %s", ctx.Param("id"), err)
+		problemResponse(ctx, CodeBadParameter, "User ID is not a number",
+			ProblemItem{Code: CodeInvalidField, Detail: err.Error(), Field: "id"})
 
 		return
 	}
 
+	var patch UserPatch
+
 	if ctx.Request.Body == nil {
 		tape.Errorf("Empty body")
-		errorResponse(ctx, http.StatusUnprocessableEntity, "Empty CSV file not allowed")
+		problemResponse(ctx, CodeEmptyBody, "Empty body not allowed")
 
 		return
 	}
 
-	csvReader := csv.NewReader(ctx.Request.Body)
+	if err = json.NewDecoder(ctx.Request.Body).Decode(&patch); err != nil {
+		tape.Errorf("Bad patch: %s", err)
+		inputProblemResponse(ctx, jsonError{Err: err})
+
+		return
+	}
+
+	queryCtx, cancel := queryContext(ctx, s.timeouts.Write)
+	defer cancel()
+
+	user, err := s.db.GetUserByID(queryCtx, id)
+	if errors.Is(err, db.ErrNotFound) {
+		tape.Errorf("User %d not found", id)
+		problemResponsef(ctx, CodeUserNotFound, "User %d not found", id)
+
+		return
+	}
 
-	users, err := ParseUsersCSV(csvReader)
 	if err != nil {
-		tape.Errorf("CSV parsing error: %s", err)
-		errorResponsef(ctx, http.StatusUnprocessableEntity, "CSV parsing error: %s", err)
+		tape.Errorf("DB error while calling GetUserByID: %s", err)
+		dbProblemResponse(ctx, err)
 
 		return
 	}
 
-	if len(users) == 0 {
-		tape.Errorf("Empty users list")
-		errorResponse(ctx, http.StatusUnprocessableEntity, "User CSV file must contain at least one user")
+	user, err = PrepareUser(patch.Apply(user))
+	if err != nil {
+		tape.Errorf("Invalid user: %s", err)
+		inputProblemResponse(ctx, err)
 
 		return
 	}
 
-	tape.Debugf("Users that will be added to DB: %v", users)
+	tape.Debugf("Updating user: %v", user)
+
+	err = s.db.UpdateUser(queryCtx, user)
+	if errors.Is(err, db.ErrNotFound) {
+		tape.Errorf("User %d not found", id)
+		problemResponsef(ctx, CodeUserNotFound, "User %d not found", id)
+
+		return
+	}
 
-	err = s.db.CreateUsers(context.Background(), users)
 	if err != nil {
-		tape.Errorf("DB error while calling CreateUsers: %s", err)
-		errorResponsef(ctx, http.StatusInternalServerError, "Database error: %s", err)
+		tape.Errorf("DB error while calling UpdateUser: %s", err)
+		dbProblemResponse(ctx, err)
 
 		return
 	}
 
-	tape.Infof("Returning StatusCreated")
-	okResponse(ctx, http.StatusCreated)
+	renderUser(ctx, tape, http.StatusOK, format, user)
+}
+
+// userCSVFields is the number of fields in every record of a users CSV file. The ID field may be left out.
+const userCSVFields = 5
+
+type fieldCountError struct {
+	Got, Want int
+}
+
+func (e fieldCountError) Error() string {
+	return fmt.Sprintf("expected %d or %d fields, got %d", e.Want-1, e.Want, e.Got)
 }
 
 /*
-ParseUsersCSV parses the CSV file into a User list. If the CSV file has syntax errors returns (nil, err). If there is a
-parsing error for one of the fields, returns all users parsed before the bad one and parsing error.
+ParseUsersCSV parses the CSV file into a User list and prepares each user with PrepareUser. Records either have an ID
+field first or have no ID field at all. An empty or missing ID is parsed as 0, which means the database assigns one.
+
+If the CSV file has syntax errors returns (nil, err) where err wraps *csv.ParseError, and if it cannot be read at all
+an inputError. If there is an error in one of the records, returns all users parsed before the bad one and a
+*FieldError.
 */
 func ParseUsersCSV(reader *csv.Reader) ([]db.User, error) {
+	reader.FieldsPerRecord = -1 // Checked by parseUserRecords, because the ID field is optional
+
 	records, err := reader.ReadAll()
 	if err != nil {
-		return nil, fmt.Errorf("error reading CSV records: %w", err)
+		return nil, inputError{Err: fmt.Errorf("error reading CSV records: %w", err)}
 	}
 
+	return parseUserRecords(records)
+}
+
+// parseUserRecords is ParseUsersCSV after the records are read.
+func parseUserRecords(records [][]string) ([]db.User, error) {
+	var err error
+
 	users := make([]db.User, len(records))
 
 	for i, rec := range records {
-		id, err := strconv.ParseInt(rec[0], 10, 0)
-		if err != nil {
-			return users, fmt.Errorf("record %d: ID is not a number: %w", i, err)
+		var id int64
+
+		switch len(rec) {
+		case userCSVFields:
+			if rec[0] != "" {
+				id, err = strconv.ParseInt(rec[0], 10, 0)
+				if err != nil {
+					return users[:i], &FieldError{Err: fmt.Errorf("ID is not a number: %w", err), Field: "id", Row: i + 1}
+				}
+			}
+
+			rec = rec[1:]
+		case userCSVFields - 1:
+		default:
+			return users[:i], &FieldError{Err: fieldCountError{Got: len(rec), Want: userCSVFields}, Row: i + 1}
 		}
 
-		users[i] = db.User{
-			Name:        rec[1],
-			PhoneNumber: rec[2],
-			Country:     rec[3],
-			City:        rec[4],
+		users[i], err = PrepareUser(db.User{
+			Name:        rec[0],
+			PhoneNumber: rec[1],
+			Country:     rec[2],
+			City:        rec[3],
 			ID:          id,
+		})
+		if err != nil {
+			setRow(err, i+1)
+
+			return users[:i], err
 		}
 	}
 
@@ -0,0 +1,61 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+/*
+Timeouts limit how long the database calls of one request may take, by kind of request. Requests that run out of time
+fail with CodeDatabaseTimeout. Zero means no limit, the request then only stops when the client disconnects.
+*/
+type Timeouts struct {
+	// Read is for requests that read a few users or profiles, and for searches answered in one response.
+	Read time.Duration
+	// Write is for requests that change a few users or profiles, including merges.
+	Write time.Duration
+	// Import is for PUT /users and POST /users/diff, which match every uploaded user against the database. It starts
+	// after the upload is parsed.
+	Import time.Duration
+	// Export is for streamed user lists, which read every matching user.
+	Export time.Duration
+}
+
+// DefaultTimeouts are the Timeouts of NewServer.
+func DefaultTimeouts() Timeouts {
+	return Timeouts{
+		Read:   10 * time.Second, //nolint:gomnd // Documented default
+		Write:  10 * time.Second, //nolint:gomnd // Documented default
+		Import: 5 * time.Minute,  //nolint:gomnd // Documented default
+		Export: 0,
+	}
+}
+
+// WithTimeouts sets how long requests may use the database. Defaults to DefaultTimeouts.
+func WithTimeouts(timeouts Timeouts) ServerOption {
+	return func(s *Server) {
+		s.timeouts = timeouts
+	}
+}
+
+/*
+ErrShuttingDown is the cause to cancel the context of running requests with when the server shuts down, see
+context.WithCancelCause. Their database errors are then reported as CodeShuttingDown instead of CodeRequestCanceled.
+*/
+var ErrShuttingDown = errors.New("server is shutting down") //nolint:gochecknoglobals,forbidigo // Sentinel error
+
+/*
+queryContext returns the context for the database calls of a request. It is done when the client disconnects, when
+the server shuts down and cancels running requests, or after timeout unless it is 0. Handlers call it right before
+their first database call, so that a slow client sending the request body does not use up the time of the database.
+*/
+func queryContext(ctx *gin.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout == 0 {
+		return context.WithCancel(ctx.Request.Context())
+	}
+
+	return context.WithTimeout(ctx.Request.Context(), timeout)
+}
@@ -0,0 +1,217 @@
+package api
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/gin-gonic/gin"
+	"github.com/m-kuzmin/simple-rest-api/country"
+	"github.com/m-kuzmin/simple-rest-api/db"
+	"github.com/m-kuzmin/simple-rest-api/phone"
+	"golang.org/x/text/unicode/norm"
+)
+
+// FieldError is returned when one of the fields of an uploaded user is invalid.
+type FieldError struct {
+	Err   error
+	Field string // Empty if the error is about the whole record or Err is db.ValidationError
+	Row   int    // 1-based record number
+}
+
+func (e *FieldError) Error() string {
+	if e.Field == "" {
+		return fmt.Sprintf("record %d: %s", e.Row, e.Err)
+	}
+
+	return fmt.Sprintf("record %d: %s: %s", e.Row, e.Field, e.Err)
+}
+
+func (e *FieldError) Unwrap() error {
+	return e.Err
+}
+
+/*
+PrepareUser turns a user as uploaded by a client into the form that is stored and checks it with db.ValidateUser. This
+is what every input format (CSV, JSON and PATCH) goes through, so the same rules apply to all of them.
+
+Text fields are normalized to Unicode NFC so that the same name typed on different systems is stored the same way.
+user.PhoneNumber is the number as typed: it is converted to E.164, with the user's country used for numbers in national
+format, and the original input is kept in User.PhoneNumberRaw. Countries are converted to ISO 3166-1 alpha-2 codes and
+unknown ones are rejected.
+
+Returns *FieldError with Row set to 0.
+*/
+func PrepareUser(user db.User) (db.User, error) {
+	userCountry, err := country.Lookup(norm.NFC.String(user.Country))
+	if err != nil {
+		return user, &FieldError{Err: err, Field: "country"}
+	}
+
+	rawPhone := norm.NFC.String(user.PhoneNumber)
+
+	number, err := phone.Parse(rawPhone, userCountry.Alpha2)
+	if err != nil {
+		return user, &FieldError{Err: err, Field: "phoneNumber"}
+	}
+
+	user = db.User{
+		Name:           norm.NFC.String(user.Name),
+		PhoneNumber:    number.E164,
+		PhoneNumberRaw: rawPhone,
+		Country:        userCountry.Alpha2,
+		City:           norm.NFC.String(user.City),
+		ID:             user.ID,
+	}
+
+	if err = db.ValidateUser(user); err != nil {
+		return user, &FieldError{Err: err}
+	}
+
+	return user, nil
+}
+
+/*
+ParseUsersJSON parses a JSON array of users and prepares each of them with PrepareUser. If the JSON is malformed
+returns (nil, err). If a user is invalid, returns all users before the bad one and a *FieldError.
+*/
+func ParseUsersJSON(reader io.Reader) ([]db.User, error) {
+	var users []db.User
+
+	if err := json.NewDecoder(reader).Decode(&users); err != nil {
+		return nil, jsonError{Err: err}
+	}
+
+	for i := range users {
+		user, err := PrepareUser(users[i])
+		if err != nil {
+			setRow(err, i+1)
+
+			return users[:i], err
+		}
+
+		users[i] = user
+	}
+
+	return users, nil
+}
+
+// jsonError is returned when the request body is not the expected JSON.
+type jsonError struct {
+	Err error
+}
+
+func (e jsonError) Error() string {
+	return fmt.Sprintf("error decoding JSON: %s", e.Err)
+}
+
+func (e jsonError) Unwrap() error {
+	return e.Err
+}
+
+// inputError is returned when the request body cannot be read, for example because it is cut short or not in the
+// expected character encoding. Syntax errors are returned as *csv.ParseError or jsonError instead.
+type inputError struct {
+	Err error
+}
+
+func (e inputError) Error() string {
+	return fmt.Sprintf("error reading request body: %s", e.Err)
+}
+
+func (e inputError) Unwrap() error {
+	return e.Err
+}
+
+// UserPatch is the body of PATCH /users/{id}. Only the fields that are present are changed.
+type UserPatch struct {
+	Name        *string `json:"name"`
+	PhoneNumber *string `json:"phoneNumber"`
+	Country     *string `json:"country"`
+	City        *string `json:"city"`
+}
+
+/*
+Apply returns the user with the patch applied, in the form PrepareUser expects. The stored raw phone number is used if
+the patch does not change it, so that a national number is re-read in the new country if the country changes.
+*/
+func (p UserPatch) Apply(user db.User) db.User {
+	if user.PhoneNumberRaw != "" {
+		user.PhoneNumber = user.PhoneNumberRaw
+	}
+
+	for _, field := range []struct {
+		patch *string
+		value *string
+	}{
+		{p.Name, &user.Name},
+		{p.PhoneNumber, &user.PhoneNumber},
+		{p.Country, &user.Country},
+		{p.City, &user.City},
+	} {
+		if field.patch != nil {
+			*field.value = *field.patch
+		}
+	}
+
+	return user
+}
+
+func setRow(err error, row int) {
+	var fieldErr *FieldError
+	if errors.As(err, &fieldErr) {
+		fieldErr.Row = row
+	}
+}
+
+// fieldProblemItems describes what is wrong with a field, one item per broken validation rule.
+func fieldProblemItems(err *FieldError) []ProblemItem {
+	var invalid db.ValidationError
+	if !errors.As(err.Err, &invalid) {
+		return []ProblemItem{{Code: CodeInvalidField, Detail: err.Err.Error(), Field: err.Field, Row: err.Row}}
+	}
+
+	items := make([]ProblemItem, len(invalid.Violations))
+	for i, violation := range invalid.Violations {
+		items[i] = ProblemItem{
+			Code:   CodeInvalidField,
+			Detail: violation.Field + " " + violation.Detail,
+			Field:  violation.Field,
+			Row:    err.Row,
+		}
+	}
+
+	return items
+}
+
+/*
+inputProblemResponse responds with the problem that caused ParseUsersCSV, ParseUsersJSON or PrepareUser to fail. Errors
+that do not come from the request body are internal errors, their message is only logged by the caller.
+*/
+func inputProblemResponse(ctx *gin.Context, err error) {
+	var (
+		fieldErr *FieldError
+		csvErr   *csv.ParseError
+		jsonErr  jsonError
+		inputErr inputError
+	)
+
+	switch {
+	case errors.As(err, &fieldErr):
+		problemResponse(ctx, CodeInvalidField, "Request contains an invalid user", fieldProblemItems(fieldErr)...)
+	case errors.As(err, &csvErr):
+		problemResponse(ctx, CodeCSVSyntax, "CSV file is malformed", ProblemItem{
+			Code:   CodeCSVSyntax,
+			Detail: csvErr.Err.Error(),
+			Line:   csvErr.Line,
+		})
+	case errors.As(err, &jsonErr):
+		problemResponsef(ctx, CodeJSONSyntax, "JSON is malformed: %s", jsonErr.Err)
+	case errors.As(err, &inputErr):
+		problemResponsef(ctx, CodeBadInput, "Request body cannot be read: %s", inputErr.Err)
+	default:
+		problemResponse(ctx, CodeInternal, "")
+	}
+}
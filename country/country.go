@@ -0,0 +1,147 @@
+/*
+Package country looks up ISO 3166-1 countries by code or name. The table is embedded in the binary, see countries.csv
+and gen.go.
+*/
+package country
+
+import (
+	"bytes"
+	_ "embed" // For the country table
+	"encoding/csv"
+	"fmt"
+	"strings"
+	"sync"
+	"unicode"
+
+	"golang.org/x/text/runes"
+	"golang.org/x/text/transform"
+	"golang.org/x/text/unicode/norm"
+)
+
+//go:generate go run gen.go
+
+//go:embed countries.csv
+var countriesCSV []byte
+
+// Country is an ISO 3166-1 country.
+type Country struct {
+	Alpha2  string `json:"alpha2"  xml:"alpha2"`
+	Alpha3  string `json:"alpha3"  xml:"alpha3"`
+	Numeric string `json:"numeric" xml:"numeric"` // Zero padded to 3 digits
+	Name    string `json:"name"    xml:"name"`    // ISO 3166-1 English short name
+}
+
+// UnknownError is returned by Lookup when the input does not name any country.
+type UnknownError struct {
+	Input string
+}
+
+func (e UnknownError) Error() string {
+	return fmt.Sprintf("unknown country %q", e.Input)
+}
+
+type table struct {
+	countries []Country
+	index     map[string]int // key() of every code and name -> index in countries
+}
+
+var (
+	loadOnce sync.Once //nolint:gochecknoglobals // The table is parsed on first use
+	loaded   table     //nolint:gochecknoglobals // The table is parsed on first use
+)
+
+func countryTable() table {
+	loadOnce.Do(func() {
+		loaded = parseTable(countriesCSV)
+	})
+
+	return loaded
+}
+
+/*
+parseTable reads countries.csv. Codes are indexed before names, and English names before aliases and localized ones,
+so if two countries share a key the more authoritative match wins.
+*/
+func parseTable(data []byte) table {
+	records, err := csv.NewReader(bytes.NewReader(data)).ReadAll()
+	if err != nil {
+		panic(fmt.Sprintf("country: embedded countries.csv is malformed: %s", err))
+	}
+
+	records = records[1:] // Header
+
+	tbl := table{
+		countries: make([]Country, len(records)),
+		index:     make(map[string]int, len(records)*16), //nolint:gomnd // About as many names per country
+	}
+
+	for i, rec := range records {
+		tbl.countries[i] = Country{Alpha2: rec[0], Alpha3: rec[1], Numeric: rec[2], Name: rec[3]}
+	}
+
+	add := func(i int, name string) {
+		if k := key(name); k != "" {
+			if _, exists := tbl.index[k]; !exists {
+				tbl.index[k] = i
+			}
+		}
+	}
+
+	for column := 0; column <= 3; column++ {
+		for i, rec := range records {
+			add(i, rec[column])
+		}
+	}
+
+	for i, rec := range records {
+		for _, alias := range strings.Split(rec[4], "|") {
+			add(i, alias)
+		}
+	}
+
+	return tbl
+}
+
+/*
+key folds case and accents and drops everything except letters and digits, so "U.S.A." matches "usa". "&" is read as
+"and", so "Antigua & Barbuda" matches "Antigua and Barbuda".
+*/
+func key(name string) string {
+	unaccent := transform.Chain(norm.NFD, runes.Remove(runes.In(unicode.Mn)), norm.NFC)
+
+	folded, _, err := transform.String(unaccent, name)
+	if err != nil {
+		folded = name
+	}
+
+	folded = strings.ReplaceAll(folded, "&", "and")
+
+	return strings.Map(func(r rune) rune {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			return unicode.ToLower(r)
+		}
+
+		return -1
+	}, folded)
+}
+
+// All returns every ISO 3166-1 country sorted by alpha-2 code.
+func All() []Country {
+	countries := countryTable().countries
+
+	return append(make([]Country, 0, len(countries)), countries...)
+}
+
+/*
+Lookup finds a country by its alpha-2, alpha-3 or numeric code, ISO 3166-1 short or official name, English CLDR name, a
+common alias such as "UK", or its name in one of the major languages. Case, accents and punctuation are ignored.
+*/
+func Lookup(name string) (Country, error) {
+	tbl := countryTable()
+
+	if i, found := tbl.index[key(name)]; found {
+		return tbl.countries[i], nil
+	}
+
+	return Country{}, UnknownError{Input: name}
+}
@@ -0,0 +1,100 @@
+package country_test
+
+import (
+	"testing"
+
+	"github.com/m-kuzmin/simple-rest-api/country"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestShouldHaveAllISOCountries(t *testing.T) {
+	t.Parallel()
+
+	assert.Len(t, country.All(), 249)
+}
+
+func TestShouldLookupByCodeAliasAndLocalizedName(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]string{
+		"US":                       "US",
+		"usa":                      "US",
+		"840":                      "US",
+		"United States":            "US",
+		"United States of America": "US",
+		"U.S.A.":                   "US",
+		"Estados Unidos":           "US",
+		"UK":                       "GB",
+		"Great Britain":            "GB",
+		"Deutschland":              "DE",
+		"Allemagne":                "DE",
+		"Côte d’Ivoire":            "CI",
+		"cote d'ivoire":            "CI",
+		"  germany ":               "DE",
+		"ドイツ":                      "DE",
+	}
+
+	for input, alpha2 := range tests {
+		found, err := country.Lookup(input)
+		assert.Nil(t, err, input)
+		assert.Equal(t, alpha2, found.Alpha2, input)
+	}
+}
+
+func TestShouldLookupEveryISOName(t *testing.T) {
+	t.Parallel()
+
+	for _, want := range country.All() {
+		for _, input := range []string{want.Name, want.Alpha2, want.Alpha3, want.Numeric} {
+			found, err := country.Lookup(input)
+			assert.Nil(t, err, input)
+			assert.Equal(t, want, found, input)
+		}
+	}
+}
+
+func TestShouldLookupISONamesAndCLDRAliases(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		input, alpha2, name string
+	}{
+		{input: "Bosnia and Herzegovina", alpha2: "BA", name: "Bosnia and Herzegovina"},
+		{input: "Bosnia & Herzegovina", alpha2: "BA", name: "Bosnia and Herzegovina"},
+		{input: "Trinidad and Tobago", alpha2: "TT", name: "Trinidad and Tobago"},
+		{input: "Trinidad & Tobago", alpha2: "TT", name: "Trinidad and Tobago"},
+		{input: "Antigua and Barbuda", alpha2: "AG", name: "Antigua and Barbuda"},
+		{input: "Antigua & Barbuda", alpha2: "AG", name: "Antigua and Barbuda"},
+		{input: "Saint Kitts and Nevis", alpha2: "KN", name: "Saint Kitts and Nevis"},
+		{input: "St. Kitts & Nevis", alpha2: "KN", name: "Saint Kitts and Nevis"},
+		{input: "Korea, Republic of", alpha2: "KR", name: "Korea, Republic of"},
+		{input: "South Korea", alpha2: "KR", name: "Korea, Republic of"},
+		{input: "United Kingdom of Great Britain and Northern Ireland", alpha2: "GB", name: "United Kingdom"},
+		{input: "Palestine, State of", alpha2: "PS", name: "Palestine, State of"},
+		{input: "Hong Kong", alpha2: "HK", name: "Hong Kong"},
+		{input: "Hong Kong SAR China", alpha2: "HK", name: "Hong Kong"},
+		{input: "Macao", alpha2: "MO", name: "Macao"},
+		{input: "Macau SAR China", alpha2: "MO", name: "Macao"},
+		{input: "Congo", alpha2: "CG", name: "Congo"},
+		{input: "Congo - Kinshasa", alpha2: "CD", name: "Congo, The Democratic Republic of the"},
+	}
+
+	for _, test := range tests {
+		found, err := country.Lookup(test.input)
+		assert.Nil(t, err, test.input)
+		assert.Equal(t, test.alpha2, found.Alpha2, test.input)
+		assert.Equal(t, test.name, found.Name, test.input)
+	}
+}
+
+func TestShouldRejectUnknownCountries(t *testing.T) {
+	t.Parallel()
+
+	for _, input := range []string{"", "Atlantis", "XX", "Yugoslavia"} {
+		_, err := country.Lookup(input)
+
+		var unknown country.UnknownError
+
+		assert.ErrorAs(t, err, &unknown, input)
+	}
+}
@@ -0,0 +1,130 @@
+//go:build ignore
+
+/*
+This program generates countries.csv from the ISO 3166-1 list of the iso-codes package
+(https://salsa.debian.org/iso-codes-team/iso-codes, installed as /usr/share/iso-codes on Debian and Ubuntu) and the CLDR
+data in golang.org/x/text. Run it with `go generate ./country`, or `go run gen.go -iso path/to/iso_3166-1.json`.
+
+The ISO short name is the name of every country. The ISO official and common names, the CLDR English name and the CLDR
+names in other languages are aliases.
+*/
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"os"
+	"sort"
+	"strings"
+
+	"golang.org/x/text/language"
+	"golang.org/x/text/language/display"
+)
+
+// isoCountry is an entry of iso_3166-1.json.
+type isoCountry struct {
+	Alpha2       string `json:"alpha_2"`
+	Alpha3       string `json:"alpha_3"`
+	Numeric      string `json:"numeric"`
+	Name         string `json:"name"`
+	OfficialName string `json:"official_name"`
+	CommonName   string `json:"common_name"`
+}
+
+// aliases are common names that are neither ISO nor CLDR names.
+var aliases = map[string][]string{
+	"US": {"United States of America", "America", "U.S.", "U.S.A."},
+	"GB": {"UK", "U.K.", "Great Britain", "Britain"},
+	"KR": {"Republic of Korea", "Korea"},
+	"KP": {"Democratic People's Republic of Korea"},
+	"CZ": {"Czech Republic"},
+	"NL": {"Holland", "The Netherlands"},
+	"CD": {"DRC", "DR Congo", "Democratic Republic of the Congo"},
+	"CG": {"Republic of the Congo"},
+	"CI": {"Ivory Coast"},
+	"TR": {"Turkey"},
+	"MK": {"Macedonia"},
+	"SZ": {"Swaziland"},
+	"MM": {"Burma"},
+	"VA": {"Holy See", "Vatican"},
+	"AE": {"UAE"},
+	"IR": {"Islamic Republic of Iran"},
+	"BO": {"Plurinational State of Bolivia"},
+	"VE": {"Bolivarian Republic of Venezuela"},
+	"TZ": {"United Republic of Tanzania"},
+	"MD": {"Republic of Moldova"},
+	"FM": {"Federated States of Micronesia"},
+}
+
+// localized are the languages whose country names are accepted.
+var localized = []language.Tag{
+	language.German, language.French, language.Spanish, language.Italian, language.Portuguese, language.Dutch,
+	language.Polish, language.Russian, language.Ukrainian, language.Turkish, language.Chinese, language.Japanese,
+	language.Korean, language.Arabic,
+}
+
+func main() {
+	isoPath := flag.String("iso", "/usr/share/iso-codes/json/iso_3166-1.json", "The iso_3166-1.json of iso-codes")
+	flag.Parse()
+
+	data, err := os.ReadFile(*isoPath)
+	if err != nil {
+		panic(err)
+	}
+
+	var iso struct {
+		Countries []isoCountry `json:"3166-1"`
+	}
+
+	if err = json.Unmarshal(data, &iso); err != nil {
+		panic(err)
+	}
+
+	sort.Slice(iso.Countries, func(i, j int) bool { return iso.Countries[i].Alpha2 < iso.Countries[j].Alpha2 })
+
+	out, err := os.Create("countries.csv")
+	if err != nil {
+		panic(err)
+	}
+	defer out.Close()
+
+	writer := csv.NewWriter(out)
+	_ = writer.Write([]string{"alpha2", "alpha3", "numeric", "name", "aliases"})
+
+	for _, country := range iso.Countries {
+		names := map[string]bool{country.OfficialName: true, country.CommonName: true}
+
+		for _, alias := range aliases[country.Alpha2] {
+			names[alias] = true
+		}
+
+		if region, err := language.ParseRegion(country.Alpha2); err == nil {
+			names[display.English.Regions().Name(region)] = true
+
+			for _, lang := range localized {
+				names[display.Regions(lang).Name(region)] = true
+			}
+		}
+
+		delete(names, country.Name)
+		delete(names, "")
+
+		list := make([]string, 0, len(names))
+		for n := range names {
+			list = append(list, n)
+		}
+
+		sort.Strings(list)
+
+		_ = writer.Write([]string{
+			country.Alpha2, country.Alpha3, country.Numeric, country.Name, strings.Join(list, "|"),
+		})
+	}
+
+	writer.Flush()
+
+	if err := writer.Error(); err != nil {
+		panic(err)
+	}
+}
@@ -1,21 +1,186 @@
 package db
 
-import "context"
+import (
+	"context"
+	"strings"
+	"time"
+)
 
 // Querier is for all queries to all tables in the DB
 type Querier interface {
 	UserQuerier
+	ImportProfileQuerier
 }
 
 // UserQuerier is for queries to the users table
 type UserQuerier interface {
-	CreateUsers(context.Context, []User) error
+	/*
+		CreateUsers saves the users. Users whose ID is 0 get a new ID that is greater than every ID in the table, and
+		that ID is written to their element of the slice.
+	*/
+	CreateUsers(ctx context.Context, users []User) error
+
+	/*
+		ImportUsers saves the users like CreateUsers, except that users whose ID is already taken are handled according
+		to the policy. In the same transaction it replaces the saved users in overwrite like UpdateUser, regardless of
+		the policy. Returns how many users were created, updated and skipped, or ErrNotFound if a user to overwrite
+		does not exist, in which case nothing is saved.
+	*/
+	ImportUsers(ctx context.Context, users []User, policy ConflictPolicy, overwrite []User) (ImportCounts, error)
+
+	// GetUserByID returns the user with this ID or ErrNotFound.
+	GetUserByID(ctx context.Context, id int64) (User, error)
+
+	// GetUsersByIDs returns the users with these IDs ordered by ID. IDs without a user are left out.
+	GetUsersByIDs(ctx context.Context, ids []int64) ([]User, error)
+
+	// UpdateUser replaces all fields of the user with the same ID. Returns ErrNotFound if there is no such user.
+	UpdateUser(ctx context.Context, user User) error
+
+	/*
+		MatchUsers returns the saved users that have the same non-zero ID as one of the candidates or are probable
+		duplicates of one (see ProbableDuplicates), ordered by ID.
+	*/
+	MatchUsers(ctx context.Context, candidates []User) ([]User, error)
+
+	// DuplicateUsers returns every cluster of similar users, see ClusterDuplicates.
+	DuplicateUsers(ctx context.Context) ([][]User, error)
+
+	/*
+		MergeUsers atomically reads the users of the spec, picks the fields of the survivor from them, overwrites the
+		survivor, deletes the merged users and records the merge in the audit trail. No other write can change the
+		users in between. Returns the merge, UserNotFoundError if one of the users does not exist, or ValidationError
+		if the survivor would be invalid.
+	*/
+	MergeUsers(ctx context.Context, spec MergeSpec) (Merge, error)
+
+	// ListMerges returns the audit trail of MergeUsers ordered by Merge.ID.
+	ListMerges(ctx context.Context) ([]Merge, error)
+
+	// SearchUsers returns all users that match the filter ordered by ID.
+	SearchUsers(context.Context, UserFilter) ([]User, error)
+
+	/*
+		EachUser calls fn for every user that matches the filter in ID order. Unlike SearchUsers it does not hold all of
+		the results in memory at once, so it is suitable for exporting the whole table. Iteration stops at the first
+		error returned by fn and that error is returned as is.
+	*/
+	EachUser(ctx context.Context, filter UserFilter, fn func(User) error) error
+}
+
+// ImportProfileQuerier is for queries to the import_profiles table
+type ImportProfileQuerier interface {
+	// CreateImportProfile saves a new profile. Returns an ErrConflict error if the name is taken.
+	CreateImportProfile(ctx context.Context, profile ImportProfile) error
+
+	// GetImportProfile returns the profile with this name or ErrNotFound.
+	GetImportProfile(ctx context.Context, name string) (ImportProfile, error)
+
+	// ListImportProfiles returns all profiles ordered by name.
+	ListImportProfiles(ctx context.Context) ([]ImportProfile, error)
+
+	// UpdateImportProfile replaces the profile with the same name. Returns ErrNotFound if there is no such profile.
+	UpdateImportProfile(ctx context.Context, profile ImportProfile) error
+
+	// DeleteImportProfile deletes the profile with this name. Returns ErrNotFound if there is no such profile.
+	DeleteImportProfile(ctx context.Context, name string) error
 }
 
+/*
+ImportProfile describes the CSV files of one partner: how to read them and which column is which User field. It is a
+row of the import_profiles table.
+*/
+type ImportProfile struct {
+	Name string `json:"name"`
+	// Columns is the User field (by JSON name) of each CSV column. Columns mapped to "" are ignored.
+	Columns   []string `json:"columns"`
+	Delimiter string   `json:"delimiter"`
+	// Encoding is the character encoding of the file, by its WHATWG name, for example "windows-1252".
+	Encoding string `json:"encoding"`
+	// Header is true if the first record of the file is a header that should be skipped.
+	Header bool `json:"header"`
+	// Defaults are used for fields that have no column or are empty in a record, by JSON name.
+	Defaults map[string]string `json:"defaults"`
+}
+
+/*
+User is a row of the users table. The `validate` tags mirror the column types of the table and are checked with
+ValidateUser before users are saved.
+*/
 type User struct {
-	Name        string
-	PhoneNumber string
-	Country     string
-	City        string
-	ID          int64
+	Name string `json:"name" validate:"required,max=256,personname" xml:"name"`
+	// PhoneNumber is in E.164 format, see package phone.
+	PhoneNumber string `json:"phoneNumber" validate:"required,max=32,e164" xml:"phoneNumber"`
+	// PhoneNumberRaw is the phone number exactly as it was uploaded.
+	PhoneNumberRaw string `json:"phoneNumberRaw" validate:"max=64" xml:"phoneNumberRaw"`
+	// Country is an ISO 3166-1 alpha-2 code, see package country.
+	Country string `json:"country" validate:"required,max=128,iso3166_1_alpha2" xml:"country"`
+	City    string `json:"city"    validate:"required,max=128,placename"        xml:"city"`
+	// ID is 0 for users that have not been saved yet and should get an ID from the database.
+	ID int64 `json:"id" validate:"omitempty,gt=0" xml:"id"`
+}
+
+// ConflictPolicy decides what UserQuerier.ImportUsers does with users whose ID is already taken.
+type ConflictPolicy string
+
+const (
+	// ConflictFail returns an ErrConflict error, like CreateUsers.
+	ConflictFail ConflictPolicy = "fail"
+	// ConflictSkip keeps the saved user.
+	ConflictSkip ConflictPolicy = "skip"
+	// ConflictOverwrite replaces the saved user.
+	ConflictOverwrite ConflictPolicy = "overwrite"
+)
+
+// ImportCounts is the outcome of UserQuerier.ImportUsers.
+type ImportCounts struct {
+	Created int `json:"created"`
+	Updated int `json:"updated"`
+	Skipped int `json:"skipped"`
+}
+
+/*
+resolveConflict returns the saved user with the uploaded one applied according to the policy, and whether that changed
+anything. ConflictFail is not handled here.
+*/
+func resolveConflict(saved, uploaded User, policy ConflictPolicy) (User, bool) {
+	switch policy {
+	case ConflictOverwrite:
+		return uploaded, true
+	default:
+		return saved, false
+	}
+}
+
+// Merge is a record in the audit trail of merged users.
+type Merge struct {
+	ID       int64  `json:"id"`
+	Survivor User   `json:"survivor"` // The user after the merge
+	Merged   []User `json:"merged"`   // The users merged into Survivor as they were before they were deleted
+	// Fields is the ID of the user each field of Survivor was taken from, by JSON field name.
+	Fields   map[string]int64 `json:"fields"`
+	MergedAt time.Time        `json:"mergedAt"`
+}
+
+/*
+ProbableDuplicates reports whether a and b are likely the same person saved twice: they have the same phone number, or
+the same name and city ignoring accents and case. IDs are not compared.
+*/
+func ProbableDuplicates(a, b User) bool {
+	return a.PhoneNumber == b.PhoneNumber ||
+		FoldText(a.Name) == FoldText(b.Name) && FoldText(a.City) == FoldText(b.City)
+}
+
+// UserFilter narrows down the results of UserQuerier.SearchUsers. Empty fields match every user.
+type UserFilter struct {
+	// Name matches users whose name contains this substring. Comparison is accent- and case-insensitive (see FoldText).
+	Name string
+	// Country matches users from this country, an ISO 3166-1 alpha-2 code.
+	Country string
+}
+
+// Matches reports whether the user passes the filter.
+func (f UserFilter) Matches(user User) bool {
+	return (f.Name == "" || strings.Contains(FoldText(user.Name), FoldText(f.Name))) &&
+		(f.Country == "" || user.Country == f.Country)
 }
@@ -0,0 +1,516 @@
+/*
+Package dbtest checks that a db.Querier behaves like every other one. Each backend runs the same suite in its own tests:
+
+	func TestInMemoryDBConformance(t *testing.T) {
+		dbtest.RunQuerierSuite(t, func(t *testing.T) db.Querier {
+			return db.NewInMemoryDB()
+		})
+	}
+*/
+package dbtest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/m-kuzmin/simple-rest-api/db"
+	"github.com/stretchr/testify/assert"
+)
+
+// largeBatch is larger than a page of EachUser in every backend.
+const largeBatch = 1234
+
+/*
+Factory returns a new, empty database for one test. It should register cleanup with t.Cleanup and fail the test if the
+database cannot be created.
+*/
+type Factory func(t *testing.T) db.Querier
+
+// RunQuerierSuite runs every test of the suite against databases from the factory. Each test gets a new database.
+func RunQuerierSuite(t *testing.T, factory Factory) {
+	t.Helper()
+
+	tests := []struct {
+		name string
+		test func(*testing.T, db.Querier)
+	}{
+		{"CreateUsersGeneratesIDs", testCreateUsersGeneratesIDs},
+		{"FirstGeneratedID", testFirstGeneratedID},
+		{"CreateUsersRejectsTakenIDs", testCreateUsersRejectsTakenIDs},
+		{"CreateUsersIsAtomic", testCreateUsersIsAtomic},
+		{"ImportUsersFollowsPolicy", testImportUsersFollowsPolicy},
+		{"ImportUsersRepeatedID", testImportUsersRepeatedID},
+		{"ImportUsersOverwrite", testImportUsersOverwrite},
+		{"EmptyInput", testEmptyInput},
+		{"LargeBatch", testLargeBatch},
+		{"GetAndUpdateUser", testGetAndUpdateUser},
+		{"SearchUsers", testSearchUsers},
+		{"EachUserStopsOnError", testEachUserStopsOnError},
+		{"MatchUsers", testMatchUsers},
+		{"DuplicateUsers", testDuplicateUsers},
+		{"MergeUsers", testMergeUsers},
+		{"ImportProfiles", testImportProfiles},
+		{"CanceledContext", testCanceledContext},
+		{"ExpiredContext", testExpiredContext},
+	}
+
+	for _, test := range tests {
+		test := test
+
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+
+			test.test(t, factory(t))
+		})
+	}
+}
+
+// newUser returns a valid user with a phone number and city that depend on n, so that users with different n are not
+// duplicates of each other.
+func newUser(n int, name string) db.User {
+	return db.User{
+		Name:           name,
+		PhoneNumber:    fmt.Sprintf("+1800%07d", n),
+		PhoneNumberRaw: fmt.Sprintf("800%07d", n),
+		Country:        "US",
+		City:           fmt.Sprintf("Springfield %d", n),
+	}
+}
+
+func withID(user db.User, id int64) db.User {
+	user.ID = id
+
+	return user
+}
+
+// mustCreate saves the users or stops the test.
+func mustCreate(t *testing.T, database db.Querier, users ...db.User) []db.User {
+	t.Helper()
+
+	if err := database.CreateUsers(context.Background(), users); err != nil {
+		t.Fatalf("CreateUsers: %s", err)
+	}
+
+	return users
+}
+
+func allUsers(t *testing.T, database db.Querier) []db.User {
+	t.Helper()
+
+	users, err := database.SearchUsers(context.Background(), db.UserFilter{})
+	assert.Nil(t, err)
+
+	return users
+}
+
+func ids(users []db.User) []int64 {
+	ids := make([]int64, len(users))
+	for i, user := range users {
+		ids[i] = user.ID
+	}
+
+	return ids
+}
+
+func testCreateUsersGeneratesIDs(t *testing.T, database db.Querier) {
+	users := mustCreate(t, database, newUser(1, "John Doe"), withID(newUser(2, "Jane Roe"), 10), newUser(3, "Max Power"))
+
+	assert.Equal(t, int64(10), users[1].ID)
+	assert.Greater(t, users[0].ID, int64(10), "generated IDs must be greater than explicit ones")
+	assert.Greater(t, users[2].ID, int64(10), "generated IDs must be greater than explicit ones")
+	assert.NotEqual(t, users[0].ID, users[2].ID)
+	assert.Equal(t, users, mapByID(allUsers(t, database), ids(users)))
+
+	more := mustCreate(t, database, newUser(4, "Erika Mustermann"))
+	assert.Greater(t, more[0].ID, users[2].ID, "IDs keep growing")
+}
+
+func testFirstGeneratedID(t *testing.T, database db.Querier) {
+	users := mustCreate(t, database, newUser(1, "John Doe"))
+	assert.Equal(t, int64(1), users[0].ID, "no ID may be skipped in a new database")
+
+	// Moving past an explicit ID must not skip one either
+	users = mustCreate(t, database, withID(newUser(2, "Jane Roe"), 2), newUser(3, "Max Power"))
+	assert.Equal(t, int64(3), users[1].ID)
+}
+
+// mapByID returns the users with these IDs in this order.
+func mapByID(users []db.User, order []int64) []db.User {
+	byID := map[int64]db.User{}
+	for _, user := range users {
+		byID[user.ID] = user
+	}
+
+	ordered := make([]db.User, len(order))
+	for i, id := range order {
+		ordered[i] = byID[id]
+	}
+
+	return ordered
+}
+
+func testCreateUsersRejectsTakenIDs(t *testing.T, database db.Querier) {
+	mustCreate(t, database, withID(newUser(1, "John Doe"), 1))
+
+	err := database.CreateUsers(context.Background(), []db.User{withID(newUser(2, "Jane Roe"), 1)})
+	assert.True(t, errors.Is(err, db.ErrConflict), "got %v", err)
+
+	user, err := database.GetUserByID(context.Background(), 1)
+	assert.Nil(t, err)
+	assert.Equal(t, "John Doe", user.Name, "the saved user must be kept")
+}
+
+func testCreateUsersIsAtomic(t *testing.T, database db.Querier) {
+	err := database.CreateUsers(context.Background(), []db.User{
+		withID(newUser(1, "John Doe"), 1),
+		newUser(2, "Jane Roe"),
+		withID(newUser(3, "Max Power"), 1),
+	})
+	assert.True(t, errors.Is(err, db.ErrConflict), "got %v", err)
+	assert.Empty(t, allUsers(t, database), "nothing may be saved if one user fails")
+}
+
+func testImportUsersFollowsPolicy(t *testing.T, database db.Querier) {
+	ctx := context.Background()
+	saved := withID(newUser(1, "John Doe"), 1)
+	uploaded := withID(newUser(2, "Johnny Doe"), 1)
+
+	mustCreate(t, database, saved)
+
+	_, err := database.ImportUsers(ctx, []db.User{uploaded}, db.ConflictFail, nil)
+	assert.True(t, errors.Is(err, db.ErrConflict), "got %v", err)
+
+	counts, err := database.ImportUsers(ctx, []db.User{uploaded, newUser(3, "New User")}, db.ConflictSkip, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, db.ImportCounts{Created: 1, Updated: 0, Skipped: 1}, counts)
+
+	user, err := database.GetUserByID(ctx, 1)
+	assert.Nil(t, err)
+	assert.Equal(t, saved, user)
+
+	counts, err = database.ImportUsers(ctx, []db.User{uploaded}, db.ConflictOverwrite, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, db.ImportCounts{Created: 0, Updated: 1, Skipped: 0}, counts)
+
+	user, err = database.GetUserByID(ctx, 1)
+	assert.Nil(t, err)
+	assert.Equal(t, uploaded, user)
+}
+
+func testImportUsersRepeatedID(t *testing.T, database db.Querier) {
+	counts, err := database.ImportUsers(context.Background(), []db.User{
+		withID(newUser(1, "John Doe"), 1),
+		withID(newUser(2, "Johnny Doe"), 1),
+	}, db.ConflictOverwrite, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, db.ImportCounts{Created: 1, Updated: 1, Skipped: 0}, counts)
+
+	users := allUsers(t, database)
+	if assert.Len(t, users, 1) {
+		assert.Equal(t, "Johnny Doe", users[0].Name, "a later row overwrites an earlier one")
+	}
+}
+
+func testImportUsersOverwrite(t *testing.T, database db.Querier) {
+	ctx := context.Background()
+	saved := mustCreate(t, database, newUser(1, "John Doe"))
+	replaced := withID(newUser(2, "Johnny Doe"), saved[0].ID)
+
+	counts, err := database.ImportUsers(ctx, []db.User{newUser(3, "Jane Roe")}, db.ConflictFail, []db.User{replaced})
+	assert.Nil(t, err)
+	assert.Equal(t, db.ImportCounts{Created: 1, Updated: 1, Skipped: 0}, counts)
+
+	users := allUsers(t, database)
+	if assert.Len(t, users, 2) {
+		assert.Equal(t, replaced, users[0])
+	}
+
+	_, err = database.ImportUsers(ctx, []db.User{newUser(4, "Jim Roe")}, db.ConflictFail, []db.User{
+		withID(newUser(5, "Jimmy Roe"), 1000),
+	})
+	assert.True(t, errors.Is(err, db.ErrNotFound), "got %v", err)
+	assert.Equal(t, users, allUsers(t, database), "nothing may be saved if a user to overwrite is missing")
+}
+
+func testEmptyInput(t *testing.T, database db.Querier) {
+	ctx := context.Background()
+
+	assert.Nil(t, database.CreateUsers(ctx, nil))
+
+	counts, err := database.ImportUsers(ctx, []db.User{}, db.ConflictSkip, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, db.ImportCounts{}, counts)
+
+	// Empty results must be empty slices, not nil, so that they are rendered as [] in JSON
+	users, err := database.SearchUsers(ctx, db.UserFilter{})
+	assert.Nil(t, err)
+	assert.NotNil(t, users)
+	assert.Empty(t, users)
+
+	users, err = database.GetUsersByIDs(ctx, nil)
+	assert.Nil(t, err)
+	assert.NotNil(t, users)
+	assert.Empty(t, users)
+
+	users, err = database.MatchUsers(ctx, nil)
+	assert.Nil(t, err)
+	assert.NotNil(t, users)
+	assert.Empty(t, users)
+
+	clusters, err := database.DuplicateUsers(ctx)
+	assert.Nil(t, err)
+	assert.NotNil(t, clusters)
+	assert.Empty(t, clusters)
+
+	merges, err := database.ListMerges(ctx)
+	assert.Nil(t, err)
+	assert.NotNil(t, merges)
+	assert.Empty(t, merges)
+
+	profiles, err := database.ListImportProfiles(ctx)
+	assert.Nil(t, err)
+	assert.NotNil(t, profiles)
+	assert.Empty(t, profiles)
+
+	assert.Nil(t, database.EachUser(ctx, db.UserFilter{}, func(db.User) error {
+		t.Error("EachUser called fn on an empty database")
+
+		return nil
+	}))
+}
+
+func testLargeBatch(t *testing.T, database db.Querier) {
+	users := make([]db.User, largeBatch)
+	for i := range users {
+		users[i] = newUser(i, fmt.Sprintf("User %d", i))
+	}
+
+	mustCreate(t, database, users...)
+
+	seen := map[int64]bool{}
+	previous := int64(0)
+
+	assert.Nil(t, database.EachUser(context.Background(), db.UserFilter{}, func(user db.User) error {
+		assert.Greater(t, user.ID, previous, "EachUser must go in ID order")
+		assert.False(t, seen[user.ID], "EachUser must not repeat users")
+
+		seen[user.ID] = true
+		previous = user.ID
+
+		return nil
+	}))
+	assert.Len(t, seen, largeBatch)
+	assert.Len(t, allUsers(t, database), largeBatch)
+
+	found, err := database.GetUsersByIDs(context.Background(), ids(users))
+	assert.Nil(t, err)
+	assert.Len(t, found, largeBatch)
+}
+
+func testGetAndUpdateUser(t *testing.T, database db.Querier) {
+	ctx := context.Background()
+	user := mustCreate(t, database, newUser(1, "John Doe"))[0]
+
+	_, err := database.GetUserByID(ctx, user.ID+1)
+	assert.True(t, errors.Is(err, db.ErrNotFound), "got %v", err)
+
+	user.City = "Shelbyville"
+	assert.Nil(t, database.UpdateUser(ctx, user))
+
+	saved, err := database.GetUserByID(ctx, user.ID)
+	assert.Nil(t, err)
+	assert.Equal(t, user, saved)
+
+	err = database.UpdateUser(ctx, withID(user, user.ID+1))
+	assert.True(t, errors.Is(err, db.ErrNotFound), "got %v", err)
+
+	found, err := database.GetUsersByIDs(ctx, []int64{user.ID + 1, user.ID})
+	assert.Nil(t, err)
+	assert.Equal(t, []db.User{user}, found)
+}
+
+func testSearchUsers(t *testing.T, database db.Querier) {
+	ctx := context.Background()
+	jose := newUser(1, "José Müller")
+	jose.Country = "DE"
+	users := mustCreate(t, database, jose, newUser(2, "John Doe"), newUser(3, "Jane Roe"))
+
+	found, err := database.SearchUsers(ctx, db.UserFilter{Name: "jose MULLER"})
+	assert.Nil(t, err)
+	assert.Equal(t, users[:1], found, "names are compared ignoring accents and case")
+
+	found, err = database.SearchUsers(ctx, db.UserFilter{Name: "j", Country: "US"})
+	assert.Nil(t, err)
+	assert.Equal(t, users[1:], found)
+
+	exported := []db.User{}
+	assert.Nil(t, database.EachUser(ctx, db.UserFilter{Country: "DE"}, func(user db.User) error {
+		exported = append(exported, user)
+
+		return nil
+	}))
+	assert.Equal(t, users[:1], exported)
+}
+
+var errStop = errors.New("stop") //nolint:gochecknoglobals,forbidigo // Returned as is by EachUser
+
+func testEachUserStopsOnError(t *testing.T, database db.Querier) {
+	mustCreate(t, database, newUser(1, "John Doe"), newUser(2, "Jane Roe"))
+
+	calls := 0
+	err := database.EachUser(context.Background(), db.UserFilter{}, func(db.User) error {
+		calls++
+
+		return errStop
+	})
+	assert.Equal(t, errStop, err, "the error of fn must be returned as is")
+	assert.Equal(t, 1, calls)
+}
+
+func testMatchUsers(t *testing.T, database db.Querier) {
+	users := mustCreate(t, database,
+		withID(newUser(1, "John Doe"), 1),
+		withID(newUser(2, "José Müller"), 2),
+		withID(newUser(3, "Jane Roe"), 3),
+		withID(newUser(4, "Max Power"), 4),
+	)
+
+	sameName := newUser(100, "JOSE muller")
+	sameName.City = "springfield 2"
+
+	matches, err := database.MatchUsers(context.Background(), []db.User{
+		withID(newUser(101, "Someone Else"), 1), // Same ID
+		sameName,                                // Same name and city
+		newUser(3, "Someone Else"),              // Same phone number
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, users[:3], matches)
+}
+
+func testDuplicateUsers(t *testing.T, database db.Querier) {
+	samePhone := newUser(1, "Jonathan Doe")
+	sameCity := newUser(5, "John Do")
+	sameCity.City = "SPRINGFIELD 1"
+
+	// Two edits apart, but names are only compared if they start with the same letters
+	otherBlock := newUser(6, "Ron Doe")
+	otherBlock.City = "Springfield 1"
+
+	users := mustCreate(t, database, newUser(1, "John Doe"), newUser(2, "Jane Roe"), samePhone, sameCity, otherBlock)
+
+	clusters, err := database.DuplicateUsers(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, [][]db.User{{users[0], users[2], users[3]}}, clusters)
+}
+
+func testMergeUsers(t *testing.T, database db.Querier) {
+	ctx := context.Background()
+	users := mustCreate(t, database, newUser(1, "John Doe"), newUser(2, "Jon Doe"), newUser(3, "Jane Roe"))
+
+	survivor := users[0]
+	survivor.City = users[1].City
+
+	merge, err := database.MergeUsers(ctx, db.MergeSpec{
+		Survivor: users[0].ID,
+		Merged:   []int64{users[1].ID},
+		Fields:   map[string]int64{"city": users[1].ID},
+	})
+	assert.Nil(t, err)
+	assert.NotZero(t, merge.ID)
+	assert.WithinDuration(t, time.Now(), merge.MergedAt, time.Minute)
+	assert.Equal(t, survivor, merge.Survivor)
+	assert.Equal(t, users[1:2], merge.Merged)
+	assert.Equal(t, map[string]int64{
+		"name": users[0].ID, "phoneNumber": users[0].ID, "country": users[0].ID, "city": users[1].ID,
+	}, merge.Fields)
+	assert.Equal(t, []db.User{survivor, users[2]}, allUsers(t, database))
+
+	_, err = database.MergeUsers(ctx, db.MergeSpec{Survivor: users[2].ID, Merged: []int64{users[1].ID}, Fields: nil})
+	assert.True(t, errors.Is(err, db.ErrNotFound), "got %v", err)
+	assert.Equal(t, db.UserNotFoundError{ID: users[1].ID}, err)
+	assert.Equal(t, []db.User{survivor, users[2]}, allUsers(t, database), "a failed merge must not change anything")
+
+	merges, err := database.ListMerges(ctx)
+	assert.Nil(t, err)
+
+	if assert.Len(t, merges, 1) {
+		assert.Equal(t, merge.ID, merges[0].ID)
+		assert.Equal(t, survivor, merges[0].Survivor)
+		assert.Equal(t, users[1:2], merges[0].Merged)
+		assert.Equal(t, merge.Fields, merges[0].Fields)
+		assert.WithinDuration(t, merge.MergedAt, merges[0].MergedAt, time.Millisecond)
+	}
+}
+
+func testImportProfiles(t *testing.T, database db.Querier) {
+	ctx := context.Background()
+	acme := db.ImportProfile{
+		Name:      "acme",
+		Columns:   []string{"name", "", "city"},
+		Delimiter: ";",
+		Encoding:  "windows-1252",
+		Header:    true,
+		Defaults:  map[string]string{"country": "DE"},
+	}
+	beta := db.ImportProfile{
+		Name:      "beta",
+		Columns:   []string{"id", "name", "phoneNumber", "country", "city"},
+		Delimiter: ",",
+		Encoding:  "utf-8",
+		Header:    false,
+		Defaults:  map[string]string{},
+	}
+
+	assert.Nil(t, database.CreateImportProfile(ctx, beta))
+	assert.Nil(t, database.CreateImportProfile(ctx, acme))
+
+	err := database.CreateImportProfile(ctx, acme)
+	assert.True(t, errors.Is(err, db.ErrConflict), "got %v", err)
+
+	saved, err := database.GetImportProfile(ctx, "acme")
+	assert.Nil(t, err)
+	assert.Equal(t, acme, saved)
+
+	acme.Header = false
+	assert.Nil(t, database.UpdateImportProfile(ctx, acme))
+
+	profiles, err := database.ListImportProfiles(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, []db.ImportProfile{acme, beta}, profiles)
+
+	assert.Nil(t, database.DeleteImportProfile(ctx, "acme"))
+
+	_, err = database.GetImportProfile(ctx, "acme")
+	assert.True(t, errors.Is(err, db.ErrNotFound), "got %v", err)
+	assert.True(t, errors.Is(database.UpdateImportProfile(ctx, acme), db.ErrNotFound))
+	assert.True(t, errors.Is(database.DeleteImportProfile(ctx, "acme"), db.ErrNotFound))
+}
+
+func testCanceledContext(t *testing.T, database db.Querier) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	err := database.CreateUsers(ctx, []db.User{newUser(1, "John Doe")})
+	assert.True(t, errors.Is(err, context.Canceled), "got %v", err)
+	assert.Empty(t, allUsers(t, database), "a canceled write must not be saved")
+
+	_, err = database.SearchUsers(ctx, db.UserFilter{})
+	assert.True(t, errors.Is(err, context.Canceled), "got %v", err)
+
+	err = database.EachUser(ctx, db.UserFilter{}, func(db.User) error { return nil })
+	assert.True(t, errors.Is(err, context.Canceled), "got %v", err)
+}
+
+func testExpiredContext(t *testing.T, database db.Querier) {
+	ctx, cancel := context.WithDeadline(context.Background(), time.Now().Add(-time.Second))
+	defer cancel()
+
+	_, err := database.GetUserByID(ctx, 1)
+	assert.True(t, errors.Is(err, db.ErrTimeout), "got %v", err)
+
+	_, err = database.ImportUsers(ctx, []db.User{newUser(1, "John Doe")}, db.ConflictSkip, nil)
+	assert.True(t, errors.Is(err, db.ErrTimeout), "got %v", err)
+}
@@ -0,0 +1,165 @@
+package db
+
+import (
+	"sort"
+
+	"github.com/m-kuzmin/simple-rest-api/logging"
+)
+
+const (
+	// maxNameDistance is how many single letter edits two folded names may be apart to be considered similar.
+	maxNameDistance = 2
+	/*
+		nameBlockLength is how many leading runes of the folded name users of the same city must share to be compared by
+		name. Comparing every pair of users in a city grows with its square, so the price is that names with a typo in
+		their first letters are not found. The ListDuplicateCandidates queries use the same length.
+	*/
+	nameBlockLength = 2
+	// maxBlockSize is the most users of one block (see duplicateBlock) that are compared pair by pair.
+	maxBlockSize = 1000
+)
+
+// duplicateBlock is the folded city and the first nameBlockLength runes of the folded name of the user.
+type duplicateBlock struct {
+	City, NamePrefix string
+}
+
+func blockOf(user User) duplicateBlock {
+	name := []rune(FoldText(user.Name))
+	if len(name) > nameBlockLength {
+		name = name[:nameBlockLength]
+	}
+
+	return duplicateBlock{City: FoldText(user.City), NamePrefix: string(name)}
+}
+
+/*
+SimilarUsers reports whether a and b are likely the same person: they have the same phone number, or they live in the
+same city and their names are at most maxNameDistance edits apart. Names and cities are compared with FoldText. Unlike
+ProbableDuplicates this catches typos, so it is meant for finding users to review rather than for rejecting imports.
+*/
+func SimilarUsers(a, b User) bool {
+	return a.PhoneNumber == b.PhoneNumber ||
+		FoldText(a.City) == FoldText(b.City) && editDistance(FoldText(a.Name), FoldText(b.Name)) <= maxNameDistance
+}
+
+/*
+ClusterDuplicates groups users that are similar (see SimilarUsers) to another user of the group. A user can be in a
+cluster because of a chain of similar users even if it is not similar to all of them. Users that are not similar to
+anyone are left out. Users in a cluster are ordered by ID, clusters by the ID of their first user.
+
+Names are only compared within a duplicateBlock, and blocks of more than maxBlockSize users are only clustered by phone
+number, so that the work is bounded however many users live in one city.
+*/
+func ClusterDuplicates(users []User) [][]User {
+	users = append([]User{}, users...)
+	sort.SliceStable(users, func(i, j int) bool { return users[i].ID < users[j].ID })
+
+	parent := make([]int, len(users))
+	for i := range parent {
+		parent[i] = i
+	}
+
+	var root func(int) int
+	root = func(i int) int {
+		if parent[i] != i {
+			parent[i] = root(parent[i])
+		}
+
+		return parent[i]
+	}
+
+	byPhone := map[string][]int{}
+	byBlock := map[duplicateBlock][]int{}
+
+	for i, user := range users {
+		byPhone[user.PhoneNumber] = append(byPhone[user.PhoneNumber], i)
+		byBlock[blockOf(user)] = append(byBlock[blockOf(user)], i)
+	}
+
+	for _, group := range byPhone {
+		for _, i := range group[1:] {
+			parent[root(i)] = root(group[0])
+		}
+	}
+
+	for block, group := range byBlock {
+		if len(group) > maxBlockSize {
+			logging.Warnf("Not comparing the names of %d users in %q starting with %q, there are too many", len(group),
+				block.City, block.NamePrefix)
+
+			continue
+		}
+
+		for n, i := range group {
+			for _, j := range group[n+1:] {
+				if root(i) != root(j) && SimilarUsers(users[i], users[j]) {
+					parent[root(j)] = root(i)
+				}
+			}
+		}
+	}
+
+	clusterOf := map[int]int{} // Root to index in clusters
+	clusters := [][]User{}
+
+	for i, user := range users {
+		index, found := clusterOf[root(i)]
+		if !found {
+			index = len(clusters)
+			clusterOf[root(i)] = index
+			clusters = append(clusters, nil)
+		}
+
+		clusters[index] = append(clusters[index], user)
+	}
+
+	duplicates := [][]User{}
+
+	for _, cluster := range clusters {
+		if len(cluster) > 1 {
+			duplicates = append(duplicates, cluster)
+		}
+	}
+
+	return duplicates
+}
+
+// editDistance is the Levenshtein distance between a and b in runes.
+func editDistance(a, b string) int {
+	source, target := []rune(a), []rune(b)
+
+	previous := make([]int, len(target)+1)
+	current := make([]int, len(target)+1)
+
+	for j := range previous {
+		previous[j] = j
+	}
+
+	for i := range source {
+		current[0] = i + 1
+
+		for j := range target {
+			cost := 1
+			if source[i] == target[j] {
+				cost = 0
+			}
+
+			current[j+1] = minInt(previous[j+1]+1, current[j]+1, previous[j]+cost)
+		}
+
+		previous, current = current, previous
+	}
+
+	return previous[len(target)]
+}
+
+func minInt(first int, rest ...int) int {
+	for _, n := range rest {
+		if n < first {
+			first = n
+		}
+	}
+
+	return first
+}
@@ -0,0 +1,29 @@
+package db_test
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/m-kuzmin/simple-rest-api/db"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestShouldNotCompareNamesInOversizedBlocks(t *testing.T) {
+	t.Parallel()
+
+	small := []db.User{
+		{ID: 1, Name: "John Doe", PhoneNumber: "+18000000001", City: "Boston"},
+		{ID: 2, Name: "Jon Doe", PhoneNumber: "+18000000002", City: "Boston"},
+	}
+	assert.Len(t, db.ClusterDuplicates(small), 1)
+
+	// Every pair is similar, but there are too many users with the same city and first letters to compare them
+	large := []db.User{}
+	for i := 0; i < 1001; i++ {
+		large = append(large, db.User{
+			ID: int64(i + 1), Name: fmt.Sprintf("John Doe %d", i%10), PhoneNumber: fmt.Sprintf("+1800%07d", i), City: "Boston",
+		})
+	}
+
+	assert.Empty(t, db.ClusterDuplicates(large))
+}
@@ -0,0 +1,176 @@
+package db
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/lib/pq"
+	"modernc.org/sqlite"
+	sqlite3 "modernc.org/sqlite/lib"
+)
+
+// Errors returned by Querier implementations. Compare them with errors.Is, the returned error usually wraps the
+// original driver error as well.
+//
+//nolint:forbidigo // Sentinel errors
+var (
+	// ErrNotFound is returned when the requested record does not exist.
+	ErrNotFound = errors.New("not found")
+	// ErrConflict is returned when a record with the same unique key already exists.
+	ErrConflict = errors.New("conflicts with existing data")
+	// ErrConstraint is returned when a value is rejected by the schema: missing, too long or otherwise invalid.
+	ErrConstraint = errors.New("violates a constraint")
+	// ErrTimeout is returned when the query did not finish in time.
+	ErrTimeout = errors.New("query timed out")
+	// ErrUnavailable is returned when the database cannot be reached or refuses new work.
+	ErrUnavailable = errors.New("database unavailable")
+)
+
+/*
+Error is a database error classified as one of the Err* sentinels. errors.Is(err, ErrConflict) and similar are true when
+Kind is that sentinel.
+*/
+type Error struct {
+	Kind   error
+	Err    error  // The original driver error
+	Column string // The column that caused the error, if the database reported it
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s: %s", e.Kind, e.Err)
+}
+
+func (e *Error) Is(target error) bool {
+	return e.Kind == target //nolint:errorlint,goerr113 // Kind is always one of the sentinels
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// Postgres error codes, see https://www.postgresql.org/docs/current/errcodes-appendix.html
+const (
+	pqUniqueViolation      = "23505"
+	pqNotNullViolation     = "23502"
+	pqCheckViolation       = "23514"
+	pqForeignKeyViolation  = "23503"
+	pqStringTooLong        = "22001"
+	pqQueryCanceled        = "57014"
+	pqAdminShutdown        = "57P01"
+	pqCrashShutdown        = "57P02"
+	pqCannotConnectNow     = "57P03"
+	pqTooManyConnections   = "53300"
+	pqConnectionException  = "08"
+	pqInsufficientResource = "53"
+)
+
+/*
+postgresError classifies err into one of the Err* sentinels where possible. Errors that do not fit any of them are
+wrapped as they are, so the caller should treat them as internal errors. ctx is the context of the query, it tells a
+query stopped for running out of time from one stopped because the caller went away.
+*/
+func postgresError(ctx context.Context, err error) error {
+	if err == nil {
+		return nil
+	}
+
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		if pqErr.Code == pqQueryCanceled && errors.Is(ctx.Err(), context.Canceled) {
+			return fmt.Errorf("PostgreSQL error: %w: %w", ctx.Err(), err)
+		}
+
+		if kind := postgresErrorKind(pqErr); kind != nil {
+			return &Error{Kind: kind, Err: err, Column: pqErr.Column}
+		}
+	}
+
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		return &Error{Kind: ErrTimeout, Err: err}
+	case errors.Is(err, driver.ErrBadConn):
+		return &Error{Kind: ErrUnavailable, Err: err}
+	}
+
+	return fmt.Errorf("PostgreSQL error: %w", err)
+}
+
+func postgresErrorKind(err *pq.Error) error {
+	switch err.Code {
+	case pqUniqueViolation:
+		return ErrConflict
+	case pqNotNullViolation, pqCheckViolation, pqForeignKeyViolation, pqStringTooLong:
+		return ErrConstraint
+	case pqQueryCanceled: // Unless the context was canceled, see postgresError
+		return ErrTimeout
+	case pqAdminShutdown, pqCrashShutdown, pqCannotConnectNow, pqTooManyConnections:
+		return ErrUnavailable
+	}
+
+	switch err.Code.Class() {
+	case pqConnectionException, pqInsufficientResource:
+		return ErrUnavailable
+	}
+
+	return nil
+}
+
+/*
+sqliteError is postgresError for SQLite. SQLite does not report the column of a constraint error separately, so it is
+taken from the message, for example "UNIQUE constraint failed: users.id".
+*/
+func sqliteError(ctx context.Context, err error) error {
+	if err == nil {
+		return nil
+	}
+
+	var liteErr *sqlite.Error
+	if errors.As(err, &liteErr) {
+		if liteErr.Code() == sqlite3.SQLITE_INTERRUPT && errors.Is(ctx.Err(), context.Canceled) {
+			return fmt.Errorf("SQLite error: %w: %w", ctx.Err(), err)
+		}
+
+		if kind := sqliteErrorKind(liteErr.Code()); kind != nil {
+			const marker = "constraint failed: "
+
+			column := ""
+			if i := strings.LastIndex(liteErr.Error(), marker); i >= 0 {
+				failed, _, _ := strings.Cut(liteErr.Error()[i+len(marker):], " ")
+				_, column, _ = strings.Cut(failed, ".")
+			}
+
+			return &Error{Kind: kind, Err: err, Column: column}
+		}
+	}
+
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		return &Error{Kind: ErrTimeout, Err: err}
+	case errors.Is(err, driver.ErrBadConn):
+		return &Error{Kind: ErrUnavailable, Err: err}
+	}
+
+	return fmt.Errorf("SQLite error: %w", err)
+}
+
+// sqliteErrorKind classifies an extended result code, see https://www.sqlite.org/rescode.html
+func sqliteErrorKind(code int) error {
+	switch code {
+	case sqlite3.SQLITE_CONSTRAINT_PRIMARYKEY, sqlite3.SQLITE_CONSTRAINT_UNIQUE:
+		return ErrConflict
+	case sqlite3.SQLITE_INTERRUPT: // Unless the context was canceled, see sqliteError
+		return ErrTimeout
+	}
+
+	switch code & 0xff { //nolint:gomnd // The primary result code is the lowest byte
+	case sqlite3.SQLITE_CONSTRAINT:
+		return ErrConstraint
+	case sqlite3.SQLITE_BUSY, sqlite3.SQLITE_LOCKED, sqlite3.SQLITE_CANTOPEN, sqlite3.SQLITE_FULL:
+		return ErrUnavailable
+	}
+
+	return nil
+}
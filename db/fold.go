@@ -0,0 +1,40 @@
+package db
+
+import (
+	"strings"
+	"unicode"
+
+	"golang.org/x/text/runes"
+	"golang.org/x/text/transform"
+	"golang.org/x/text/unicode/norm"
+)
+
+/*
+foldReplacer handles letters that do not decompose into a base letter and a combining mark, so removing marks alone
+would leave them as is. The list follows what Postgres' unaccent.rules does for the same letters.
+*/
+var foldReplacer = strings.NewReplacer( //nolint:gochecknoglobals // Read-only lookup table
+	"ß", "ss", "ẞ", "SS",
+	"æ", "ae", "Æ", "AE",
+	"œ", "oe", "Œ", "OE",
+	"ø", "o", "Ø", "O",
+	"ł", "l", "Ł", "L",
+	"đ", "d", "Đ", "D",
+	"ħ", "h", "Ħ", "H",
+	"ı", "i",
+)
+
+/*
+FoldText removes accents and case from s so that "José Müller" and "jose muller" compare equal. It mirrors the
+fold_text() SQL function used by the Postgres migrations, so InMemoryDB searches behave the same way as Postgres ones.
+*/
+func FoldText(s string) string {
+	unaccent := transform.Chain(norm.NFD, runes.Remove(runes.In(unicode.Mn)), norm.NFC)
+
+	folded, _, err := transform.String(unaccent, foldReplacer.Replace(s))
+	if err != nil { // Only possible with invalid UTF-8, in which case we still want to compare case-insensitively.
+		folded = s
+	}
+
+	return strings.ToLower(folded)
+}
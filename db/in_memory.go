@@ -2,27 +2,665 @@ package db
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
 
 	"github.com/m-kuzmin/simple-rest-api/logging"
 )
 
-const preallocateUsers = 100
+var _ Querier = (*InMemoryDB)(nil)
 
 func NewInMemoryDB() *InMemoryDB {
 	return &InMemoryDB{
-		Users: make([]User, 0, preallocateUsers),
+		users:     map[int64]User{},
+		byCountry: index{},
+		byCity:    index{},
+		byPhone:   index{},
+		profiles:  map[string]ImportProfile{},
 	}
 }
 
+/*
+InMemoryDB is a Querier that keeps everything in memory. It is safe for concurrent use and behaves like Postgres, so it
+can be used for development and tests.
+
+Users are kept by ID. Secondary indexes by country, city (see FoldText) and phone number are used for filtering and for
+finding duplicates.
+
+Every modification is a list of changes that is committed at once. A database created with NewInMemoryDB forgets
+everything when the process exits, one opened with OpenInMemoryDB also writes the changes to a log on disk.
+*/
 type InMemoryDB struct {
-	Users []User
+	mu sync.RWMutex
+
+	users     map[int64]User
+	byCountry index
+	byCity    index
+	byPhone   index
+	lastID    int64 // The largest ID ever saved or generated
+
+	merges   []Merge
+	profiles map[string]ImportProfile
+
+	wal *writeAheadLog // nil if the database is not persisted
+}
+
+// changeOp is the kind of a change.
+type changeOp string
+
+const (
+	opPutUser       changeOp = "putUser"
+	opDeleteUser    changeOp = "deleteUser"
+	opPutMerge      changeOp = "putMerge"
+	opPutProfile    changeOp = "putProfile"
+	opDeleteProfile changeOp = "deleteProfile"
+)
+
+/*
+change is one modification of an InMemoryDB. Changes set the final state of a user, merge or profile, so applying one
+twice has the same effect as applying it once. Which fields are used depends on Op.
+*/
+type change struct {
+	Op      changeOp       `json:"op"`
+	User    *User          `json:"user,omitempty"`
+	ID      int64          `json:"id,omitempty"`
+	Merge   *Merge         `json:"merge,omitempty"`
+	Profile *ImportProfile `json:"profile,omitempty"`
+	Name    string         `json:"name,omitempty"`
+}
+
+/*
+contextError returns the error of a done context the way the SQL backends do: an expired deadline is ErrTimeout and a
+cancellation wraps context.Canceled. InMemoryDB never waits, so it only checks the context before doing any work.
+*/
+func contextError(ctx context.Context) error {
+	switch err := ctx.Err(); {
+	case err == nil:
+		return nil
+	case errors.Is(err, context.DeadlineExceeded):
+		return &Error{Kind: ErrTimeout, Err: err}
+	default:
+		return fmt.Errorf("InMemoryDB: %w", err)
+	}
+}
+
+func putUser(user User) change {
+	return change{Op: opPutUser, User: &user}
+}
+
+/*
+commit writes the changes to the log, if there is one, and then applies them. Nothing is applied if the log cannot be
+written. Callers must hold the write lock.
+*/
+func (db *InMemoryDB) commit(changes ...change) error {
+	if len(changes) == 0 {
+		return nil
+	}
+
+	if db.wal != nil {
+		if err := db.wal.append(changes); err != nil {
+			return err
+		}
+	}
+
+	for _, c := range changes {
+		db.apply(c)
+	}
+
+	if db.wal != nil && db.wal.needsCompaction() {
+		db.wal.requestCompaction()
+	}
+
+	return nil
+}
+
+// apply makes the change in memory. Callers must hold the write lock.
+func (db *InMemoryDB) apply(c change) {
+	switch c.Op {
+	case opPutUser:
+		db.put(*c.User)
+	case opDeleteUser:
+		db.remove(c.ID)
+	case opPutMerge:
+		if i := int(c.Merge.ID) - 1; i < len(db.merges) {
+			db.merges[i] = *c.Merge
+		} else {
+			db.merges = append(db.merges, *c.Merge)
+		}
+	case opPutProfile:
+		db.profiles[c.Profile.Name] = *c.Profile
+	case opDeleteProfile:
+		delete(db.profiles, c.Name)
+	}
+}
+
+// index maps a key to the IDs of the users with that key.
+type index map[string]map[int64]struct{}
+
+func (idx index) add(key string, id int64) {
+	if idx[key] == nil {
+		idx[key] = map[int64]struct{}{}
+	}
+
+	idx[key][id] = struct{}{}
+}
+
+func (idx index) remove(key string, id int64) {
+	delete(idx[key], id)
+
+	if len(idx[key]) == 0 {
+		delete(idx, key)
+	}
+}
+
+// put saves the user and updates the indexes. Callers must hold the write lock.
+func (db *InMemoryDB) put(user User) {
+	if old, found := db.users[user.ID]; found {
+		db.byCountry.remove(old.Country, old.ID)
+		db.byCity.remove(FoldText(old.City), old.ID)
+		db.byPhone.remove(old.PhoneNumber, old.ID)
+	}
+
+	db.users[user.ID] = user
+	db.byCountry.add(user.Country, user.ID)
+	db.byCity.add(FoldText(user.City), user.ID)
+	db.byPhone.add(user.PhoneNumber, user.ID)
+
+	if user.ID > db.lastID {
+		db.lastID = user.ID
+	}
+}
+
+// remove deletes the user and updates the indexes. Callers must hold the write lock.
+func (db *InMemoryDB) remove(id int64) {
+	user, found := db.users[id]
+	if !found {
+		return
+	}
+
+	delete(db.users, id)
+	db.byCountry.remove(user.Country, id)
+	db.byCity.remove(FoldText(user.City), id)
+	db.byPhone.remove(user.PhoneNumber, id)
+}
+
+// sortedUsers returns the users with these IDs ordered by ID. Callers must hold the lock.
+func (db *InMemoryDB) sortedUsers(ids map[int64]struct{}) []User {
+	users := make([]User, 0, len(ids))
+	for id := range ids {
+		users = append(users, db.users[id])
+	}
+
+	sort.Slice(users, func(i, j int) bool { return users[i].ID < users[j].ID })
+
+	return users
 }
 
 // CreateUsers implements UserQuerier.
-func (db *InMemoryDB) CreateUsers(_ context.Context, users []User) error {
-	db.Users = append(db.Users, users...)
+func (db *InMemoryDB) CreateUsers(ctx context.Context, users []User) error {
+	if err := contextError(ctx); err != nil {
+		return err
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if err := db.checkUniqueIDs(users); err != nil {
+		return err
+	}
+
+	withIDs := append([]User{}, users...)
+	db.generateIDs(withIDs)
+
+	changes := make([]change, len(withIDs))
+	for i, user := range withIDs {
+		changes[i] = putUser(user)
+	}
+
+	if err := db.commit(changes...); err != nil {
+		return err
+	}
+
+	copy(users, withIDs)
+	logging.Debugf("InMemoryDB: created %d users, %d in total", len(users), len(db.users))
+
+	return nil
+}
+
+// ImportUsers implements UserQuerier.
+func (db *InMemoryDB) ImportUsers(ctx context.Context, users []User, policy ConflictPolicy, overwrite []User,
+) (ImportCounts, error) {
+	if err := contextError(ctx); err != nil {
+		return ImportCounts{}, err
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if policy == ConflictFail {
+		if err := db.checkUniqueIDs(users); err != nil { // Then no user below is found
+			return ImportCounts{}, err
+		}
+	}
+
+	counts := ImportCounts{}
+	pending := map[int64]User{} // Users with an ID as they will be after the import
+	changes := []change{}
+
+	for _, user := range users {
+		if user.ID == 0 {
+			continue
+		}
+
+		saved, found := pending[user.ID]
+		if !found {
+			saved, found = db.users[user.ID]
+		}
+
+		switch resolved, changed := resolveConflict(saved, user, policy); {
+		case !found:
+			pending[user.ID] = user
+			counts.Created++
+		case changed:
+			pending[user.ID] = resolved
+			counts.Updated++
+		default:
+			counts.Skipped++
+
+			continue
+		}
+
+		changes = append(changes, putUser(pending[user.ID]))
+	}
+
+	for _, user := range overwrite {
+		if _, found := db.users[user.ID]; !found {
+			return ImportCounts{}, ErrNotFound
+		}
+
+		changes = append(changes, putUser(user))
+		counts.Updated++
+	}
+
+	withIDs := append([]User{}, users...)
+	db.generateIDs(withIDs)
+
+	for i, user := range users {
+		if user.ID == 0 {
+			changes = append(changes, putUser(withIDs[i]))
+			counts.Created++
+		}
+	}
+
+	if err := db.commit(changes...); err != nil {
+		return ImportCounts{}, err
+	}
+
+	copy(users, withIDs)
+
+	return counts, nil
+}
+
+/*
+generateIDs gives every user with ID 0 an ID larger than any saved or uploaded one, like the ID sequence in Postgres.
+Callers must hold the lock.
+*/
+func (db *InMemoryDB) generateIDs(users []User) {
+	next := db.lastID
+
+	for _, user := range users {
+		if user.ID > next {
+			next = user.ID
+		}
+	}
+
+	for i := range users {
+		if users[i].ID == 0 {
+			next++
+			users[i].ID = next
+		}
+	}
+}
+
+// checkUniqueIDs returns an ErrConflict error if two users would have the same ID, like the primary key in Postgres.
+func (db *InMemoryDB) checkUniqueIDs(users []User) error {
+	ids := make(map[int64]bool, len(users))
+
+	for _, user := range users {
+		if user.ID == 0 {
+			continue
+		}
+
+		if _, saved := db.users[user.ID]; saved || ids[user.ID] {
+			return &Error{Kind: ErrConflict, Err: duplicateIDError{ID: user.ID}, Column: "id"}
+		}
+
+		ids[user.ID] = true
+	}
+
+	return nil
+}
+
+type duplicateIDError struct {
+	ID int64
+}
+
+func (e duplicateIDError) Error() string {
+	return fmt.Sprintf("duplicate user ID %d", e.ID)
+}
+
+// GetUserByID implements UserQuerier.
+func (db *InMemoryDB) GetUserByID(ctx context.Context, id int64) (User, error) {
+	if err := contextError(ctx); err != nil {
+		return User{}, err
+	}
+
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	user, found := db.users[id]
+	if !found {
+		return User{}, ErrNotFound
+	}
 
-	logging.Debugf("InMemoryDB.Users: %v", db.Users)
+	return user, nil
+}
+
+// GetUsersByIDs implements UserQuerier.
+func (db *InMemoryDB) GetUsersByIDs(ctx context.Context, ids []int64) ([]User, error) {
+	if err := contextError(ctx); err != nil {
+		return nil, err
+	}
+
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	found := make(map[int64]struct{}, len(ids))
+
+	for _, id := range ids {
+		if _, saved := db.users[id]; saved {
+			found[id] = struct{}{}
+		}
+	}
+
+	return db.sortedUsers(found), nil
+}
+
+// UpdateUser implements UserQuerier.
+func (db *InMemoryDB) UpdateUser(ctx context.Context, user User) error {
+	if err := contextError(ctx); err != nil {
+		return err
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if _, found := db.users[user.ID]; !found {
+		return ErrNotFound
+	}
+
+	return db.commit(putUser(user))
+}
+
+// MatchUsers implements UserQuerier.
+func (db *InMemoryDB) MatchUsers(ctx context.Context, candidates []User) ([]User, error) {
+	if err := contextError(ctx); err != nil {
+		return nil, err
+	}
+
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	found := map[int64]struct{}{}
+
+	for _, candidate := range candidates {
+		if _, saved := db.users[candidate.ID]; saved && candidate.ID != 0 {
+			found[candidate.ID] = struct{}{}
+		}
+
+		for id := range db.byPhone[candidate.PhoneNumber] {
+			found[id] = struct{}{}
+		}
+
+		for id := range db.byCity[FoldText(candidate.City)] {
+			if ProbableDuplicates(candidate, db.users[id]) {
+				found[id] = struct{}{}
+			}
+		}
+	}
+
+	return db.sortedUsers(found), nil
+}
+
+/*
+DuplicateUsers implements UserQuerier. Only users that share a phone number or a duplicateBlock with another user are
+compared.
+*/
+func (db *InMemoryDB) DuplicateUsers(ctx context.Context) ([][]User, error) {
+	if err := contextError(ctx); err != nil {
+		return nil, err
+	}
+
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	candidates := map[int64]struct{}{}
+
+	for _, ids := range db.byPhone {
+		if len(ids) < 2 { //nolint:gomnd // A user cannot be a duplicate of itself
+			continue
+		}
+
+		for id := range ids {
+			candidates[id] = struct{}{}
+		}
+	}
+
+	for _, ids := range db.byCity {
+		blocks := map[duplicateBlock][]int64{}
+		for id := range ids {
+			blocks[blockOf(db.users[id])] = append(blocks[blockOf(db.users[id])], id)
+		}
+
+		for _, block := range blocks {
+			if len(block) < 2 { //nolint:gomnd // A user cannot be a duplicate of itself
+				continue
+			}
+
+			for _, id := range block {
+				candidates[id] = struct{}{}
+			}
+		}
+	}
+
+	return ClusterDuplicates(db.sortedUsers(candidates)), nil
+}
+
+// MergeUsers implements UserQuerier.
+func (db *InMemoryDB) MergeUsers(ctx context.Context, spec MergeSpec) (Merge, error) {
+	if err := contextError(ctx); err != nil {
+		return Merge{}, err
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	merge, err := buildMerge(spec, db.users)
+	if err != nil {
+		return Merge{}, err
+	}
+
+	merge.ID = int64(len(db.merges) + 1)
+	merge.MergedAt = time.Now().UTC()
+
+	changes := make([]change, 0, len(merge.Merged)+2) //nolint:gomnd // The survivor and the merge
+	for _, user := range merge.Merged {
+		changes = append(changes, change{Op: opDeleteUser, ID: user.ID})
+	}
+
+	changes = append(changes, putUser(merge.Survivor), change{Op: opPutMerge, Merge: &merge})
+
+	if err := db.commit(changes...); err != nil {
+		return Merge{}, err
+	}
+
+	return merge, nil
+}
+
+// ListMerges implements UserQuerier.
+func (db *InMemoryDB) ListMerges(ctx context.Context) ([]Merge, error) {
+	if err := contextError(ctx); err != nil {
+		return nil, err
+	}
+
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	return append([]Merge{}, db.merges...), nil
+}
+
+// SearchUsers implements UserQuerier. The country index is used if the filter has a country.
+func (db *InMemoryDB) SearchUsers(ctx context.Context, filter UserFilter) ([]User, error) {
+	if err := contextError(ctx); err != nil {
+		return nil, err
+	}
+
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	candidates := db.users
+	if filter.Country != "" {
+		candidates = make(map[int64]User, len(db.byCountry[filter.Country]))
+		for id := range db.byCountry[filter.Country] {
+			candidates[id] = db.users[id]
+		}
+	}
+
+	found := map[int64]struct{}{}
+
+	for id, user := range candidates {
+		if filter.Matches(user) {
+			found[id] = struct{}{}
+		}
+	}
+
+	return db.sortedUsers(found), nil
+}
+
+/*
+EachUser implements UserQuerier. The matching users are copied before fn is called, so fn may use the database and
+sees the users as they were when EachUser was called. The context is checked before every call to fn.
+*/
+func (db *InMemoryDB) EachUser(ctx context.Context, filter UserFilter, fn func(User) error) error {
+	users, err := db.SearchUsers(ctx, filter)
+	if err != nil {
+		return err
+	}
+
+	for _, user := range users {
+		if err = contextError(ctx); err != nil {
+			return err
+		}
+
+		if err = fn(user); err != nil {
+			return err
+		}
+	}
 
 	return nil
 }
+
+// CreateImportProfile implements ImportProfileQuerier.
+func (db *InMemoryDB) CreateImportProfile(ctx context.Context, profile ImportProfile) error {
+	if err := contextError(ctx); err != nil {
+		return err
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if _, found := db.profiles[profile.Name]; found {
+		return &Error{Kind: ErrConflict, Err: duplicateProfileError{Name: profile.Name}, Column: "name"}
+	}
+
+	return db.commit(change{Op: opPutProfile, Profile: &profile})
+}
+
+type duplicateProfileError struct {
+	Name string
+}
+
+func (e duplicateProfileError) Error() string {
+	return fmt.Sprintf("duplicate import profile %q", e.Name)
+}
+
+// GetImportProfile implements ImportProfileQuerier.
+func (db *InMemoryDB) GetImportProfile(ctx context.Context, name string) (ImportProfile, error) {
+	if err := contextError(ctx); err != nil {
+		return ImportProfile{}, err
+	}
+
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	profile, found := db.profiles[name]
+	if !found {
+		return ImportProfile{}, ErrNotFound
+	}
+
+	return profile, nil
+}
+
+// ListImportProfiles implements ImportProfileQuerier.
+func (db *InMemoryDB) ListImportProfiles(ctx context.Context) ([]ImportProfile, error) {
+	if err := contextError(ctx); err != nil {
+		return nil, err
+	}
+
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	profiles := make([]ImportProfile, 0, len(db.profiles))
+	for _, profile := range db.profiles {
+		profiles = append(profiles, profile)
+	}
+
+	sort.Slice(profiles, func(i, j int) bool { return profiles[i].Name < profiles[j].Name })
+
+	return profiles, nil
+}
+
+// UpdateImportProfile implements ImportProfileQuerier.
+func (db *InMemoryDB) UpdateImportProfile(ctx context.Context, profile ImportProfile) error {
+	if err := contextError(ctx); err != nil {
+		return err
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if _, found := db.profiles[profile.Name]; !found {
+		return ErrNotFound
+	}
+
+	return db.commit(change{Op: opPutProfile, Profile: &profile})
+}
+
+// DeleteImportProfile implements ImportProfileQuerier.
+func (db *InMemoryDB) DeleteImportProfile(ctx context.Context, name string) error {
+	if err := contextError(ctx); err != nil {
+		return err
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if _, found := db.profiles[name]; !found {
+		return ErrNotFound
+	}
+
+	return db.commit(change{Op: opDeleteProfile, Name: name})
+}
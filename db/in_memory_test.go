@@ -0,0 +1,97 @@
+package db_test
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/m-kuzmin/simple-rest-api/db"
+	"github.com/m-kuzmin/simple-rest-api/db/dbtest"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestInMemoryDBShouldCreateUsersConcurrently(t *testing.T) {
+	t.Parallel()
+
+	const writers, usersPerWriter = 8, 50
+
+	database := db.NewInMemoryDB()
+	ctx := context.Background()
+
+	var wg sync.WaitGroup
+
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+
+		go func(w int) {
+			defer wg.Done()
+
+			for i := 0; i < usersPerWriter; i++ {
+				user := db.User{
+					Name:        fmt.Sprintf("User %d-%d", w, i),
+					PhoneNumber: fmt.Sprintf("+1800%03d%04d", w, i),
+					Country:     "US",
+					City:        "Boston",
+				}
+				assert.Nil(t, database.CreateUsers(ctx, []db.User{user}))
+
+				_, err := database.SearchUsers(ctx, db.UserFilter{Country: "US"})
+				assert.Nil(t, err)
+			}
+		}(w)
+	}
+
+	wg.Wait()
+
+	users, err := database.SearchUsers(ctx, db.UserFilter{})
+	assert.Nil(t, err)
+	assert.Len(t, users, writers*usersPerWriter)
+
+	for i, user := range users {
+		assert.Equal(t, int64(i+1), user.ID, "generated IDs must be unique and consecutive")
+	}
+}
+
+func TestInMemoryDBShouldKeepIndexesUpToDate(t *testing.T) {
+	t.Parallel()
+
+	database := db.NewInMemoryDB()
+	ctx := context.Background()
+
+	err := database.CreateUsers(ctx, []db.User{
+		{ID: 1, Name: "John Doe", PhoneNumber: "+18001234567", Country: "US", City: "Boston"},
+		{ID: 2, Name: "Jane Roe", PhoneNumber: "+18002234567", Country: "US", City: "Chicago"},
+	})
+	assert.Nil(t, err)
+
+	// Moving user 2 to Boston and giving them the phone number of user 1 makes them duplicates
+	assert.Nil(t, database.UpdateUser(ctx, db.User{
+		ID: 2, Name: "Jane Roe", PhoneNumber: "+18001234567", Country: "GB", City: "Boston",
+	}))
+
+	clusters, err := database.DuplicateUsers(ctx)
+	assert.Nil(t, err)
+	assert.Len(t, clusters, 1)
+
+	users, err := database.SearchUsers(ctx, db.UserFilter{Country: "US"})
+	assert.Nil(t, err)
+
+	if assert.Len(t, users, 1) {
+		assert.Equal(t, int64(1), users[0].ID)
+	}
+
+	matches, err := database.MatchUsers(ctx, []db.User{{Name: "Jane Roe", PhoneNumber: "+18009999999", City: "Chicago"}})
+	assert.Nil(t, err)
+	assert.Empty(t, matches, "the old city of user 2 must not be indexed anymore")
+}
+
+func TestInMemoryDBConformance(t *testing.T) {
+	t.Parallel()
+
+	dbtest.RunQuerierSuite(t, func(t *testing.T) db.Querier {
+		t.Helper()
+
+		return db.NewInMemoryDB()
+	})
+}
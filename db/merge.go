@@ -0,0 +1,89 @@
+package db
+
+import (
+	"fmt"
+)
+
+// mergeFields copies each field that can be picked in a MergeSpec from src to dst, by JSON field name.
+var mergeFields = map[string]func(dst *User, src User){ //nolint:gochecknoglobals // Read-only lookup table
+	"name":        func(dst *User, src User) { dst.Name = src.Name },
+	"phoneNumber": func(dst *User, src User) { dst.PhoneNumber, dst.PhoneNumberRaw = src.PhoneNumber, src.PhoneNumberRaw },
+	"country":     func(dst *User, src User) { dst.Country = src.Country },
+	"city":        func(dst *User, src User) { dst.City = src.City },
+}
+
+// IsMergeField reports whether the field, by JSON name, can be picked in MergeSpec.Fields.
+func IsMergeField(field string) bool {
+	_, found := mergeFields[field]
+
+	return found
+}
+
+// MergeSpec says which users UserQuerier.MergeUsers merges and where the fields of the survivor come from.
+type MergeSpec struct {
+	Survivor int64   // The ID of the user that is kept
+	Merged   []int64 // The IDs of the users that are merged into Survivor and deleted
+	// Fields picks the user each field of Survivor is taken from, by JSON field name. Missing fields are not changed.
+	Fields map[string]int64
+}
+
+// IDs returns the survivor followed by the merged users.
+func (s MergeSpec) IDs() []int64 {
+	return append([]int64{s.Survivor}, s.Merged...)
+}
+
+// UserNotFoundError is returned by UserQuerier.MergeUsers for a user that does not exist. It is an ErrNotFound error.
+type UserNotFoundError struct {
+	ID int64
+}
+
+func (e UserNotFoundError) Error() string {
+	return fmt.Sprintf("user %d %s", e.ID, ErrNotFound)
+}
+
+func (e UserNotFoundError) Is(target error) bool {
+	return target == ErrNotFound //nolint:errorlint,goerr113 // Compared like Error.Is
+}
+
+/*
+buildMerge picks the fields of the survivor from the users, which the store has read and locked by ID. The survivor is
+checked with ValidateUser, because a field picked from another user can still be one that was saved before the
+validation rules were tightened.
+*/
+func buildMerge(spec MergeSpec, users map[int64]User) (Merge, error) {
+	for _, id := range spec.IDs() {
+		if _, found := users[id]; !found {
+			return Merge{}, UserNotFoundError{ID: id}
+		}
+	}
+
+	merge := Merge{
+		Survivor: users[spec.Survivor],
+		Merged:   make([]User, len(spec.Merged)),
+		Fields:   make(map[string]int64, len(mergeFields)),
+	}
+
+	for i, id := range spec.Merged {
+		merge.Merged[i] = users[id]
+	}
+
+	for field, copyField := range mergeFields {
+		from, picked := spec.Fields[field]
+		if !picked {
+			from = spec.Survivor
+		}
+
+		if _, found := users[from]; !found {
+			return Merge{}, UserNotFoundError{ID: from}
+		}
+
+		copyField(&merge.Survivor, users[from])
+		merge.Fields[field] = from
+	}
+
+	if err := ValidateUser(merge.Survivor); err != nil {
+		return Merge{}, err
+	}
+
+	return merge, nil
+}
@@ -0,0 +1,3 @@
+ALTER TABLE users DROP COLUMN IF EXISTS name_folded;
+DROP FUNCTION IF EXISTS fold_text(text);
+DROP EXTENSION IF EXISTS unaccent;
@@ -0,0 +1,9 @@
+CREATE EXTENSION IF NOT EXISTS unaccent WITH SCHEMA public;
+
+-- unaccent() is only STABLE because its dictionary can be swapped at runtime. Naming the dictionary explicitly makes
+-- the result depend on the input alone, which is what a generated column requires.
+CREATE OR REPLACE FUNCTION fold_text(input text) RETURNS text
+    LANGUAGE sql IMMUTABLE STRICT PARALLEL SAFE
+    AS $$ SELECT lower(public.unaccent('public.unaccent'::regdictionary, input)) $$;
+
+ALTER TABLE users ADD COLUMN name_folded text NOT NULL GENERATED ALWAYS AS (fold_text(name)) STORED;
@@ -0,0 +1,4 @@
+-- phone_number now holds the E.164 form, phone_number_raw keeps whatever the client sent.
+ALTER TABLE users ADD COLUMN phone_number_raw varchar(64);
+UPDATE users SET phone_number_raw = phone_number;
+ALTER TABLE users ALTER COLUMN phone_number_raw SET NOT NULL;
@@ -0,0 +1,3 @@
+-- Clients may leave the ID out, in which case it is taken from this sequence. Explicit IDs are still accepted.
+ALTER TABLE users ALTER COLUMN id ADD GENERATED BY DEFAULT AS IDENTITY;
+SELECT setval(pg_get_serial_sequence('users', 'id'), COALESCE(max(id), 0) + 1, false) FROM users;
@@ -0,0 +1,9 @@
+-- Audit trail of merged users. Users are stored as JSON so that the record outlives them.
+CREATE TABLE user_merges (
+  id bigint GENERATED ALWAYS AS IDENTITY PRIMARY KEY,
+  survivor_id bigint NOT NULL,
+  survivor jsonb NOT NULL,
+  merged jsonb NOT NULL,
+  fields jsonb NOT NULL,
+  merged_at timestamptz NOT NULL DEFAULT now()
+);
@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS users_city_folded;
+DROP INDEX IF EXISTS users_phone_number;
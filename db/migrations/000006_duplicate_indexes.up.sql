@@ -0,0 +1,3 @@
+-- Lets ListDuplicateCandidates find users that share a phone number or a city without comparing every pair of users.
+CREATE INDEX users_phone_number ON users (phone_number);
+CREATE INDEX users_city_folded ON users (fold_text(city));
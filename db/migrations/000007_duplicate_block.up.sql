@@ -0,0 +1,2 @@
+-- Lets ListDuplicateCandidates group users by city and the first letters of their name, see db.ClusterDuplicates.
+CREATE INDEX users_duplicate_block ON users (fold_text(city), left(name_folded, 2));
@@ -0,0 +1,8 @@
+CREATE TABLE import_profiles (
+  name varchar(64) PRIMARY KEY,
+  columns text[] NOT NULL,
+  delimiter varchar(4) NOT NULL DEFAULT ',',
+  encoding varchar(32) NOT NULL DEFAULT 'utf-8',
+  header boolean NOT NULL DEFAULT false,
+  defaults jsonb NOT NULL DEFAULT '{}'
+);
@@ -0,0 +1,667 @@
+package db
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/m-kuzmin/simple-rest-api/logging"
+)
+
+const (
+	walFileName      = "wal.log"
+	snapshotFileName = "snapshot.json"
+
+	defaultSyncInterval     = time.Second
+	defaultSnapshotInterval = 5 * time.Minute
+	defaultCompactionSize   = 64 << 20 // 64 MiB
+
+	dataDirPerm  = 0o700
+	dataFilePerm = 0o600
+)
+
+// SyncPolicy decides when the write-ahead log of a persisted InMemoryDB is flushed to disk with fsync.
+type SyncPolicy string
+
+const (
+	// SyncAlways flushes the log before every write returns. Nothing that was written is lost in a power failure.
+	SyncAlways SyncPolicy = "always"
+	// SyncInterval flushes the log in the background. Writes from the last interval can be lost in a power failure.
+	SyncInterval SyncPolicy = "interval"
+	// SyncNever leaves flushing to the OS. Writes survive a crash of the process, but not necessarily of the machine.
+	SyncNever SyncPolicy = "never"
+)
+
+// ParseSyncPolicy returns the policy with this name.
+func ParseSyncPolicy(name string) (SyncPolicy, error) {
+	switch policy := SyncPolicy(name); policy {
+	case SyncAlways, SyncInterval, SyncNever:
+		return policy, nil
+	default:
+		return "", unknownSyncPolicyError{Name: name}
+	}
+}
+
+type unknownSyncPolicyError struct {
+	Name string
+}
+
+func (e unknownSyncPolicyError) Error() string {
+	return fmt.Sprintf("unknown sync policy %q, expected %q, %q or %q", e.Name, SyncAlways, SyncInterval, SyncNever)
+}
+
+type persistConfig struct {
+	syncPolicy       SyncPolicy
+	syncInterval     time.Duration
+	snapshotInterval time.Duration
+	compactionSize   int64
+}
+
+// PersistOption changes the defaults of OpenInMemoryDB.
+type PersistOption func(*persistConfig)
+
+// WithSyncPolicy sets when the log is flushed to disk. Defaults to SyncAlways.
+func WithSyncPolicy(policy SyncPolicy) PersistOption {
+	return func(c *persistConfig) {
+		c.syncPolicy = policy
+	}
+}
+
+// WithSyncInterval sets how often the log is flushed with SyncInterval. Defaults to a second.
+func WithSyncInterval(interval time.Duration) PersistOption {
+	return func(c *persistConfig) {
+		c.syncInterval = interval
+	}
+}
+
+// WithSnapshotInterval sets how often a snapshot is taken in the background. 0 disables it. Defaults to 5 minutes.
+func WithSnapshotInterval(interval time.Duration) PersistOption {
+	return func(c *persistConfig) {
+		c.snapshotInterval = interval
+	}
+}
+
+// WithCompactionSize takes a snapshot as soon as the log grows past size bytes. 0 disables it. Defaults to 64 MiB.
+func WithCompactionSize(size int64) PersistOption {
+	return func(c *persistConfig) {
+		c.compactionSize = size
+	}
+}
+
+// snapshot is the content of the snapshot file.
+type snapshot struct {
+	LastID   int64           `json:"lastId"`
+	Users    []User          `json:"users"`
+	Merges   []Merge         `json:"merges"`
+	Profiles []ImportProfile `json:"profiles"`
+}
+
+/*
+writeAheadLog is the log file of a persisted InMemoryDB. Every commit is one line: the CRC-32 of the changes in hex, a
+space and the changes as a JSON array. A line that is cut short or does not match its checksum ends the log.
+
+Fields are protected by the lock of the InMemoryDB, except for the channels and snapshotting.
+*/
+type writeAheadLog struct {
+	dir    string
+	file   *os.File
+	size   int64
+	dirty  bool  // Written since the last fsync
+	failed error // Set when the log cannot be trusted anymore, see fail
+	closed bool
+	config persistConfig
+
+	snapshotting sync.Mutex // Held while a snapshot is taken, so that only one is taken at a time
+	compact      chan struct{}
+	stop         chan struct{}
+	stopOnce     sync.Once
+	done         sync.WaitGroup
+}
+
+/*
+append writes one record. If it cannot be written completely, the log is cut back to where the record started, so that
+a later record does not end up after a partial one.
+*/
+func (w *writeAheadLog) append(changes []change) error {
+	if w.failed != nil {
+		return &Error{Kind: ErrUnavailable, Err: w.failed}
+	}
+
+	data, err := json.Marshal(changes)
+	if err != nil {
+		return fmt.Errorf("error encoding log record: %w", err)
+	}
+
+	line := fmt.Sprintf("%08x %s\n", crc32.ChecksumIEEE(data), data)
+	start := w.size
+
+	if _, err = w.file.WriteString(line); err != nil {
+		return w.truncate(start, fmt.Errorf("error writing log record: %w", err))
+	}
+
+	w.size += int64(len(line))
+
+	if w.config.syncPolicy != SyncAlways {
+		w.dirty = true
+
+		return nil
+	}
+
+	if err = w.sync(); err != nil {
+		return w.truncate(start, err)
+	}
+
+	return nil
+}
+
+// truncate cuts the log back to size after a failed append and returns the error of the append.
+func (w *writeAheadLog) truncate(size int64, err error) error {
+	if truncErr := w.file.Truncate(size); truncErr != nil {
+		w.fail(fmt.Errorf("error truncating log after %s: %w", err, truncErr))
+	} else if _, seekErr := w.file.Seek(size, io.SeekStart); seekErr != nil {
+		w.fail(fmt.Errorf("error seeking log after %s: %w", err, seekErr))
+	}
+
+	w.size = size
+
+	if w.failed != nil {
+		return &Error{Kind: ErrUnavailable, Err: w.failed}
+	}
+
+	return err
+}
+
+/*
+sync flushes the log. A failed fsync poisons the log: the kernel may have dropped the unwritten pages and cleared the
+error, so a later fsync could succeed without the data being on disk.
+*/
+func (w *writeAheadLog) sync() error {
+	if err := w.file.Sync(); err != nil {
+		w.fail(fmt.Errorf("error syncing log: %w", err))
+
+		return &Error{Kind: ErrUnavailable, Err: w.failed}
+	}
+
+	w.dirty = false
+
+	return nil
+}
+
+/*
+fail makes every following write fail with ErrUnavailable. It is called when the log file may not match what was
+written to it. Reopening the database recovers whatever is on disk.
+*/
+func (w *writeAheadLog) fail(err error) {
+	if w.failed == nil {
+		w.failed = err
+		logging.Errorf("InMemoryDB: refusing all writes until the database is reopened: %s", err)
+	}
+}
+
+func (w *writeAheadLog) needsCompaction() bool {
+	return w.config.compactionSize > 0 && w.size > w.config.compactionSize
+}
+
+/*
+OpenInMemoryDB opens an InMemoryDB that is persisted in dir, which is created if needed. The last snapshot is loaded
+and the log written since then is replayed. If the process crashed in the middle of a write, the unfinished record is
+dropped, as if the write never happened.
+
+Call Close to flush the log and stop background work.
+*/
+func OpenInMemoryDB(dir string, options ...PersistOption) (*InMemoryDB, error) {
+	config := persistConfig{
+		syncPolicy:       SyncAlways,
+		syncInterval:     defaultSyncInterval,
+		snapshotInterval: defaultSnapshotInterval,
+		compactionSize:   defaultCompactionSize,
+	}
+
+	for _, option := range options {
+		option(&config)
+	}
+
+	if err := os.MkdirAll(dir, dataDirPerm); err != nil {
+		return nil, fmt.Errorf("error creating data directory: %w", err)
+	}
+
+	db := NewInMemoryDB()
+
+	if err := db.loadSnapshot(filepath.Join(dir, snapshotFileName)); err != nil {
+		return nil, err
+	}
+
+	file, err := os.OpenFile(filepath.Join(dir, walFileName), os.O_RDWR|os.O_CREATE, dataFilePerm)
+	if err != nil {
+		return nil, fmt.Errorf("error opening log: %w", err)
+	}
+
+	size, err := db.replay(file)
+	if err != nil {
+		file.Close() //nolint:errcheck,gosec // The replay error is more useful
+
+		return nil, err
+	}
+
+	db.wal = &writeAheadLog{
+		dir:     dir,
+		file:    file,
+		size:    size,
+		config:  config,
+		compact: make(chan struct{}, 1),
+		stop:    make(chan struct{}),
+	}
+
+	logging.Infof("InMemoryDB: loaded %d users from %s", len(db.users), dir)
+
+	db.wal.done.Add(1)
+
+	go db.background()
+
+	return db, nil
+}
+
+func (db *InMemoryDB) loadSnapshot(path string) error {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+
+	if err != nil {
+		return fmt.Errorf("error reading snapshot: %w", err)
+	}
+
+	var snap snapshot
+	if err = json.Unmarshal(data, &snap); err != nil {
+		return fmt.Errorf("error decoding snapshot %s: %w", path, err)
+	}
+
+	for _, user := range snap.Users {
+		db.put(user)
+	}
+
+	for i := range snap.Merges {
+		db.apply(change{Op: opPutMerge, Merge: &snap.Merges[i]})
+	}
+
+	for _, profile := range snap.Profiles {
+		db.profiles[profile.Name] = profile
+	}
+
+	if snap.LastID > db.lastID {
+		db.lastID = snap.LastID
+	}
+
+	return nil
+}
+
+/*
+replay applies every record in the log and returns the size of the valid part of it. Anything after the first bad
+record is cut off, so that new records are not appended after garbage.
+*/
+func (db *InMemoryDB) replay(file *os.File) (int64, error) {
+	reader := bufio.NewReader(file)
+	valid := int64(0)
+
+	for {
+		line, err := reader.ReadBytes('\n')
+		if errors.Is(err, io.EOF) && len(line) == 0 {
+			break
+		}
+
+		changes, ok := parseLogRecord(line)
+		if err != nil || !ok {
+			logging.Errorf("InMemoryDB: dropping the log after byte %d, it ends with an incomplete or corrupt record", valid)
+
+			break
+		}
+
+		for _, c := range changes {
+			db.apply(c)
+		}
+
+		valid += int64(len(line))
+	}
+
+	if err := file.Truncate(valid); err != nil {
+		return 0, fmt.Errorf("error truncating log: %w", err)
+	}
+
+	if _, err := file.Seek(valid, io.SeekStart); err != nil {
+		return 0, fmt.Errorf("error seeking log: %w", err)
+	}
+
+	return valid, nil
+}
+
+// parseLogRecord decodes one line of the log. Returns false if the line is incomplete or corrupt.
+func parseLogRecord(line []byte) ([]change, bool) {
+	checksum, data, found := bytes.Cut(bytes.TrimSuffix(line, []byte("\n")), []byte(" "))
+	if !found || string(checksum) != fmt.Sprintf("%08x", crc32.ChecksumIEEE(data)) {
+		return nil, false
+	}
+
+	var changes []change
+	if err := json.Unmarshal(data, &changes); err != nil {
+		return nil, false
+	}
+
+	return changes, true
+}
+
+/*
+Snapshot writes the whole database to the snapshot file and removes what it contains from the log. It is called in the
+background and when the log grows too large, but can also be called directly, for example before a backup. Does
+nothing if the database is not persisted.
+
+The database is copied under the read lock and written without any lock, so reads and writes go on meanwhile. The new
+snapshot replaces the old one atomically. If the process crashes before the log is shortened, the log is replayed over
+the new snapshot, which is harmless because changes can be applied twice.
+*/
+func (db *InMemoryDB) Snapshot() error {
+	if db.wal == nil {
+		return nil
+	}
+
+	db.wal.snapshotting.Lock()
+	defer db.wal.snapshotting.Unlock()
+
+	db.mu.RLock()
+	snap, logSize, err := db.copySnapshot()
+	db.mu.RUnlock()
+
+	if err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(snap)
+	if err != nil {
+		return fmt.Errorf("error encoding snapshot: %w", err)
+	}
+
+	path := filepath.Join(db.wal.dir, snapshotFileName)
+	if err = writeFileSync(path+".tmp", data); err != nil {
+		return err
+	}
+
+	if err = os.Rename(path+".tmp", path); err != nil {
+		return fmt.Errorf("error replacing snapshot: %w", err)
+	}
+
+	if err = syncDir(db.wal.dir); err != nil {
+		return err
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if err = db.wal.dropPrefix(logSize); err != nil {
+		return err
+	}
+
+	logging.Debugf("InMemoryDB: snapshot of %d users written to %s", len(snap.Users), path)
+
+	return nil
+}
+
+// copySnapshot copies the database and returns how much of the log the copy contains. Callers must hold the read lock.
+func (db *InMemoryDB) copySnapshot() (snapshot, int64, error) {
+	if db.wal.failed != nil {
+		return snapshot{}, 0, &Error{Kind: ErrUnavailable, Err: db.wal.failed}
+	}
+
+	ids := make(map[int64]struct{}, len(db.users))
+	for id := range db.users {
+		ids[id] = struct{}{}
+	}
+
+	snap := snapshot{
+		LastID:   db.lastID,
+		Users:    db.sortedUsers(ids),
+		Merges:   append([]Merge{}, db.merges...),
+		Profiles: make([]ImportProfile, 0, len(db.profiles)),
+	}
+
+	for _, profile := range db.profiles {
+		snap.Profiles = append(snap.Profiles, profile)
+	}
+
+	sort.Slice(snap.Profiles, func(i, j int) bool { return snap.Profiles[i].Name < snap.Profiles[j].Name })
+
+	return snap, db.wal.size, nil
+}
+
+/*
+dropPrefix removes the first size bytes from the log after a snapshot that contains them was written. Records that were
+appended while the snapshot was written are kept: they are copied to a new log that replaces the old one atomically.
+Callers must hold the write lock.
+*/
+func (w *writeAheadLog) dropPrefix(size int64) error {
+	if w.failed != nil {
+		return &Error{Kind: ErrUnavailable, Err: w.failed}
+	}
+
+	if size == w.size {
+		if err := w.file.Truncate(0); err != nil {
+			return fmt.Errorf("error emptying log: %w", err)
+		}
+
+		if _, err := w.file.Seek(0, io.SeekStart); err != nil {
+			w.fail(fmt.Errorf("error seeking log: %w", err))
+
+			return &Error{Kind: ErrUnavailable, Err: w.failed}
+		}
+
+		w.size = 0
+
+		return w.sync()
+	}
+
+	tail := make([]byte, w.size-size)
+	if _, err := w.file.ReadAt(tail, size); err != nil {
+		return fmt.Errorf("error reading log: %w", err)
+	}
+
+	path := filepath.Join(w.dir, walFileName)
+	if err := writeFileSync(path+".tmp", tail); err != nil {
+		return err
+	}
+
+	if err := os.Rename(path+".tmp", path); err != nil {
+		return fmt.Errorf("error replacing log: %w", err)
+	}
+
+	// From here on the open file is not the log anymore, so any error means that writes would be lost
+	if err := w.reopen(path); err != nil {
+		w.fail(err)
+
+		return &Error{Kind: ErrUnavailable, Err: w.failed}
+	}
+
+	w.size, w.dirty = int64(len(tail)), false
+
+	return nil
+}
+
+// reopen replaces the open log file with the one at path, positioned at its end.
+func (w *writeAheadLog) reopen(path string) error {
+	if err := syncDir(w.dir); err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(path, os.O_RDWR, dataFilePerm)
+	if err != nil {
+		return fmt.Errorf("error opening log: %w", err)
+	}
+
+	if _, err = file.Seek(0, io.SeekEnd); err != nil {
+		file.Close() //nolint:errcheck,gosec // The seek error is more useful
+
+		return fmt.Errorf("error seeking log: %w", err)
+	}
+
+	w.file.Close() //nolint:errcheck,gosec // Replaced, everything in it was flushed to the new log
+	w.file = file
+
+	return nil
+}
+
+// writeFileSync writes the file and flushes it to disk.
+func writeFileSync(path string, data []byte) error {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, dataFilePerm)
+	if err != nil {
+		return fmt.Errorf("error creating %s: %w", path, err)
+	}
+
+	if _, err = file.Write(data); err == nil {
+		err = file.Sync()
+	}
+
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err != nil {
+		return fmt.Errorf("error writing %s: %w", path, err)
+	}
+
+	return nil
+}
+
+// syncDir flushes a directory so that files renamed into it survive a power failure.
+func syncDir(path string) error {
+	dir, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("error opening data directory: %w", err)
+	}
+	defer dir.Close() //nolint:errcheck // Nothing was written to it
+
+	if err = dir.Sync(); err != nil {
+		return fmt.Errorf("error syncing data directory: %w", err)
+	}
+
+	return nil
+}
+
+// backgroundInterval is how often background runs on its own, or 0 if it only compacts the log when asked to.
+func (w *writeAheadLog) backgroundInterval() time.Duration {
+	interval := w.config.snapshotInterval
+
+	if w.config.syncPolicy == SyncInterval && (interval <= 0 || w.config.syncInterval < interval) {
+		interval = w.config.syncInterval
+	}
+
+	return interval
+}
+
+// requestCompaction asks background to take a snapshot. Callers must hold the write lock.
+func (w *writeAheadLog) requestCompaction() {
+	select {
+	case w.compact <- struct{}{}:
+	default: // Already requested
+	}
+}
+
+// background flushes the log and takes snapshots until Close is called.
+func (db *InMemoryDB) background() {
+	defer db.wal.done.Done()
+
+	var tick <-chan time.Time
+
+	if interval := db.wal.backgroundInterval(); interval > 0 {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		tick = ticker.C
+	}
+
+	lastSnapshot := time.Now()
+
+	for {
+		select {
+		case <-db.wal.stop:
+			return
+		case <-db.wal.compact:
+			if err := db.Snapshot(); err != nil {
+				logging.Errorf("InMemoryDB: log compaction failed: %s", err)
+			}
+		case now := <-tick:
+			if db.wal.config.snapshotInterval > 0 && now.Sub(lastSnapshot) >= db.wal.config.snapshotInterval {
+				lastSnapshot = now
+
+				if err := db.Snapshot(); err != nil {
+					logging.Errorf("InMemoryDB: background snapshot failed: %s", err)
+				}
+
+				continue
+			}
+
+			db.mu.Lock()
+
+			if db.wal.dirty && db.wal.failed == nil {
+				if err := db.wal.sync(); err != nil {
+					logging.Errorf("InMemoryDB: background sync failed: %s", err)
+				}
+			}
+
+			db.mu.Unlock()
+		}
+	}
+}
+
+/*
+Close stops background work, takes a final snapshot so that the next start does not have to replay the log, and closes
+the log. Writes after Close fail with ErrUnavailable. Does nothing if the database is not persisted or already closed.
+*/
+func (db *InMemoryDB) Close() error {
+	if db.wal == nil {
+		return nil
+	}
+
+	db.wal.stopOnce.Do(func() { close(db.wal.stop) })
+	db.wal.done.Wait()
+
+	db.mu.RLock()
+	closed := db.wal.closed
+	db.mu.RUnlock()
+
+	if closed {
+		return nil
+	}
+
+	err := db.Snapshot()
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if db.wal.closed { // Closed concurrently
+		return nil
+	}
+
+	if closeErr := db.wal.file.Close(); err == nil && closeErr != nil {
+		err = fmt.Errorf("error closing log: %w", closeErr)
+	}
+
+	db.wal.closed = true
+
+	if db.wal.failed == nil {
+		db.wal.failed = closedError{}
+	}
+
+	return err
+}
+
+type closedError struct{}
+
+func (closedError) Error() string {
+	return "database is closed"
+}
@@ -0,0 +1,231 @@
+package db_test
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/m-kuzmin/simple-rest-api/db"
+	"github.com/m-kuzmin/simple-rest-api/db/dbtest"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPersistedInMemoryDBShouldRecoverFromLog(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	ctx := context.Background()
+
+	database, err := db.OpenInMemoryDB(dir, db.WithSnapshotInterval(0))
+	assert.Nil(t, err)
+
+	users := []db.User{
+		{Name: "John Doe", PhoneNumber: "+18001234567", Country: "US", City: "Boston"},
+		{Name: "Jane Roe", PhoneNumber: "+18002234567", Country: "US", City: "Chicago"},
+	}
+	assert.Nil(t, database.CreateUsers(ctx, users))
+	assert.Nil(t, database.UpdateUser(ctx, db.User{
+		ID: 2, Name: "Jane Roe", PhoneNumber: "+18002234567", Country: "US", City: "Denver",
+	}))
+	assert.Nil(t, database.CreateImportProfile(ctx, db.ImportProfile{Name: "acme", Columns: []string{"name"}}))
+
+	// Simulate a crash: the log is not closed and no snapshot is taken
+	reopened, err := db.OpenInMemoryDB(dir, db.WithSnapshotInterval(0))
+	assert.Nil(t, err)
+
+	saved, err := reopened.SearchUsers(ctx, db.UserFilter{})
+	assert.Nil(t, err)
+
+	if assert.Len(t, saved, 2) {
+		assert.Equal(t, "Denver", saved[1].City)
+	}
+
+	_, err = reopened.GetImportProfile(ctx, "acme")
+	assert.Nil(t, err)
+
+	// Generated IDs continue after the recovered ones
+	more := []db.User{{Name: "Max Mustermann", PhoneNumber: "+49301234567", Country: "DE", City: "Berlin"}}
+	assert.Nil(t, reopened.CreateUsers(ctx, more))
+	assert.Equal(t, int64(3), more[0].ID)
+}
+
+func TestPersistedInMemoryDBShouldDropTornRecord(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	ctx := context.Background()
+
+	database, err := db.OpenInMemoryDB(dir, db.WithSnapshotInterval(0))
+	assert.Nil(t, err)
+	assert.Nil(t, database.CreateUsers(ctx, []db.User{
+		{ID: 1, Name: "John Doe", PhoneNumber: "+18001234567", Country: "US", City: "Boston"},
+	}))
+
+	// A write that was cut short by a crash
+	log, err := os.OpenFile(filepath.Join(dir, "wal.log"), os.O_WRONLY|os.O_APPEND, 0)
+	assert.Nil(t, err)
+	_, err = log.WriteString(`0badc0de [{"op":"putUser","user":{"id":2,"na`)
+	assert.Nil(t, err)
+	assert.Nil(t, log.Close())
+
+	reopened, err := db.OpenInMemoryDB(dir, db.WithSnapshotInterval(0))
+	assert.Nil(t, err)
+	assert.Nil(t, reopened.CreateUsers(ctx, []db.User{
+		{ID: 3, Name: "Jane Roe", PhoneNumber: "+18002234567", Country: "US", City: "Chicago"},
+	}))
+
+	// The torn record must be gone, otherwise the new record would be lost after it
+	reopened, err = db.OpenInMemoryDB(dir, db.WithSnapshotInterval(0))
+	assert.Nil(t, err)
+
+	saved, err := reopened.SearchUsers(ctx, db.UserFilter{})
+	assert.Nil(t, err)
+	assert.Len(t, saved, 2)
+}
+
+func TestPersistedInMemoryDBShouldCompactLog(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	ctx := context.Background()
+
+	database, err := db.OpenInMemoryDB(dir, db.WithSnapshotInterval(0), db.WithCompactionSize(1))
+	assert.Nil(t, err)
+	assert.Nil(t, database.CreateUsers(ctx, []db.User{
+		{ID: 1, Name: "John Doe", PhoneNumber: "+18001234567", Country: "US", City: "Boston"},
+	}))
+
+	assert.Eventually(t, func() bool {
+		info, err := os.Stat(filepath.Join(dir, "wal.log"))
+
+		return err == nil && info.Size() == 0
+	}, 5*time.Second, time.Millisecond, "the log must be emptied once it is larger than the compaction size")
+
+	assert.Nil(t, database.CreateUsers(ctx, []db.User{
+		{ID: 2, Name: "Jon Doe", PhoneNumber: "+18001234567", Country: "US", City: "Cambridge"},
+	}))
+
+	merge, err := database.MergeUsers(ctx, db.MergeSpec{Survivor: 1, Merged: []int64{2}, Fields: map[string]int64{
+		"city": 2,
+	}})
+	assert.Nil(t, err)
+	assert.Nil(t, database.Close())
+
+	reopened, err := db.OpenInMemoryDB(dir)
+	assert.Nil(t, err)
+
+	user, err := reopened.GetUserByID(ctx, 1)
+	assert.Nil(t, err)
+	assert.Equal(t, "Cambridge", user.City)
+
+	merges, err := reopened.ListMerges(ctx)
+	assert.Nil(t, err)
+
+	if assert.Len(t, merges, 1) {
+		assert.Equal(t, merge.ID, merges[0].ID)
+		assert.True(t, merge.MergedAt.Equal(merges[0].MergedAt))
+	}
+
+	assert.Nil(t, reopened.Close())
+}
+
+func TestPersistedInMemoryDBShouldKeepWritesMadeDuringSnapshot(t *testing.T) {
+	t.Parallel()
+
+	const writers, usersPerWriter = 4, 50
+
+	dir := t.TempDir()
+	ctx := context.Background()
+
+	database, err := db.OpenInMemoryDB(dir, db.WithSnapshotInterval(0), db.WithCompactionSize(0),
+		db.WithSyncPolicy(db.SyncNever))
+	assert.Nil(t, err)
+
+	var wg sync.WaitGroup
+
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+
+		go func(w int) {
+			defer wg.Done()
+
+			for i := 0; i < usersPerWriter; i++ {
+				assert.Nil(t, database.CreateUsers(ctx, []db.User{{
+					Name:        fmt.Sprintf("User %d-%d", w, i),
+					PhoneNumber: fmt.Sprintf("+1800%03d%04d", w, i),
+					Country:     "US",
+					City:        "Boston",
+				}}))
+			}
+		}(w)
+	}
+
+	wg.Add(1)
+
+	go func() { // Snapshots are written while the users are created
+		defer wg.Done()
+
+		for i := 0; i < usersPerWriter; i++ {
+			assert.Nil(t, database.Snapshot())
+		}
+	}()
+
+	wg.Wait()
+
+	// Simulate a crash: whatever the last snapshot missed must be in the log
+	reopened, err := db.OpenInMemoryDB(dir, db.WithSnapshotInterval(0))
+	assert.Nil(t, err)
+
+	users, err := reopened.SearchUsers(ctx, db.UserFilter{})
+	assert.Nil(t, err)
+	assert.Len(t, users, writers*usersPerWriter)
+
+	assert.Nil(t, database.Close())
+	assert.Nil(t, reopened.Close())
+}
+
+func TestPersistedInMemoryDBShouldRefuseWritesAfterClose(t *testing.T) {
+	t.Parallel()
+
+	database, err := db.OpenInMemoryDB(t.TempDir())
+	assert.Nil(t, err)
+	assert.Nil(t, database.Close())
+	assert.Nil(t, database.Close(), "a second Close does nothing")
+
+	err = database.CreateUsers(context.Background(), []db.User{
+		{Name: "John Doe", PhoneNumber: "+18001234567", Country: "US", City: "Boston"},
+	})
+	assert.ErrorIs(t, err, db.ErrUnavailable)
+}
+
+func TestShouldParseSyncPolicy(t *testing.T) {
+	t.Parallel()
+
+	policy, err := db.ParseSyncPolicy("interval")
+	assert.Nil(t, err)
+	assert.Equal(t, db.SyncInterval, policy)
+
+	_, err = db.ParseSyncPolicy("sometimes")
+	assert.NotNil(t, err)
+}
+
+func TestPersistedInMemoryDBConformance(t *testing.T) {
+	t.Parallel()
+
+	dbtest.RunQuerierSuite(t, func(t *testing.T) db.Querier {
+		t.Helper()
+
+		database, err := db.OpenInMemoryDB(t.TempDir(), db.WithSyncPolicy(db.SyncNever))
+		if err != nil {
+			t.Fatalf("Cannot open the database: %s", err)
+		}
+
+		t.Cleanup(func() { assert.Nil(t, database.Close()) })
+
+		return database
+	})
+}
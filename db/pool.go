@@ -0,0 +1,60 @@
+package db
+
+import (
+	"database/sql"
+	"time"
+)
+
+/*
+PoolConfig sizes the connection pool of a database/sql backend, see the Set* methods of sql.DB. Zero means no limit for
+every field except MaxIdleConns, where it means that idle connections are closed right away.
+*/
+type PoolConfig struct {
+	// MaxOpenConns limits the connections in use and idle. Requests wait for a free connection past it.
+	MaxOpenConns int
+	// MaxIdleConns is how many unused connections are kept open for the next requests.
+	MaxIdleConns int
+	// ConnMaxLifetime closes connections this old, so that the pool follows failovers and DNS changes.
+	ConnMaxLifetime time.Duration
+	// ConnMaxIdleTime closes connections that were not used for this long, so that the pool shrinks after a peak.
+	ConnMaxIdleTime time.Duration
+}
+
+// DefaultPoolConfig is the PoolConfig of OpenStore. It keeps well below the default max_connections of PostgreSQL.
+func DefaultPoolConfig() PoolConfig {
+	return PoolConfig{
+		MaxOpenConns:    20,               //nolint:gomnd // Documented default
+		MaxIdleConns:    10,               //nolint:gomnd // Documented default
+		ConnMaxLifetime: 30 * time.Minute, //nolint:gomnd // Documented default
+		ConnMaxIdleTime: 5 * time.Minute,  //nolint:gomnd // Documented default
+	}
+}
+
+// Apply configures the pool of conn.
+func (c PoolConfig) Apply(conn *sql.DB) {
+	conn.SetMaxOpenConns(c.MaxOpenConns)
+	conn.SetMaxIdleConns(c.MaxIdleConns)
+	conn.SetConnMaxLifetime(c.ConnMaxLifetime)
+	conn.SetConnMaxIdleTime(c.ConnMaxIdleTime)
+}
+
+// Pooled is a Querier that uses a database/sql connection pool.
+type Pooled interface {
+	// Stats returns the current state of the pool.
+	Stats() sql.DBStats
+}
+
+var (
+	_ Pooled = (*Postgres)(nil)
+	_ Pooled = (*SQLite)(nil)
+)
+
+// Stats implements Pooled.
+func (db *Postgres) Stats() sql.DBStats {
+	return db.sqlDB.Stats()
+}
+
+// Stats implements Pooled.
+func (db *SQLite) Stats() sql.DBStats {
+	return db.sqlDB.Stats()
+}
@@ -3,6 +3,7 @@ package db
 import (
 	"context"
 	"database/sql"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"time"
@@ -11,8 +12,14 @@ import (
 	"github.com/golang-migrate/migrate/database/postgres"
 	"github.com/m-kuzmin/simple-rest-api/db/sqlc"
 	"github.com/m-kuzmin/simple-rest-api/logging"
+	"github.com/m-kuzmin/simple-rest-api/retry"
 )
 
+// eachUserPageSize is how many rows Postgres.EachUser keeps in memory at once.
+const eachUserPageSize = 500
+
+var _ Querier = (*Postgres)(nil)
+
 type Postgres struct {
 	sqlDB *sql.DB
 	conn  *sqlc.Queries
@@ -25,25 +32,545 @@ func NewPostgres(conn *sql.DB) *Postgres {
 	}
 }
 
-// CreateUsers implements UserQuerier.
+// CreateUsers implements UserQuerier. Either all users are saved or none are.
 func (db *Postgres) CreateUsers(ctx context.Context, users []User) error {
+	_, err := db.ImportUsers(ctx, users, ConflictFail, nil)
+
+	return err
+}
+
+// ImportUsers implements UserQuerier. All users are saved in one transaction.
+func (db *Postgres) ImportUsers(ctx context.Context, users []User, policy ConflictPolicy, overwrite []User,
+) (ImportCounts, error) {
+	tx, err := db.sqlDB.BeginTx(ctx, nil)
+	if err != nil {
+		return ImportCounts{}, postgresError(ctx, err)
+	}
+
+	defer tx.Rollback() //nolint:errcheck // Does nothing after Commit, and the error that caused it is returned
+
+	conn := db.conn.WithTx(tx)
+
+	counts, err := importUsers(ctx, conn, users, policy)
+	if err != nil {
+		return ImportCounts{}, err
+	}
+
+	for _, user := range overwrite {
+		updated, err := conn.UpdateUser(ctx, sqlc.UpdateUserParams{
+			ID:             user.ID,
+			Name:           user.Name,
+			PhoneNumber:    user.PhoneNumber,
+			PhoneNumberRaw: user.PhoneNumberRaw,
+			Country:        user.Country,
+			City:           user.City,
+		})
+		if err != nil {
+			return ImportCounts{}, postgresError(ctx, err)
+		}
+
+		if updated == 0 {
+			return ImportCounts{}, ErrNotFound
+		}
+
+		counts.Updated++
+	}
+
+	if err = tx.Commit(); err != nil {
+		return ImportCounts{}, postgresError(ctx, err)
+	}
+
+	return counts, nil
+}
+
+/*
+importUsers inserts users with explicit IDs first and moves the ID sequence past them, so that the IDs generated for the
+rest of the users do not collide with them. Conflicts are resolved by the UpsertUser query, which mirrors
+resolveConflict, unless the policy is ConflictFail. It must run in a transaction: with explicit IDs the users table is
+locked against other inserts until the transaction ends.
+*/
+func importUsers(ctx context.Context, conn *sqlc.Queries, users []User, policy ConflictPolicy) (ImportCounts, error) {
+	counts := ImportCounts{}
+	explicitIDs := false
+
+	for _, user := range users {
+		if user.ID != 0 {
+			explicitIDs = true
+
+			break
+		}
+	}
+
+	// Locked before the first insert: upgrading the lock of an insert could deadlock with another import
+	if explicitIDs {
+		if err := conn.LockUsersForIDSync(ctx); err != nil {
+			return ImportCounts{}, postgresError(ctx, err)
+		}
+	}
+
 	for _, user := range users {
-		arg := sqlc.CreateUserParams{
-			ID:          user.ID,
-			Name:        user.Name,
-			PhoneNumber: user.PhoneNumber,
-			Country:     user.Country,
-			City:        user.City,
+		if user.ID == 0 {
+			continue
+		}
+
+		inserted, err := upsertUser(ctx, conn, user, policy)
+
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			counts.Skipped++
+		case err != nil:
+			return ImportCounts{}, postgresError(ctx, err)
+		case inserted:
+			counts.Created++
+		default:
+			counts.Updated++
+		}
+	}
+
+	if explicitIDs {
+		if err := conn.SyncUserIDSequence(ctx); err != nil {
+			return ImportCounts{}, postgresError(ctx, err)
+		}
+	}
+
+	for i := range users {
+		if users[i].ID != 0 {
+			continue
+		}
+
+		id, err := conn.CreateUserWithGeneratedID(ctx, sqlc.CreateUserWithGeneratedIDParams{
+			Name:           users[i].Name,
+			PhoneNumber:    users[i].PhoneNumber,
+			PhoneNumberRaw: users[i].PhoneNumberRaw,
+			Country:        users[i].Country,
+			City:           users[i].City,
+		})
+		if err != nil {
+			return ImportCounts{}, postgresError(ctx, err)
+		}
+
+		users[i].ID = id
+		counts.Created++
+	}
+
+	return counts, nil
+}
+
+// upsertUser saves a user with an explicit ID. Returns sql.ErrNoRows if the saved user with this ID was kept.
+func upsertUser(ctx context.Context, conn *sqlc.Queries, user User, policy ConflictPolicy) (bool, error) {
+	if policy == ConflictFail {
+		err := conn.CreateUser(ctx, sqlc.CreateUserParams{
+			ID:             user.ID,
+			Name:           user.Name,
+			PhoneNumber:    user.PhoneNumber,
+			PhoneNumberRaw: user.PhoneNumberRaw,
+			Country:        user.Country,
+			City:           user.City,
+		})
+
+		return err == nil, err //nolint:wrapcheck // Wrapped by the caller
+	}
+
+	return conn.UpsertUser(ctx, sqlc.UpsertUserParams{ //nolint:wrapcheck // Wrapped by the caller
+		ID:             user.ID,
+		Name:           user.Name,
+		PhoneNumber:    user.PhoneNumber,
+		PhoneNumberRaw: user.PhoneNumberRaw,
+		Country:        user.Country,
+		City:           user.City,
+		Policy:         string(policy),
+	})
+}
+
+// GetUserByID implements UserQuerier.
+func (db *Postgres) GetUserByID(ctx context.Context, id int64) (User, error) {
+	row, err := db.conn.GetUserByID(ctx, id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return User{}, ErrNotFound
+	}
+
+	if err != nil {
+		return User{}, postgresError(ctx, err)
+	}
+
+	return userFromRow(sqlc.SearchUsersRow(row)), nil
+}
+
+// GetUsersByIDs implements UserQuerier.
+func (db *Postgres) GetUsersByIDs(ctx context.Context, ids []int64) ([]User, error) {
+	rows, err := db.conn.GetUsersByIDs(ctx, ids)
+	if err != nil {
+		return nil, postgresError(ctx, err)
+	}
+
+	users := make([]User, len(rows))
+	for i, row := range rows {
+		users[i] = userFromRow(sqlc.SearchUsersRow(row))
+	}
+
+	return users, nil
+}
+
+// UpdateUser implements UserQuerier.
+func (db *Postgres) UpdateUser(ctx context.Context, user User) error {
+	updated, err := db.conn.UpdateUser(ctx, sqlc.UpdateUserParams{
+		ID:             user.ID,
+		Name:           user.Name,
+		PhoneNumber:    user.PhoneNumber,
+		PhoneNumberRaw: user.PhoneNumberRaw,
+		Country:        user.Country,
+		City:           user.City,
+	})
+	if err != nil {
+		return postgresError(ctx, err)
+	}
+
+	if updated == 0 {
+		return ErrNotFound
+	}
+
+	return nil
+}
+
+// MatchUsers implements UserQuerier.
+func (db *Postgres) MatchUsers(ctx context.Context, candidates []User) ([]User, error) {
+	arg := sqlc.MatchUsersParams{
+		Ids:          []int64{},
+		PhoneNumbers: make([]string, len(candidates)),
+		Names:        make([]string, len(candidates)),
+		Cities:       make([]string, len(candidates)),
+	}
+
+	for i, candidate := range candidates {
+		if candidate.ID != 0 {
+			arg.Ids = append(arg.Ids, candidate.ID)
+		}
+
+		arg.PhoneNumbers[i] = candidate.PhoneNumber
+		arg.Names[i] = candidate.Name
+		arg.Cities[i] = candidate.City
+	}
+
+	rows, err := db.conn.MatchUsers(ctx, arg)
+	if err != nil {
+		return nil, postgresError(ctx, err)
+	}
+
+	users := make([]User, len(rows))
+	for i, row := range rows {
+		users[i] = userFromRow(sqlc.SearchUsersRow(row))
+	}
+
+	return users, nil
+}
+
+// DuplicateUsers implements UserQuerier. Only users that share a phone number or city with another user are fetched.
+func (db *Postgres) DuplicateUsers(ctx context.Context) ([][]User, error) {
+	rows, err := db.conn.ListDuplicateCandidates(ctx)
+	if err != nil {
+		return nil, postgresError(ctx, err)
+	}
+
+	users := make([]User, len(rows))
+	for i, row := range rows {
+		users[i] = userFromRow(sqlc.SearchUsersRow(row))
+	}
+
+	return ClusterDuplicates(users), nil
+}
+
+// MergeUsers implements UserQuerier.
+func (db *Postgres) MergeUsers(ctx context.Context, spec MergeSpec) (Merge, error) {
+	tx, err := db.sqlDB.BeginTx(ctx, nil)
+	if err != nil {
+		return Merge{}, postgresError(ctx, err)
+	}
+
+	defer tx.Rollback() //nolint:errcheck // Does nothing after Commit, and the error that caused it is returned
+
+	conn := db.conn.WithTx(tx)
+
+	rows, err := conn.LockUsersByIDs(ctx, spec.IDs())
+	if err != nil {
+		return Merge{}, postgresError(ctx, err)
+	}
+
+	users := make(map[int64]User, len(rows))
+	for _, row := range rows {
+		users[row.ID] = userFromRow(sqlc.SearchUsersRow(row))
+	}
+
+	merge, err := buildMerge(spec, users)
+	if err != nil {
+		return Merge{}, err
+	}
+
+	arg, err := mergeParams(merge)
+	if err != nil {
+		return Merge{}, err
+	}
+
+	updated, err := conn.UpdateUser(ctx, sqlc.UpdateUserParams{
+		ID:             merge.Survivor.ID,
+		Name:           merge.Survivor.Name,
+		PhoneNumber:    merge.Survivor.PhoneNumber,
+		PhoneNumberRaw: merge.Survivor.PhoneNumberRaw,
+		Country:        merge.Survivor.Country,
+		City:           merge.Survivor.City,
+	})
+	if err != nil {
+		return Merge{}, postgresError(ctx, err)
+	}
+
+	ids := make([]int64, len(merge.Merged))
+	for i, user := range merge.Merged {
+		ids[i] = user.ID
+	}
+
+	deleted, err := conn.DeleteUsersByIDs(ctx, ids)
+	if err != nil {
+		return Merge{}, postgresError(ctx, err)
+	}
+
+	if updated == 0 || deleted != int64(len(ids)) {
+		return Merge{}, ErrNotFound
+	}
+
+	row, err := conn.CreateUserMerge(ctx, arg)
+	if err != nil {
+		return Merge{}, postgresError(ctx, err)
+	}
+
+	if err = tx.Commit(); err != nil {
+		return Merge{}, postgresError(ctx, err)
+	}
+
+	merge.ID, merge.MergedAt = row.ID, row.MergedAt
+
+	return merge, nil
+}
+
+func mergeParams(merge Merge) (sqlc.CreateUserMergeParams, error) {
+	arg := sqlc.CreateUserMergeParams{SurvivorID: merge.Survivor.ID}
+
+	for _, field := range []struct {
+		dst   *json.RawMessage
+		value any
+	}{
+		{&arg.Survivor, merge.Survivor},
+		{&arg.Merged, merge.Merged},
+		{&arg.Fields, merge.Fields},
+	} {
+		encoded, err := json.Marshal(field.value)
+		if err != nil {
+			return arg, fmt.Errorf("error encoding merge: %w", err)
+		}
+
+		*field.dst = encoded
+	}
+
+	return arg, nil
+}
+
+// ListMerges implements UserQuerier.
+func (db *Postgres) ListMerges(ctx context.Context) ([]Merge, error) {
+	rows, err := db.conn.ListUserMerges(ctx)
+	if err != nil {
+		return nil, postgresError(ctx, err)
+	}
+
+	merges := make([]Merge, len(rows))
+
+	for i, row := range rows {
+		merges[i] = Merge{ID: row.ID, MergedAt: row.MergedAt}
+
+		for _, field := range []struct {
+			src   json.RawMessage
+			value any
+		}{
+			{row.Survivor, &merges[i].Survivor},
+			{row.Merged, &merges[i].Merged},
+			{row.Fields, &merges[i].Fields},
+		} {
+			if err = json.Unmarshal(field.src, field.value); err != nil {
+				return nil, fmt.Errorf("error decoding merge %d: %w", row.ID, err)
+			}
 		}
+	}
+
+	return merges, nil
+}
+
+// SearchUsers implements UserQuerier.
+func (db *Postgres) SearchUsers(ctx context.Context, filter UserFilter) ([]User, error) {
+	rows, err := db.conn.SearchUsers(ctx, sqlc.SearchUsersParams{Name: filter.Name, Country: filter.Country})
+	if err != nil {
+		return nil, postgresError(ctx, err)
+	}
+
+	users := make([]User, len(rows))
+	for i, row := range rows {
+		users[i] = userFromRow(row)
+	}
 
-		if err := db.conn.CreateUser(ctx, arg); err != nil {
-			return fmt.Errorf("PostgreSQL error: %w", err)
+	return users, nil
+}
+
+// EachUser implements UserQuerier. Users are fetched in pages of eachUserPageSize rows using keyset pagination.
+func (db *Postgres) EachUser(ctx context.Context, filter UserFilter, fn func(User) error) error {
+	arg := sqlc.SearchUsersPageParams{
+		AfterID:  sql.NullInt64{},
+		Name:     filter.Name,
+		Country:  filter.Country,
+		PageSize: eachUserPageSize,
+	}
+
+	for {
+		rows, err := db.conn.SearchUsersPage(ctx, arg)
+		if err != nil {
+			return postgresError(ctx, err)
+		}
+
+		for _, row := range rows {
+			if err = fn(userFromRow(sqlc.SearchUsersRow(row))); err != nil {
+				return err
+			}
+		}
+
+		if len(rows) < eachUserPageSize {
+			return nil
 		}
+
+		arg.AfterID = sql.NullInt64{Int64: rows[len(rows)-1].ID, Valid: true}
+	}
+}
+
+// CreateImportProfile implements ImportProfileQuerier.
+func (db *Postgres) CreateImportProfile(ctx context.Context, profile ImportProfile) error {
+	defaults, err := json.Marshal(profile.Defaults)
+	if err != nil {
+		return fmt.Errorf("error encoding profile defaults: %w", err)
+	}
+
+	err = db.conn.CreateImportProfile(ctx, sqlc.CreateImportProfileParams{
+		Name:      profile.Name,
+		Columns:   profile.Columns,
+		Delimiter: profile.Delimiter,
+		Encoding:  profile.Encoding,
+		Header:    profile.Header,
+		Defaults:  defaults,
+	})
+	if err != nil {
+		return postgresError(ctx, err)
 	}
 
 	return nil
 }
 
+// GetImportProfile implements ImportProfileQuerier.
+func (db *Postgres) GetImportProfile(ctx context.Context, name string) (ImportProfile, error) {
+	row, err := db.conn.GetImportProfile(ctx, name)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ImportProfile{}, ErrNotFound
+	}
+
+	if err != nil {
+		return ImportProfile{}, postgresError(ctx, err)
+	}
+
+	return profileFromRow(row)
+}
+
+// ListImportProfiles implements ImportProfileQuerier.
+func (db *Postgres) ListImportProfiles(ctx context.Context) ([]ImportProfile, error) {
+	rows, err := db.conn.ListImportProfiles(ctx)
+	if err != nil {
+		return nil, postgresError(ctx, err)
+	}
+
+	profiles := make([]ImportProfile, len(rows))
+
+	for i, row := range rows {
+		if profiles[i], err = profileFromRow(row); err != nil {
+			return nil, err
+		}
+	}
+
+	return profiles, nil
+}
+
+// UpdateImportProfile implements ImportProfileQuerier.
+func (db *Postgres) UpdateImportProfile(ctx context.Context, profile ImportProfile) error {
+	defaults, err := json.Marshal(profile.Defaults)
+	if err != nil {
+		return fmt.Errorf("error encoding profile defaults: %w", err)
+	}
+
+	updated, err := db.conn.UpdateImportProfile(ctx, sqlc.UpdateImportProfileParams{
+		Name:      profile.Name,
+		Columns:   profile.Columns,
+		Delimiter: profile.Delimiter,
+		Encoding:  profile.Encoding,
+		Header:    profile.Header,
+		Defaults:  defaults,
+	})
+	if err != nil {
+		return postgresError(ctx, err)
+	}
+
+	if updated == 0 {
+		return ErrNotFound
+	}
+
+	return nil
+}
+
+// DeleteImportProfile implements ImportProfileQuerier.
+func (db *Postgres) DeleteImportProfile(ctx context.Context, name string) error {
+	deleted, err := db.conn.DeleteImportProfile(ctx, name)
+	if err != nil {
+		return postgresError(ctx, err)
+	}
+
+	if deleted == 0 {
+		return ErrNotFound
+	}
+
+	return nil
+}
+
+func profileFromRow(row sqlc.ImportProfile) (ImportProfile, error) {
+	profile := ImportProfile{
+		Name:      row.Name,
+		Columns:   row.Columns,
+		Delimiter: row.Delimiter,
+		Encoding:  row.Encoding,
+		Header:    row.Header,
+		Defaults:  map[string]string{},
+	}
+
+	if err := json.Unmarshal(row.Defaults, &profile.Defaults); err != nil {
+		return ImportProfile{}, fmt.Errorf("error decoding defaults of profile %q: %w", row.Name, err)
+	}
+
+	return profile, nil
+}
+
+/*
+userFromRow converts a row of any query that selects all user columns. sqlc generates a separate type for each such
+query, but they all have the same fields, so they can be converted to sqlc.SearchUsersRow.
+*/
+func userFromRow(row sqlc.SearchUsersRow) User {
+	return User{
+		Name:           row.Name,
+		PhoneNumber:    row.PhoneNumber,
+		PhoneNumberRaw: row.PhoneNumberRaw,
+		Country:        row.Country,
+		City:           row.City,
+		ID:             row.ID,
+	}
+}
+
 func (db *Postgres) Close() error {
 	if err := db.sqlDB.Close(); err != nil {
 		return fmt.Errorf("failed to close sql connection handle: %w", err)
@@ -73,7 +600,11 @@ func PostgresMigrateUp(db *sql.DB, migrationsSource, dbName string) error {
 	return nil
 }
 
-func ConnectToDBWithRetry(postgresDriver, postgresAddr string, retries uint, interval time.Duration,
+/*
+ConnectToDBWithRetry opens a connection pool and pings the database until it answers, retrying with the policy. Every
+ping error is retried unless the policy has a Retryable classifier, because the database may still be starting.
+*/
+func ConnectToDBWithRetry(ctx context.Context, postgresDriver, postgresAddr string, policy retry.Policy,
 ) (*sql.DB, error) {
 	conn, err := sql.Open(postgresDriver, postgresAddr)
 	if err != nil {
@@ -81,21 +612,18 @@ func ConnectToDBWithRetry(postgresDriver, postgresAddr string, retries uint, int
 			postgresDriver, err)
 	}
 
-	for i := uint(0); i < retries; i++ {
-		err = conn.Ping()
-		if err != nil {
-			if i > 0 {
-				logging.Warnf("Retry %d: Pinging PostgreSQL after %s because it has not started yet", i,
-					interval.String())
-			}
-
-			time.Sleep(interval)
-
-			continue
+	if policy.OnRetry == nil {
+		policy.OnRetry = func(attempt uint, err error, wait time.Duration) {
+			logging.Warnf("Ping %d failed, pinging PostgreSQL again in %s because it has not started yet: %s", attempt,
+				wait.Round(time.Millisecond), err)
 		}
+	}
+
+	if err = retry.Do(ctx, policy, conn.PingContext); err != nil {
+		conn.Close() //nolint:errcheck,gosec // The ping error is more useful
 
-		return conn, nil
+		return nil, fmt.Errorf("failed to ping database: %w", err)
 	}
 
-	return nil, fmt.Errorf("failed to ping database %q after %d attempts: %w", postgresAddr, retries, err)
+	return conn, nil
 }
@@ -1,10 +1,144 @@
 -- name: CreateUser :exec
 INSERT INTO users (
-    id, name, phone_number, country, city
+    id, name, phone_number, phone_number_raw, country, city
 ) VALUES (
-    $1, $2, $3, $4, $5
+    $1, $2, $3, $4, $5, $6
 );
 
+-- name: UpsertUser :one
+-- Follows ConflictPolicy for skip and overwrite. Returns no rows if the saved user is kept as is.
+INSERT INTO users (
+    id, name, phone_number, phone_number_raw, country, city
+) VALUES (
+    sqlc.arg(id), sqlc.arg(name), sqlc.arg(phone_number), sqlc.arg(phone_number_raw), sqlc.arg(country), sqlc.arg(city)
+)
+ON CONFLICT (id) DO UPDATE SET
+    name = EXCLUDED.name,
+    phone_number = EXCLUDED.phone_number,
+    phone_number_raw = EXCLUDED.phone_number_raw,
+    country = EXCLUDED.country,
+    city = EXCLUDED.city
+WHERE sqlc.arg(policy)::text = 'overwrite'
+RETURNING (xmax = 0) AS inserted;
+
+-- name: CreateUserWithGeneratedID :one
+INSERT INTO users (
+    name, phone_number, phone_number_raw, country, city
+) VALUES (
+    $1, $2, $3, $4, $5
+)
+RETURNING id;
+
+-- name: LockUsersForIDSync :exec
+-- Blocks other inserts until the transaction ends, so that no ID is generated while the sequence is being moved.
+LOCK TABLE users IN SHARE ROW EXCLUSIVE MODE;
+
+-- name: SyncUserIDSequence :exec
+-- Only moves the sequence forward: IDs of deleted and merged users are still referenced by user_merges. A sequence that
+-- has not generated an ID and has no users to move past stays uncalled, so that the first generated ID is still 1.
+SELECT setval(
+    seq.name,
+    GREATEST(max(users.id), pg_sequence_last_value(seq.name), 1),
+    max(users.id) IS NOT NULL OR pg_sequence_last_value(seq.name) IS NOT NULL
+) FROM (SELECT pg_get_serial_sequence('users', 'id')::regclass AS name) AS seq
+LEFT JOIN users ON true
+GROUP BY seq.name;
+
 -- name: DeleteUserByID :exec
 DELETE FROM users
 WHERE id = $1;
+
+-- name: SearchUsers :many
+SELECT id, name, phone_number, phone_number_raw, country, city FROM users
+WHERE (sqlc.arg(name)::text = '' OR strpos(name_folded, fold_text(sqlc.arg(name)::text)) > 0)
+  AND (sqlc.arg(country)::text = '' OR country = sqlc.arg(country)::text)
+ORDER BY id;
+
+-- name: SearchUsersPage :many
+SELECT id, name, phone_number, phone_number_raw, country, city FROM users
+WHERE (sqlc.narg(after_id)::bigint IS NULL OR id > sqlc.narg(after_id)::bigint)
+  AND (sqlc.arg(name)::text = '' OR strpos(name_folded, fold_text(sqlc.arg(name)::text)) > 0)
+  AND (sqlc.arg(country)::text = '' OR country = sqlc.arg(country)::text)
+ORDER BY id
+LIMIT sqlc.arg(page_size);
+
+-- name: MatchUsers :many
+SELECT id, name, phone_number, phone_number_raw, country, city FROM users
+WHERE id = ANY(sqlc.arg(ids)::bigint[])
+   OR phone_number = ANY(sqlc.arg(phone_numbers)::text[])
+   OR (name_folded, fold_text(city)) IN (
+       SELECT fold_text(n), fold_text(c) FROM unnest(sqlc.arg(names)::text[], sqlc.arg(cities)::text[]) AS t(n, c)
+   )
+ORDER BY id;
+
+-- name: GetUserByID :one
+SELECT id, name, phone_number, phone_number_raw, country, city FROM users
+WHERE id = $1;
+
+-- name: GetUsersByIDs :many
+SELECT id, name, phone_number, phone_number_raw, country, city FROM users
+WHERE id = ANY(sqlc.arg(ids)::bigint[])
+ORDER BY id;
+
+-- name: LockUsersByIDs :many
+-- Locked in ID order, so that concurrent merges of overlapping users do not deadlock.
+SELECT id, name, phone_number, phone_number_raw, country, city FROM users
+WHERE id = ANY(sqlc.arg(ids)::bigint[])
+ORDER BY id
+FOR UPDATE;
+
+-- name: UpdateUser :execrows
+UPDATE users SET
+    name = $2, phone_number = $3, phone_number_raw = $4, country = $5, city = $6
+WHERE id = $1;
+
+-- name: ListDuplicateCandidates :many
+-- Groups the users by phone number and by duplicate block (folded city and the first 2 letters of the folded name, see
+-- db.ClusterDuplicates) instead of comparing every pair, see the users_phone_number and users_duplicate_block indexes.
+SELECT id, name, phone_number, phone_number_raw, country, city FROM users
+WHERE phone_number IN (SELECT phone_number FROM users GROUP BY phone_number HAVING count(*) > 1)
+    OR (fold_text(city), left(name_folded, 2)) IN (
+        SELECT fold_text(city), left(name_folded, 2) FROM users
+        GROUP BY fold_text(city), left(name_folded, 2) HAVING count(*) > 1
+    )
+ORDER BY id;
+
+-- name: DeleteUsersByIDs :execrows
+DELETE FROM users
+WHERE id = ANY(sqlc.arg(ids)::bigint[]);
+
+-- name: CreateUserMerge :one
+INSERT INTO user_merges (
+    survivor_id, survivor, merged, fields
+) VALUES (
+    $1, $2, $3, $4
+)
+RETURNING id, merged_at;
+
+-- name: ListUserMerges :many
+SELECT id, survivor_id, survivor, merged, fields, merged_at FROM user_merges
+ORDER BY id;
+
+-- name: CreateImportProfile :exec
+INSERT INTO import_profiles (
+    name, columns, delimiter, encoding, header, defaults
+) VALUES (
+    $1, $2, $3, $4, $5, $6
+);
+
+-- name: GetImportProfile :one
+SELECT name, columns, delimiter, encoding, header, defaults FROM import_profiles
+WHERE name = $1;
+
+-- name: ListImportProfiles :many
+SELECT name, columns, delimiter, encoding, header, defaults FROM import_profiles
+ORDER BY name;
+
+-- name: UpdateImportProfile :execrows
+UPDATE import_profiles SET
+    columns = $2, delimiter = $3, encoding = $4, header = $5, defaults = $6
+WHERE name = $1;
+
+-- name: DeleteImportProfile :execrows
+DELETE FROM import_profiles
+WHERE name = $1;
@@ -0,0 +1,205 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/m-kuzmin/simple-rest-api/logging"
+	"github.com/m-kuzmin/simple-rest-api/retry"
+)
+
+// IsTransient is true for errors that may not happen again if the query is retried, such as a lost connection.
+func IsTransient(err error) bool {
+	return errors.Is(err, ErrUnavailable)
+}
+
+/*
+DefaultConnectRetry is the retry.Policy of OpenStore for the first connection to PostgreSQL. It waits up to a minute for
+the database to start, which is enough for the PostgreSQL container of docker-compose.yml.
+*/
+func DefaultConnectRetry() retry.Policy {
+	return retry.Policy{
+		InitialInterval: 500 * time.Millisecond, //nolint:gomnd // Documented default
+		MaxInterval:     10 * time.Second,       //nolint:gomnd // Documented default
+		Multiplier:      2,                      //nolint:gomnd // Documented default
+		Jitter:          0.2,                    //nolint:gomnd // Documented default
+		MaxElapsedTime:  time.Minute,
+		MaxAttempts:     0,
+		Retryable:       nil,
+		OnRetry:         nil,
+	}
+}
+
+/*
+DefaultQueryRetry is the retry.Policy of OpenStore for queries that fail with a transient error. Retries are quick and
+few, the request timeouts limit them further.
+*/
+func DefaultQueryRetry() retry.Policy {
+	return retry.Policy{
+		InitialInterval: 50 * time.Millisecond, //nolint:gomnd // Documented default
+		MaxInterval:     time.Second,
+		Multiplier:      2,   //nolint:gomnd // Documented default
+		Jitter:          0.5, //nolint:gomnd // Documented default
+		MaxElapsedTime:  0,
+		MaxAttempts:     3, //nolint:gomnd // Documented default
+		Retryable:       IsTransient,
+		OnRetry:         nil,
+	}
+}
+
+// PooledStore is a Store with a connection pool, the kind of Store whose queries can fail with transient errors.
+type PooledStore interface {
+	Store
+	Pooled
+}
+
+/*
+RetryingStore retries the queries of a PooledStore that fail with a transient error (see IsTransient). Only queries
+that are safe to repeat are retried: reads, and writes that set every field of a record. Creating, importing, merging
+and deleting may have succeeded even if the connection was lost before the reply, so they are run once.
+*/
+type RetryingStore struct {
+	PooledStore
+	policy retry.Policy
+}
+
+var _ PooledStore = (*RetryingStore)(nil)
+
+// NewRetryingStore retries the queries of store with the policy. Without a Retryable classifier IsTransient is used.
+func NewRetryingStore(store PooledStore, policy retry.Policy) *RetryingStore {
+	if policy.Retryable == nil {
+		policy.Retryable = IsTransient
+	}
+
+	if policy.OnRetry == nil {
+		policy.OnRetry = func(attempt uint, err error, wait time.Duration) {
+			logging.Warnf("Retrying query in %s after attempt %d failed: %s", wait, attempt, err)
+		}
+	}
+
+	return &RetryingStore{PooledStore: store, policy: policy}
+}
+
+func (s *RetryingStore) do(ctx context.Context, fn func(ctx context.Context) error) error {
+	return retry.Do(ctx, s.policy, fn) //nolint:wrapcheck // The error of the store, possibly wrapped by retry
+}
+
+// GetUserByID implements Querier.
+func (s *RetryingStore) GetUserByID(ctx context.Context, id int64) (user User, err error) {
+	err = s.do(ctx, func(ctx context.Context) error {
+		user, err = s.PooledStore.GetUserByID(ctx, id)
+
+		return err
+	})
+
+	return user, err
+}
+
+// GetUsersByIDs implements Querier.
+func (s *RetryingStore) GetUsersByIDs(ctx context.Context, ids []int64) (users []User, err error) {
+	err = s.do(ctx, func(ctx context.Context) error {
+		users, err = s.PooledStore.GetUsersByIDs(ctx, ids)
+
+		return err
+	})
+
+	return users, err
+}
+
+// UpdateUser implements Querier.
+func (s *RetryingStore) UpdateUser(ctx context.Context, user User) error {
+	return s.do(ctx, func(ctx context.Context) error {
+		return s.PooledStore.UpdateUser(ctx, user) //nolint:wrapcheck // Classified by the store
+	})
+}
+
+// MatchUsers implements Querier.
+func (s *RetryingStore) MatchUsers(ctx context.Context, candidates []User) (users []User, err error) {
+	err = s.do(ctx, func(ctx context.Context) error {
+		users, err = s.PooledStore.MatchUsers(ctx, candidates)
+
+		return err
+	})
+
+	return users, err
+}
+
+// DuplicateUsers implements Querier.
+func (s *RetryingStore) DuplicateUsers(ctx context.Context) (clusters [][]User, err error) {
+	err = s.do(ctx, func(ctx context.Context) error {
+		clusters, err = s.PooledStore.DuplicateUsers(ctx)
+
+		return err
+	})
+
+	return clusters, err
+}
+
+// ListMerges implements Querier.
+func (s *RetryingStore) ListMerges(ctx context.Context) (merges []Merge, err error) {
+	err = s.do(ctx, func(ctx context.Context) error {
+		merges, err = s.PooledStore.ListMerges(ctx)
+
+		return err
+	})
+
+	return merges, err
+}
+
+// SearchUsers implements Querier.
+func (s *RetryingStore) SearchUsers(ctx context.Context, filter UserFilter) (users []User, err error) {
+	err = s.do(ctx, func(ctx context.Context) error {
+		users, err = s.PooledStore.SearchUsers(ctx, filter)
+
+		return err
+	})
+
+	return users, err
+}
+
+// EachUser implements Querier. It is only retried until fn is called for the first user, to not repeat users.
+func (s *RetryingStore) EachUser(ctx context.Context, filter UserFilter, fn func(User) error) error {
+	started := false
+	policy := s.policy
+	policy.Retryable = func(err error) bool {
+		return !started && s.policy.Retryable(err)
+	}
+
+	return retry.Do(ctx, policy, func(ctx context.Context) error { //nolint:wrapcheck // Same as do
+		return s.PooledStore.EachUser(ctx, filter, func(user User) error { //nolint:wrapcheck // Same as do
+			started = true
+
+			return fn(user)
+		})
+	})
+}
+
+// GetImportProfile implements Querier.
+func (s *RetryingStore) GetImportProfile(ctx context.Context, name string) (profile ImportProfile, err error) {
+	err = s.do(ctx, func(ctx context.Context) error {
+		profile, err = s.PooledStore.GetImportProfile(ctx, name)
+
+		return err
+	})
+
+	return profile, err
+}
+
+// ListImportProfiles implements Querier.
+func (s *RetryingStore) ListImportProfiles(ctx context.Context) (profiles []ImportProfile, err error) {
+	err = s.do(ctx, func(ctx context.Context) error {
+		profiles, err = s.PooledStore.ListImportProfiles(ctx)
+
+		return err
+	})
+
+	return profiles, err
+}
+
+// UpdateImportProfile implements Querier.
+func (s *RetryingStore) UpdateImportProfile(ctx context.Context, profile ImportProfile) error {
+	return s.do(ctx, func(ctx context.Context) error {
+		return s.PooledStore.UpdateImportProfile(ctx, profile) //nolint:wrapcheck // Classified by the store
+	})
+}
@@ -16,11 +16,12 @@ func TestShouldCreateAccount(t *testing.T) {
 
 	ctx := context.Background()
 	arg := sqlc.CreateUserParams{
-		ID:          userID,
-		Name:        "John Doe",
-		PhoneNumber: "18001234567",
-		Country:     "US",
-		City:        "New York",
+		ID:             userID,
+		Name:           "John Doe",
+		PhoneNumber:    "+18001234567",
+		PhoneNumberRaw: "18001234567",
+		Country:        "US",
+		City:           "New York",
 	}
 
 	err := testQueries.CreateUser(ctx, arg)
@@ -35,3 +36,74 @@ func TestShouldCreateAccount(t *testing.T) {
 		t.Fail()
 	}
 }
+
+func TestShouldSearchUsersIgnoringAccentsAndCase(t *testing.T) {
+	t.Parallel()
+
+	userID := rand.Int63() //nolint:gosec // We only need this to prevent two tests from placing the same ID in the DB.
+	t.Log("user id:", userID)
+
+	ctx := context.Background()
+	arg := sqlc.CreateUserParams{
+		ID:             userID,
+		Name:           "José Müller",
+		PhoneNumber:    "+491701234567",
+		PhoneNumberRaw: "491701234567",
+		Country:        "DE",
+		City:           "München",
+	}
+
+	if err := testQueries.CreateUser(ctx, arg); err != nil {
+		t.Fatalf("While creating the user: %s", err)
+	}
+
+	defer func() {
+		if err := testQueries.DeleteUserByID(ctx, userID); err != nil {
+			t.Errorf("While deleting the user: %s", err)
+		}
+	}()
+
+	rows, err := testQueries.SearchUsers(ctx, sqlc.SearchUsersParams{Name: "jose MULLER"})
+	if err != nil {
+		t.Fatalf("While searching users: %s", err)
+	}
+
+	for _, row := range rows {
+		if row.ID == userID {
+			return
+		}
+	}
+
+	t.Errorf("User %d was not found by folded name", userID)
+}
+
+func TestShouldGenerateUserID(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	arg := sqlc.CreateUserWithGeneratedIDParams{
+		Name:           "Jane Doe",
+		PhoneNumber:    "+18002234567",
+		PhoneNumberRaw: "18002234567",
+		Country:        "US",
+		City:           "Boston",
+	}
+
+	userID, err := testQueries.CreateUserWithGeneratedID(ctx, arg)
+	if err != nil {
+		t.Fatalf("While creating the user: %s", err)
+	}
+
+	t.Log("user id:", userID)
+
+	row, err := testQueries.GetUserByID(ctx, userID)
+	if err != nil {
+		t.Errorf("While getting the user: %s", err)
+	} else if row.Name != arg.Name {
+		t.Errorf("Got user %q with the generated ID, expected %q", row.Name, arg.Name)
+	}
+
+	if err = testQueries.DeleteUserByID(ctx, userID); err != nil {
+		t.Errorf("While deleting the user: %s", err)
+	}
+}
@@ -0,0 +1,667 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/m-kuzmin/simple-rest-api/db/sqlitec"
+	_ "modernc.org/sqlite" // Registers the pure Go "sqlite" driver, so the server builds with CGO_ENABLED=0
+)
+
+const sqliteDriver = "sqlite"
+
+//go:embed sqlite/migrations/*.up.sql
+var sqliteMigrations embed.FS
+
+var _ Querier = (*SQLite)(nil)
+
+/*
+SQLite is a Querier for a single SQLite file, meant for local development and single-node installs. It behaves like
+Postgres. SQLite has no unaccent, so folded names and cities (see FoldText) are computed here and stored next to the
+original values.
+*/
+type SQLite struct {
+	sqlDB *sql.DB
+	conn  *sqlitec.Queries
+}
+
+func NewSQLite(conn *sql.DB) *SQLite {
+	return &SQLite{
+		conn:  sqlitec.New(conn),
+		sqlDB: conn,
+	}
+}
+
+/*
+OpenSQLite opens the database file at path, creating it if needed, and migrates it to the latest version. The
+connection waits for locks held by other connections instead of failing right away, and transactions take the write
+lock when they begin, so that concurrent imports are serialized instead of failing with "database is locked".
+*/
+func OpenSQLite(path string) (*SQLite, error) {
+	dsn := "file:" + path + "?" + url.Values{
+		"_pragma": {"busy_timeout(5000)", "journal_mode(WAL)", "foreign_keys(1)"},
+		"_txlock": {"immediate"},
+	}.Encode()
+
+	conn, err := sql.Open(sqliteDriver, dsn)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open SQLite database %q: %w", path, err)
+	}
+
+	if err = SQLiteMigrateUp(conn); err != nil {
+		conn.Close() //nolint:errcheck,gosec // The migration error is more useful
+
+		return nil, err
+	}
+
+	return NewSQLite(conn), nil
+}
+
+/*
+SQLiteMigrateUp applies the migrations in db/sqlite/migrations that are newer than the database. The version is kept in
+PRAGMA user_version, so no migrations table is needed.
+*/
+func SQLiteMigrateUp(conn *sql.DB) error {
+	var version int
+	if err := conn.QueryRow("PRAGMA user_version").Scan(&version); err != nil {
+		return fmt.Errorf("failed to read SQLite schema version: %w", err)
+	}
+
+	files, err := sqliteMigrations.ReadDir("sqlite/migrations")
+	if err != nil {
+		return fmt.Errorf("failed to list SQLite migrations: %w", err)
+	}
+
+	sort.Slice(files, func(i, j int) bool { return files[i].Name() < files[j].Name() })
+
+	for _, file := range files {
+		number, _, _ := strings.Cut(file.Name(), "_")
+
+		fileVersion, err := strconv.Atoi(number)
+		if err != nil {
+			return fmt.Errorf("bad SQLite migration name %q: %w", file.Name(), err)
+		}
+
+		if fileVersion <= version {
+			continue
+		}
+
+		script, err := sqliteMigrations.ReadFile("sqlite/migrations/" + file.Name())
+		if err != nil {
+			return fmt.Errorf("failed to read SQLite migration %q: %w", file.Name(), err)
+		}
+
+		if err = sqliteMigrate(conn, string(script), fileVersion); err != nil {
+			return fmt.Errorf("failed to apply SQLite migration %q: %w", file.Name(), err)
+		}
+	}
+
+	return nil
+}
+
+// sqliteMigrate runs the script and sets the schema version in one transaction.
+func sqliteMigrate(conn *sql.DB, script string, version int) error {
+	tx, err := conn.Begin()
+	if err != nil {
+		return err //nolint:wrapcheck // Wrapped by the caller
+	}
+
+	defer tx.Rollback() //nolint:errcheck // Does nothing after Commit, and the error that caused it is returned
+
+	if _, err = tx.Exec(script); err != nil {
+		return err //nolint:wrapcheck // Wrapped by the caller
+	}
+
+	// PRAGMA does not accept parameters, but version is a number
+	if _, err = tx.Exec(fmt.Sprintf("PRAGMA user_version = %d", version)); err != nil {
+		return err //nolint:wrapcheck // Wrapped by the caller
+	}
+
+	return tx.Commit() //nolint:wrapcheck // Wrapped by the caller
+}
+
+// CreateUsers implements UserQuerier. All users are saved in one transaction.
+func (db *SQLite) CreateUsers(ctx context.Context, users []User) error {
+	_, err := db.ImportUsers(ctx, users, ConflictFail, nil)
+
+	return err
+}
+
+/*
+ImportUsers implements UserQuerier. All users are saved in one transaction. Conflicts are resolved with resolveConflict
+because SQLite cannot tell an insert from an update in an upsert.
+*/
+func (db *SQLite) ImportUsers(ctx context.Context, users []User, policy ConflictPolicy, overwrite []User,
+) (ImportCounts, error) {
+	tx, err := db.sqlDB.BeginTx(ctx, nil)
+	if err != nil {
+		return ImportCounts{}, sqliteError(ctx, err)
+	}
+
+	defer tx.Rollback() //nolint:errcheck // Does nothing after Commit, and the error that caused it is returned
+
+	conn := db.conn.WithTx(tx)
+	counts := ImportCounts{}
+
+	// Explicit IDs go first so that AUTOINCREMENT moves past them before IDs are generated
+	for _, user := range users {
+		if user.ID == 0 {
+			continue
+		}
+
+		row, err := conn.GetUserByID(ctx, user.ID)
+
+		switch {
+		case err != nil && !errors.Is(err, sql.ErrNoRows):
+		case err == nil && policy != ConflictFail:
+			resolved, changed := resolveConflict(sqliteUserFromRow(sqlitec.SearchUsersRow(row)), user, policy)
+			if !changed {
+				counts.Skipped++
+
+				continue
+			}
+
+			_, err = conn.UpdateUser(ctx, updateUserParams(resolved))
+			counts.Updated++
+		default: // Fails with ErrConflict if the ID is taken and the policy is ConflictFail
+			err = conn.CreateUser(ctx, sqlitec.CreateUserParams{
+				ID:             user.ID,
+				Name:           user.Name,
+				PhoneNumber:    user.PhoneNumber,
+				PhoneNumberRaw: user.PhoneNumberRaw,
+				Country:        user.Country,
+				City:           user.City,
+				NameFolded:     FoldText(user.Name),
+				CityFolded:     FoldText(user.City),
+			})
+			counts.Created++
+		}
+
+		if err != nil {
+			return ImportCounts{}, sqliteError(ctx, err)
+		}
+	}
+
+	for _, user := range overwrite {
+		updated, err := conn.UpdateUser(ctx, updateUserParams(user))
+		if err != nil {
+			return ImportCounts{}, sqliteError(ctx, err)
+		}
+
+		if updated == 0 {
+			return ImportCounts{}, ErrNotFound
+		}
+
+		counts.Updated++
+	}
+
+	for i := range users {
+		if users[i].ID != 0 {
+			continue
+		}
+
+		id, err := conn.CreateUserWithGeneratedID(ctx, sqlitec.CreateUserWithGeneratedIDParams{
+			Name:           users[i].Name,
+			PhoneNumber:    users[i].PhoneNumber,
+			PhoneNumberRaw: users[i].PhoneNumberRaw,
+			Country:        users[i].Country,
+			City:           users[i].City,
+			NameFolded:     FoldText(users[i].Name),
+			CityFolded:     FoldText(users[i].City),
+		})
+		if err != nil {
+			return ImportCounts{}, sqliteError(ctx, err)
+		}
+
+		users[i].ID = id
+		counts.Created++
+	}
+
+	if err = tx.Commit(); err != nil {
+		return ImportCounts{}, sqliteError(ctx, err)
+	}
+
+	return counts, nil
+}
+
+// GetUserByID implements UserQuerier.
+func (db *SQLite) GetUserByID(ctx context.Context, id int64) (User, error) {
+	row, err := db.conn.GetUserByID(ctx, id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return User{}, ErrNotFound
+	}
+
+	if err != nil {
+		return User{}, sqliteError(ctx, err)
+	}
+
+	return sqliteUserFromRow(sqlitec.SearchUsersRow(row)), nil
+}
+
+// GetUsersByIDs implements UserQuerier.
+func (db *SQLite) GetUsersByIDs(ctx context.Context, ids []int64) ([]User, error) {
+	idsJSON, err := jsonParam(ids)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := db.conn.GetUsersByIDs(ctx, idsJSON)
+	if err != nil {
+		return nil, sqliteError(ctx, err)
+	}
+
+	users := make([]User, len(rows))
+	for i, row := range rows {
+		users[i] = sqliteUserFromRow(sqlitec.SearchUsersRow(row))
+	}
+
+	return users, nil
+}
+
+// UpdateUser implements UserQuerier.
+func (db *SQLite) UpdateUser(ctx context.Context, user User) error {
+	updated, err := db.conn.UpdateUser(ctx, updateUserParams(user))
+	if err != nil {
+		return sqliteError(ctx, err)
+	}
+
+	if updated == 0 {
+		return ErrNotFound
+	}
+
+	return nil
+}
+
+func updateUserParams(user User) sqlitec.UpdateUserParams {
+	return sqlitec.UpdateUserParams{
+		Name:           user.Name,
+		PhoneNumber:    user.PhoneNumber,
+		PhoneNumberRaw: user.PhoneNumberRaw,
+		Country:        user.Country,
+		City:           user.City,
+		NameFolded:     FoldText(user.Name),
+		CityFolded:     FoldText(user.City),
+		ID:             user.ID,
+	}
+}
+
+// MatchUsers implements UserQuerier.
+func (db *SQLite) MatchUsers(ctx context.Context, candidates []User) ([]User, error) {
+	ids := []int64{}
+	phoneNumbers := make([]string, len(candidates))
+	namesAndCities := make([][2]string, len(candidates))
+
+	for i, candidate := range candidates {
+		if candidate.ID != 0 {
+			ids = append(ids, candidate.ID)
+		}
+
+		phoneNumbers[i] = candidate.PhoneNumber
+		namesAndCities[i] = [2]string{FoldText(candidate.Name), FoldText(candidate.City)}
+	}
+
+	arg := sqlitec.MatchUsersParams{}
+
+	for _, param := range []struct {
+		dst   *interface{}
+		value any
+	}{
+		{&arg.Ids, ids},
+		{&arg.PhoneNumbers, phoneNumbers},
+		{&arg.NamesAndCities, namesAndCities},
+	} {
+		encoded, err := jsonParam(param.value)
+		if err != nil {
+			return nil, err
+		}
+
+		*param.dst = encoded
+	}
+
+	rows, err := db.conn.MatchUsers(ctx, arg)
+	if err != nil {
+		return nil, sqliteError(ctx, err)
+	}
+
+	users := make([]User, len(rows))
+	for i, row := range rows {
+		users[i] = sqliteUserFromRow(sqlitec.SearchUsersRow(row))
+	}
+
+	return users, nil
+}
+
+// DuplicateUsers implements UserQuerier. Only users that share a phone number or city with another user are fetched.
+func (db *SQLite) DuplicateUsers(ctx context.Context) ([][]User, error) {
+	rows, err := db.conn.ListDuplicateCandidates(ctx)
+	if err != nil {
+		return nil, sqliteError(ctx, err)
+	}
+
+	users := make([]User, len(rows))
+	for i, row := range rows {
+		users[i] = sqliteUserFromRow(sqlitec.SearchUsersRow(row))
+	}
+
+	return ClusterDuplicates(users), nil
+}
+
+// MergeUsers implements UserQuerier.
+// Transactions start with BEGIN IMMEDIATE (see _txlock), so the users cannot change between reading and writing them.
+func (db *SQLite) MergeUsers(ctx context.Context, spec MergeSpec) (Merge, error) {
+	idsJSON, err := jsonParam(spec.IDs())
+	if err != nil {
+		return Merge{}, err
+	}
+
+	tx, err := db.sqlDB.BeginTx(ctx, nil)
+	if err != nil {
+		return Merge{}, sqliteError(ctx, err)
+	}
+
+	defer tx.Rollback() //nolint:errcheck // Does nothing after Commit, and the error that caused it is returned
+
+	conn := db.conn.WithTx(tx)
+
+	rows, err := conn.GetUsersByIDs(ctx, idsJSON)
+	if err != nil {
+		return Merge{}, sqliteError(ctx, err)
+	}
+
+	users := make(map[int64]User, len(rows))
+	for _, row := range rows {
+		users[row.ID] = sqliteUserFromRow(sqlitec.SearchUsersRow(row))
+	}
+
+	merge, err := buildMerge(spec, users)
+	if err != nil {
+		return Merge{}, err
+	}
+
+	encoded, err := mergeParams(merge)
+	if err != nil {
+		return Merge{}, err
+	}
+
+	if idsJSON, err = jsonParam(spec.Merged); err != nil {
+		return Merge{}, err
+	}
+
+	updated, err := conn.UpdateUser(ctx, updateUserParams(merge.Survivor))
+	if err != nil {
+		return Merge{}, sqliteError(ctx, err)
+	}
+
+	deleted, err := conn.DeleteUsersByIDs(ctx, idsJSON)
+	if err != nil {
+		return Merge{}, sqliteError(ctx, err)
+	}
+
+	if updated == 0 || deleted != int64(len(spec.Merged)) {
+		return Merge{}, ErrNotFound
+	}
+
+	mergedAt := time.Now().UTC()
+
+	id, err := conn.CreateUserMerge(ctx, sqlitec.CreateUserMergeParams{
+		SurvivorID: encoded.SurvivorID,
+		Survivor:   string(encoded.Survivor),
+		Merged:     string(encoded.Merged),
+		Fields:     string(encoded.Fields),
+		MergedAt:   mergedAt,
+	})
+	if err != nil {
+		return Merge{}, sqliteError(ctx, err)
+	}
+
+	if err = tx.Commit(); err != nil {
+		return Merge{}, sqliteError(ctx, err)
+	}
+
+	merge.ID, merge.MergedAt = id, mergedAt
+
+	return merge, nil
+}
+
+// ListMerges implements UserQuerier.
+func (db *SQLite) ListMerges(ctx context.Context) ([]Merge, error) {
+	rows, err := db.conn.ListUserMerges(ctx)
+	if err != nil {
+		return nil, sqliteError(ctx, err)
+	}
+
+	merges := make([]Merge, len(rows))
+
+	for i, row := range rows {
+		merges[i] = Merge{ID: row.ID, MergedAt: row.MergedAt.UTC()}
+
+		for _, field := range []struct {
+			src   string
+			value any
+		}{
+			{row.Survivor, &merges[i].Survivor},
+			{row.Merged, &merges[i].Merged},
+			{row.Fields, &merges[i].Fields},
+		} {
+			if err = json.Unmarshal([]byte(field.src), field.value); err != nil {
+				return nil, fmt.Errorf("error decoding merge %d: %w", row.ID, err)
+			}
+		}
+	}
+
+	return merges, nil
+}
+
+// SearchUsers implements UserQuerier.
+func (db *SQLite) SearchUsers(ctx context.Context, filter UserFilter) ([]User, error) {
+	rows, err := db.conn.SearchUsers(ctx, sqlitec.SearchUsersParams{
+		NameFolded: FoldText(filter.Name),
+		Country:    filter.Country,
+	})
+	if err != nil {
+		return nil, sqliteError(ctx, err)
+	}
+
+	users := make([]User, len(rows))
+	for i, row := range rows {
+		users[i] = sqliteUserFromRow(row)
+	}
+
+	return users, nil
+}
+
+// EachUser implements UserQuerier. Users are fetched in pages of eachUserPageSize rows using keyset pagination.
+func (db *SQLite) EachUser(ctx context.Context, filter UserFilter, fn func(User) error) error {
+	arg := sqlitec.SearchUsersPageParams{
+		AfterID:    nil,
+		NameFolded: FoldText(filter.Name),
+		Country:    filter.Country,
+		PageSize:   eachUserPageSize,
+	}
+
+	for {
+		rows, err := db.conn.SearchUsersPage(ctx, arg)
+		if err != nil {
+			return sqliteError(ctx, err)
+		}
+
+		for _, row := range rows {
+			if err = fn(sqliteUserFromRow(sqlitec.SearchUsersRow(row))); err != nil {
+				return err
+			}
+		}
+
+		if len(rows) < eachUserPageSize {
+			return nil
+		}
+
+		arg.AfterID = rows[len(rows)-1].ID
+	}
+}
+
+// CreateImportProfile implements ImportProfileQuerier.
+func (db *SQLite) CreateImportProfile(ctx context.Context, profile ImportProfile) error {
+	columns, defaults, err := profileJSON(profile)
+	if err != nil {
+		return err
+	}
+
+	err = db.conn.CreateImportProfile(ctx, sqlitec.CreateImportProfileParams{
+		Name:      profile.Name,
+		Columns:   columns,
+		Delimiter: profile.Delimiter,
+		Encoding:  profile.Encoding,
+		Header:    profile.Header,
+		Defaults:  defaults,
+	})
+	if err != nil {
+		return sqliteError(ctx, err)
+	}
+
+	return nil
+}
+
+// GetImportProfile implements ImportProfileQuerier.
+func (db *SQLite) GetImportProfile(ctx context.Context, name string) (ImportProfile, error) {
+	row, err := db.conn.GetImportProfile(ctx, name)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ImportProfile{}, ErrNotFound
+	}
+
+	if err != nil {
+		return ImportProfile{}, sqliteError(ctx, err)
+	}
+
+	return sqliteProfileFromRow(row)
+}
+
+// ListImportProfiles implements ImportProfileQuerier.
+func (db *SQLite) ListImportProfiles(ctx context.Context) ([]ImportProfile, error) {
+	rows, err := db.conn.ListImportProfiles(ctx)
+	if err != nil {
+		return nil, sqliteError(ctx, err)
+	}
+
+	profiles := make([]ImportProfile, len(rows))
+
+	for i, row := range rows {
+		if profiles[i], err = sqliteProfileFromRow(row); err != nil {
+			return nil, err
+		}
+	}
+
+	return profiles, nil
+}
+
+// UpdateImportProfile implements ImportProfileQuerier.
+func (db *SQLite) UpdateImportProfile(ctx context.Context, profile ImportProfile) error {
+	columns, defaults, err := profileJSON(profile)
+	if err != nil {
+		return err
+	}
+
+	updated, err := db.conn.UpdateImportProfile(ctx, sqlitec.UpdateImportProfileParams{
+		Columns:   columns,
+		Delimiter: profile.Delimiter,
+		Encoding:  profile.Encoding,
+		Header:    profile.Header,
+		Defaults:  defaults,
+		Name:      profile.Name,
+	})
+	if err != nil {
+		return sqliteError(ctx, err)
+	}
+
+	if updated == 0 {
+		return ErrNotFound
+	}
+
+	return nil
+}
+
+// DeleteImportProfile implements ImportProfileQuerier.
+func (db *SQLite) DeleteImportProfile(ctx context.Context, name string) error {
+	deleted, err := db.conn.DeleteImportProfile(ctx, name)
+	if err != nil {
+		return sqliteError(ctx, err)
+	}
+
+	if deleted == 0 {
+		return ErrNotFound
+	}
+
+	return nil
+}
+
+// profileJSON encodes the fields of a profile that are stored as JSON.
+func profileJSON(profile ImportProfile) (columns, defaults string, err error) {
+	if columns, err = jsonParam(profile.Columns); err != nil {
+		return "", "", err
+	}
+
+	if defaults, err = jsonParam(profile.Defaults); err != nil {
+		return "", "", err
+	}
+
+	return columns, defaults, nil
+}
+
+func sqliteProfileFromRow(row sqlitec.ImportProfile) (ImportProfile, error) {
+	profile := ImportProfile{
+		Name:      row.Name,
+		Columns:   []string{},
+		Delimiter: row.Delimiter,
+		Encoding:  row.Encoding,
+		Header:    row.Header,
+		Defaults:  map[string]string{},
+	}
+
+	if err := json.Unmarshal([]byte(row.Columns), &profile.Columns); err != nil {
+		return ImportProfile{}, fmt.Errorf("error decoding columns of profile %q: %w", row.Name, err)
+	}
+
+	if err := json.Unmarshal([]byte(row.Defaults), &profile.Defaults); err != nil {
+		return ImportProfile{}, fmt.Errorf("error decoding defaults of profile %q: %w", row.Name, err)
+	}
+
+	return profile, nil
+}
+
+// jsonParam encodes a query parameter that SQLite reads with json_each, because it has no arrays.
+func jsonParam(value any) (string, error) {
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		return "", fmt.Errorf("error encoding query parameter: %w", err)
+	}
+
+	return string(encoded), nil
+}
+
+// sqliteUserFromRow is userFromRow for SQLite.
+func sqliteUserFromRow(row sqlitec.SearchUsersRow) User {
+	return User{
+		Name:           row.Name,
+		PhoneNumber:    row.PhoneNumber,
+		PhoneNumberRaw: row.PhoneNumberRaw,
+		Country:        row.Country,
+		City:           row.City,
+		ID:             row.ID,
+	}
+}
+
+func (db *SQLite) Close() error {
+	if err := db.sqlDB.Close(); err != nil {
+		return fmt.Errorf("failed to close SQLite database: %w", err)
+	}
+
+	return nil
+}
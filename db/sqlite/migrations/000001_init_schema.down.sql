@@ -0,0 +1,3 @@
+DROP TABLE import_profiles;
+DROP TABLE user_merges;
+DROP TABLE users;
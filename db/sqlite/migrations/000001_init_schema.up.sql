@@ -0,0 +1,38 @@
+-- SQLite has no unaccent, so name_folded and city_folded are computed by the application with db.FoldText.
+-- AUTOINCREMENT keeps IDs of deleted users from being reused, like the identity column in PostgreSQL.
+CREATE TABLE users (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  name TEXT NOT NULL CHECK (length(name) <= 256),
+  phone_number TEXT NOT NULL CHECK (length(phone_number) <= 32),
+  phone_number_raw TEXT NOT NULL CHECK (length(phone_number_raw) <= 64),
+  country TEXT NOT NULL CHECK (length(country) <= 128),
+  city TEXT NOT NULL CHECK (length(city) <= 128),
+  name_folded TEXT NOT NULL,
+  city_folded TEXT NOT NULL
+);
+
+CREATE INDEX users_phone_number ON users (phone_number);
+CREATE INDEX users_city_folded ON users (city_folded);
+-- Lets ListDuplicateCandidates group users by city and the first letters of their name, see db.ClusterDuplicates.
+CREATE INDEX users_duplicate_block ON users (city_folded, substr(name_folded, 1, 2));
+CREATE INDEX users_country ON users (country);
+
+-- Audit trail of merged users. Users are stored as JSON so that the record outlives them.
+CREATE TABLE user_merges (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  survivor_id INTEGER NOT NULL,
+  survivor TEXT NOT NULL,
+  merged TEXT NOT NULL,
+  fields TEXT NOT NULL,
+  merged_at DATETIME NOT NULL
+);
+
+-- columns and defaults are JSON because SQLite has no arrays.
+CREATE TABLE import_profiles (
+  name TEXT PRIMARY KEY CHECK (length(name) <= 64),
+  columns TEXT NOT NULL,
+  delimiter TEXT NOT NULL DEFAULT ',',
+  encoding TEXT NOT NULL DEFAULT 'utf-8',
+  header BOOLEAN NOT NULL DEFAULT false,
+  defaults TEXT NOT NULL DEFAULT '{}'
+);
@@ -0,0 +1,110 @@
+-- name: CreateUser :exec
+INSERT INTO users (
+    id, name, phone_number, phone_number_raw, country, city, name_folded, city_folded
+) VALUES (
+    ?, ?, ?, ?, ?, ?, ?, ?
+);
+
+-- name: CreateUserWithGeneratedID :one
+INSERT INTO users (
+    name, phone_number, phone_number_raw, country, city, name_folded, city_folded
+) VALUES (
+    ?, ?, ?, ?, ?, ?, ?
+)
+RETURNING id;
+
+-- name: DeleteUserByID :exec
+DELETE FROM users
+WHERE id = ?;
+
+-- name: SearchUsers :many
+SELECT id, name, phone_number, phone_number_raw, country, city FROM users
+WHERE (sqlc.arg(name_folded) = '' OR instr(name_folded, sqlc.arg(name_folded)) > 0)
+  AND (sqlc.arg(country) = '' OR country = sqlc.arg(country))
+ORDER BY id;
+
+-- name: SearchUsersPage :many
+SELECT id, name, phone_number, phone_number_raw, country, city FROM users
+WHERE (sqlc.narg(after_id) IS NULL OR id > sqlc.narg(after_id))
+  AND (sqlc.arg(name_folded) = '' OR instr(name_folded, sqlc.arg(name_folded)) > 0)
+  AND (sqlc.arg(country) = '' OR country = sqlc.arg(country))
+ORDER BY id
+LIMIT sqlc.arg(page_size);
+
+-- name: MatchUsers :many
+-- ids and phone_numbers are JSON arrays, names_and_cities is a JSON array of [name_folded, city_folded] pairs.
+SELECT id, name, phone_number, phone_number_raw, country, city FROM users
+WHERE id IN (SELECT value FROM json_each(sqlc.arg(ids)))
+   OR phone_number IN (SELECT value FROM json_each(sqlc.arg(phone_numbers)))
+   OR EXISTS (
+       SELECT 1 FROM json_each(sqlc.arg(names_and_cities)) AS c
+       WHERE json_extract(c.value, '$[0]') = name_folded AND json_extract(c.value, '$[1]') = city_folded
+   )
+ORDER BY id;
+
+-- name: GetUserByID :one
+SELECT id, name, phone_number, phone_number_raw, country, city FROM users
+WHERE id = ?;
+
+-- name: GetUsersByIDs :many
+-- ids is a JSON array.
+SELECT id, name, phone_number, phone_number_raw, country, city FROM users
+WHERE id IN (SELECT value FROM json_each(sqlc.arg(ids)))
+ORDER BY id;
+
+-- name: UpdateUser :execrows
+UPDATE users SET
+    name = ?, phone_number = ?, phone_number_raw = ?, country = ?, city = ?, name_folded = ?, city_folded = ?
+WHERE id = ?;
+
+-- name: ListDuplicateCandidates :many
+-- Groups the users by phone number and by duplicate block (folded city and the first 2 letters of the folded name, see
+-- db.ClusterDuplicates) instead of comparing every pair, see the users_phone_number and users_duplicate_block indexes.
+SELECT id, name, phone_number, phone_number_raw, country, city FROM users
+WHERE phone_number IN (SELECT phone_number FROM users GROUP BY phone_number HAVING count(*) > 1)
+    OR (city_folded, substr(name_folded, 1, 2)) IN (
+        SELECT city_folded, substr(name_folded, 1, 2) FROM users
+        GROUP BY city_folded, substr(name_folded, 1, 2) HAVING count(*) > 1
+    )
+ORDER BY id;
+
+-- name: DeleteUsersByIDs :execrows
+-- ids is a JSON array.
+DELETE FROM users
+WHERE id IN (SELECT value FROM json_each(sqlc.arg(ids)));
+
+-- name: CreateUserMerge :one
+INSERT INTO user_merges (
+    survivor_id, survivor, merged, fields, merged_at
+) VALUES (
+    ?, ?, ?, ?, ?
+)
+RETURNING id;
+
+-- name: ListUserMerges :many
+SELECT id, survivor_id, survivor, merged, fields, merged_at FROM user_merges
+ORDER BY id;
+
+-- name: CreateImportProfile :exec
+INSERT INTO import_profiles (
+    name, columns, delimiter, encoding, header, defaults
+) VALUES (
+    ?, ?, ?, ?, ?, ?
+);
+
+-- name: GetImportProfile :one
+SELECT name, columns, delimiter, encoding, header, defaults FROM import_profiles
+WHERE name = ?;
+
+-- name: ListImportProfiles :many
+SELECT name, columns, delimiter, encoding, header, defaults FROM import_profiles
+ORDER BY name;
+
+-- name: UpdateImportProfile :execrows
+UPDATE import_profiles SET
+    columns = ?, delimiter = ?, encoding = ?, header = ?, defaults = ?
+WHERE name = ?;
+
+-- name: DeleteImportProfile :execrows
+DELETE FROM import_profiles
+WHERE name = ?;
@@ -0,0 +1,190 @@
+package db_test
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"github.com/m-kuzmin/simple-rest-api/db"
+	"github.com/m-kuzmin/simple-rest-api/db/dbtest"
+	"github.com/stretchr/testify/assert"
+)
+
+func openTestSQLite(t *testing.T) *db.SQLite {
+	t.Helper()
+
+	database, err := db.OpenSQLite(filepath.Join(t.TempDir(), "users.db"))
+	if err != nil {
+		t.Fatalf("Cannot open SQLite: %s", err)
+	}
+
+	t.Cleanup(func() { assert.Nil(t, database.Close()) })
+
+	return database
+}
+
+func TestSQLiteShouldCreateAndImportUsers(t *testing.T) {
+	t.Parallel()
+
+	database := openTestSQLite(t)
+	ctx := context.Background()
+
+	users := []db.User{
+		{Name: "John Doe", PhoneNumber: "+18001234567", Country: "US", City: "Boston"},
+		{ID: 5, Name: "Jane Roe", PhoneNumber: "+18002234567", Country: "US", City: "Chicago"},
+	}
+	assert.Nil(t, database.CreateUsers(ctx, users))
+	assert.Equal(t, int64(6), users[0].ID, "generated IDs must be greater than explicit ones")
+
+	err := database.CreateUsers(ctx, []db.User{{ID: 5, Name: "Max", PhoneNumber: "+1", Country: "US", City: "X"}})
+	assert.True(t, errors.Is(err, db.ErrConflict), err)
+
+	var dbErr *db.Error
+	if assert.True(t, errors.As(err, &dbErr)) {
+		assert.Equal(t, "id", dbErr.Column)
+	}
+
+	counts, err := database.ImportUsers(ctx, []db.User{
+		{ID: 5, Name: "Jane Roe", PhoneNumber: "+18002234567", Country: "US", City: "Denver"},
+		{ID: 6, Name: "John Doe", PhoneNumber: "+18001234567", Country: "US", City: "Boston"},
+		{ID: 7, Name: "Max Mustermann", PhoneNumber: "+49301234567", Country: "DE", City: "Berlin"},
+	}, db.ConflictSkip, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, db.ImportCounts{Created: 1, Updated: 0, Skipped: 2}, counts)
+
+	counts, err = database.ImportUsers(ctx, []db.User{
+		{ID: 5, Name: "Jane Roe", PhoneNumber: "+18002234567", Country: "US", City: "Denver"},
+	}, db.ConflictOverwrite, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, db.ImportCounts{Created: 0, Updated: 1, Skipped: 0}, counts)
+
+	user, err := database.GetUserByID(ctx, 5)
+	assert.Nil(t, err)
+	assert.Equal(t, "Denver", user.City)
+}
+
+func TestSQLiteShouldSearchAndMatchUsers(t *testing.T) {
+	t.Parallel()
+
+	database := openTestSQLite(t)
+	ctx := context.Background()
+
+	assert.Nil(t, database.CreateUsers(ctx, []db.User{
+		{ID: 1, Name: "José Müller", PhoneNumber: "+491701234567", Country: "DE", City: "München"},
+		{ID: 2, Name: "John Doe", PhoneNumber: "+18001234567", Country: "US", City: "Boston"},
+		{ID: 3, Name: "Jon Doe", PhoneNumber: "+18009999999", Country: "US", City: "boston"},
+	}))
+
+	found, err := database.SearchUsers(ctx, db.UserFilter{Name: "jose MULLER"})
+	assert.Nil(t, err)
+
+	if assert.Len(t, found, 1) {
+		assert.Equal(t, int64(1), found[0].ID)
+	}
+
+	found, err = database.SearchUsers(ctx, db.UserFilter{Country: "US"})
+	assert.Nil(t, err)
+	assert.Len(t, found, 2)
+
+	matches, err := database.MatchUsers(ctx, []db.User{{Name: "JOSE muller", PhoneNumber: "+1", City: "Munchen"}})
+	assert.Nil(t, err)
+
+	if assert.Len(t, matches, 1) {
+		assert.Equal(t, int64(1), matches[0].ID)
+	}
+
+	clusters, err := database.DuplicateUsers(ctx)
+	assert.Nil(t, err)
+
+	if assert.Len(t, clusters, 1) {
+		assert.Len(t, clusters[0], 2)
+	}
+
+	exported := 0
+	assert.Nil(t, database.EachUser(ctx, db.UserFilter{}, func(db.User) error {
+		exported++
+
+		return nil
+	}))
+	assert.Equal(t, 3, exported)
+}
+
+func TestSQLiteShouldMergeUsers(t *testing.T) {
+	t.Parallel()
+
+	database := openTestSQLite(t)
+	ctx := context.Background()
+
+	users := []db.User{
+		{ID: 1, Name: "John Doe", PhoneNumber: "+18001234567", Country: "US", City: "Boston"},
+		{ID: 2, Name: "Jon Doe", PhoneNumber: "+18001234567", Country: "US", City: "Boston"},
+	}
+	assert.Nil(t, database.CreateUsers(ctx, users))
+
+	spec := db.MergeSpec{Survivor: 1, Merged: []int64{2}, Fields: map[string]int64{"name": 2}}
+
+	merge, err := database.MergeUsers(ctx, spec)
+	assert.Nil(t, err)
+
+	survivor, err := database.GetUserByID(ctx, 1)
+	assert.Nil(t, err)
+	assert.Equal(t, "Jon Doe", survivor.Name)
+
+	_, err = database.GetUserByID(ctx, 2)
+	assert.True(t, errors.Is(err, db.ErrNotFound))
+
+	_, err = database.MergeUsers(ctx, spec)
+	assert.True(t, errors.Is(err, db.ErrNotFound), "user 2 is gone")
+
+	merges, err := database.ListMerges(ctx)
+	assert.Nil(t, err)
+
+	if assert.Len(t, merges, 1) {
+		assert.Equal(t, merge.ID, merges[0].ID)
+		assert.Equal(t, users[1:], merges[0].Merged)
+		assert.True(t, merge.MergedAt.Equal(merges[0].MergedAt))
+	}
+}
+
+func TestSQLiteShouldStoreImportProfiles(t *testing.T) {
+	t.Parallel()
+
+	database := openTestSQLite(t)
+	ctx := context.Background()
+
+	profile := db.ImportProfile{
+		Name:      "acme",
+		Columns:   []string{"name", "", "city"},
+		Delimiter: ";",
+		Encoding:  "windows-1252",
+		Header:    true,
+		Defaults:  map[string]string{"country": "DE"},
+	}
+	assert.Nil(t, database.CreateImportProfile(ctx, profile))
+	assert.True(t, errors.Is(database.CreateImportProfile(ctx, profile), db.ErrConflict))
+
+	saved, err := database.GetImportProfile(ctx, "acme")
+	assert.Nil(t, err)
+	assert.Equal(t, profile, saved)
+
+	profile.Header = false
+	assert.Nil(t, database.UpdateImportProfile(ctx, profile))
+
+	profiles, err := database.ListImportProfiles(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, []db.ImportProfile{profile}, profiles)
+
+	assert.Nil(t, database.DeleteImportProfile(ctx, "acme"))
+	assert.True(t, errors.Is(database.DeleteImportProfile(ctx, "acme"), db.ErrNotFound))
+}
+
+func TestSQLiteConformance(t *testing.T) {
+	t.Parallel()
+
+	dbtest.RunQuerierSuite(t, func(t *testing.T) db.Querier {
+		t.Helper()
+
+		return openTestSQLite(t)
+	})
+}
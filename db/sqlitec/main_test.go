@@ -0,0 +1,43 @@
+package sqlitec_test
+
+import (
+	"database/sql"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/m-kuzmin/simple-rest-api/db"
+	"github.com/m-kuzmin/simple-rest-api/db/sqlitec"
+	"github.com/m-kuzmin/simple-rest-api/logging"
+	_ "modernc.org/sqlite"
+)
+
+const dbDriver = "sqlite"
+
+var testQueries *sqlitec.Queries //nolint:gochecknoglobals // This is used by all tests to connect to the DB.
+
+func TestMain(m *testing.M) {
+	logging.GlobalLogger = logging.StdLogger{}
+
+	dir, err := os.MkdirTemp("", "sqlitec")
+	if err != nil {
+		logging.Fatalf("Cannot create a directory for the database: %s", err)
+	}
+
+	conn, err := sql.Open(dbDriver, "file:"+filepath.Join(dir, "users.db")+"?_pragma=busy_timeout(5000)")
+	if err != nil {
+		logging.Fatalf("Cannot connect to database: %s", err)
+	}
+
+	if err = db.SQLiteMigrateUp(conn); err != nil {
+		logging.Fatalf("Failed to migrate test db: %s", err)
+	}
+
+	testQueries = sqlitec.New(conn)
+
+	code := m.Run()
+
+	conn.Close()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
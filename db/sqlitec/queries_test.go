@@ -0,0 +1,119 @@
+package sqlitec_test
+
+import (
+	"context"
+	"math/rand"
+	"testing"
+
+	"github.com/m-kuzmin/simple-rest-api/db"
+	"github.com/m-kuzmin/simple-rest-api/db/sqlitec"
+)
+
+func TestShouldCreateAccount(t *testing.T) {
+	t.Parallel()
+
+	userID := rand.Int63() //nolint:gosec // We only need this to prevent two tests from placing the same ID in the DB.
+	t.Log("user id:", userID)
+
+	ctx := context.Background()
+	arg := sqlitec.CreateUserParams{
+		ID:             userID,
+		Name:           "John Doe",
+		PhoneNumber:    "+18001234567",
+		PhoneNumberRaw: "18001234567",
+		Country:        "US",
+		City:           "New York",
+		NameFolded:     "john doe",
+		CityFolded:     "new york",
+	}
+
+	err := testQueries.CreateUser(ctx, arg)
+	if err != nil {
+		t.Logf("While creating the user: %s", err)
+		t.Fail()
+	}
+
+	err = testQueries.DeleteUserByID(ctx, userID)
+	if err != nil {
+		t.Logf("While deleting the user: %s", err)
+		t.Fail()
+	}
+}
+
+func TestShouldSearchUsersByFoldedName(t *testing.T) {
+	t.Parallel()
+
+	userID := rand.Int63() //nolint:gosec // We only need this to prevent two tests from placing the same ID in the DB.
+	t.Log("user id:", userID)
+
+	ctx := context.Background()
+	arg := sqlitec.CreateUserParams{
+		ID:             userID,
+		Name:           "José Müller",
+		PhoneNumber:    "+491701234567",
+		PhoneNumberRaw: "491701234567",
+		Country:        "DE",
+		City:           "München",
+		NameFolded:     db.FoldText("José Müller"),
+		CityFolded:     db.FoldText("München"),
+	}
+
+	if err := testQueries.CreateUser(ctx, arg); err != nil {
+		t.Fatalf("While creating the user: %s", err)
+	}
+
+	defer func() {
+		if err := testQueries.DeleteUserByID(ctx, userID); err != nil {
+			t.Errorf("While deleting the user: %s", err)
+		}
+	}()
+
+	rows, err := testQueries.SearchUsers(ctx, sqlitec.SearchUsersParams{
+		NameFolded: db.FoldText("jose MULLER"),
+		Country:    "",
+	})
+	if err != nil {
+		t.Fatalf("While searching users: %s", err)
+	}
+
+	for _, row := range rows {
+		if row.ID == userID {
+			return
+		}
+	}
+
+	t.Errorf("User %d was not found by folded name", userID)
+}
+
+func TestShouldGenerateUserID(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	arg := sqlitec.CreateUserWithGeneratedIDParams{
+		Name:           "Jane Doe",
+		PhoneNumber:    "+18002234567",
+		PhoneNumberRaw: "18002234567",
+		Country:        "US",
+		City:           "Boston",
+		NameFolded:     "jane doe",
+		CityFolded:     "boston",
+	}
+
+	userID, err := testQueries.CreateUserWithGeneratedID(ctx, arg)
+	if err != nil {
+		t.Fatalf("While creating the user: %s", err)
+	}
+
+	t.Log("user id:", userID)
+
+	row, err := testQueries.GetUserByID(ctx, userID)
+	if err != nil {
+		t.Errorf("While getting the user: %s", err)
+	} else if row.Name != arg.Name {
+		t.Errorf("Got user %q with the generated ID, expected %q", row.Name, arg.Name)
+	}
+
+	if err = testQueries.DeleteUserByID(ctx, userID); err != nil {
+		t.Errorf("While deleting the user: %s", err)
+	}
+}
@@ -0,0 +1,110 @@
+package db_test
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/m-kuzmin/simple-rest-api/db"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestShouldOpenStoreByScheme(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]interface{}{
+		"memory://": &db.InMemoryDB{},
+		"memory://" + t.TempDir() + "?fsync=never&snapshot-interval=1m": &db.InMemoryDB{},
+		"sqlite://" + filepath.Join(t.TempDir(), "users.db"):            &db.RetryingStore{},
+	}
+
+	for dsn, want := range tests {
+		database, err := db.OpenStore(context.Background(), dsn)
+		if !assert.Nil(t, err, dsn) {
+			continue
+		}
+
+		assert.IsType(t, want, database, dsn)
+		assert.Nil(t, database.Close(), dsn)
+	}
+}
+
+func TestShouldRejectBadDSN(t *testing.T) {
+	t.Parallel()
+
+	for _, dsn := range []string{
+		"mysql://root@localhost/users",
+		"users.db",
+		"memory://?fsync=sometimes",
+		"memory://?snapshot-interval=often",
+		"memory://?cache=1",
+		"memory://?fsync=never",          // Nothing to sync without a directory
+		"memory://?snapshot-interval=1m", // Nothing to snapshot without a directory
+		"memory://?seed=users.csv",       // No seed loader
+		"sqlite://users.db?cache=shared",
+	} {
+		database, err := db.OpenStore(context.Background(), dsn)
+		assert.NotNil(t, err, dsn)
+		assert.Nil(t, database, dsn)
+	}
+}
+
+func TestShouldNameEveryUnknownDSNParameter(t *testing.T) {
+	t.Parallel()
+
+	_, err := db.OpenStore(context.Background(), "sqlite://"+filepath.Join(t.TempDir(), "users.db")+"?a=1&b=2")
+	if assert.NotNil(t, err) {
+		assert.Contains(t, err.Error(), `unknown DSN parameter "a"`)
+		assert.Contains(t, err.Error(), `unknown DSN parameter "b"`)
+	}
+}
+
+func TestShouldSeedEmptyMemoryStore(t *testing.T) {
+	t.Parallel()
+
+	loads := 0
+	loader := db.WithSeedLoader(func(ctx context.Context, querier db.Querier, path string) error {
+		loads++
+
+		assert.Equal(t, "users.csv", path)
+
+		return querier.CreateUsers(ctx, []db.User{{Name: "John Doe", PhoneNumber: "+18001234567", Country: "US"}})
+	})
+	dsn := "memory://" + t.TempDir() + "?seed=users.csv"
+
+	for i := 0; i < 2; i++ {
+		database, err := db.OpenStore(context.Background(), dsn, loader)
+		if !assert.Nil(t, err) {
+			return
+		}
+
+		users, err := database.SearchUsers(context.Background(), db.UserFilter{})
+		assert.Nil(t, err)
+		assert.Len(t, users, 1)
+		assert.Nil(t, database.Close())
+	}
+
+	assert.Equal(t, 1, loads, "the seed must only be loaded into an empty database")
+}
+
+func TestShouldApplyPoolConfig(t *testing.T) {
+	t.Parallel()
+
+	database, err := db.OpenStore(context.Background(), "sqlite://"+filepath.Join(t.TempDir(), "users.db"),
+		db.WithPool(db.PoolConfig{MaxOpenConns: 7, MaxIdleConns: 2, ConnMaxLifetime: time.Hour, ConnMaxIdleTime: 0}))
+	assert.Nil(t, err)
+
+	pooled, isPooled := database.(db.Pooled)
+	if assert.True(t, isPooled) {
+		assert.Equal(t, 7, pooled.Stats().MaxOpenConnections)
+	}
+
+	assert.Nil(t, database.Close())
+
+	memory, err := db.OpenStore(context.Background(), "memory://")
+	assert.Nil(t, err)
+
+	_, isPooled = memory.(db.Pooled)
+	assert.False(t, isPooled, "the in-memory database has no connection pool")
+}
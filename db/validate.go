@@ -0,0 +1,132 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+	"unicode"
+
+	"github.com/go-playground/validator/v10"
+)
+
+var (
+	validateOnce sync.Once           //nolint:gochecknoglobals // Validators cache struct metadata, so there is one
+	validate     *validator.Validate //nolint:gochecknoglobals // Validators cache struct metadata, so there is one
+)
+
+// Violation is a field that breaks one of the rules in the `validate` struct tag.
+type Violation struct {
+	Field  string // JSON name of the field
+	Rule   string // The broken rule, for example "max"
+	Detail string
+}
+
+// ValidationError is returned by ValidateUser and lists every rule the user breaks.
+type ValidationError struct {
+	Violations []Violation
+}
+
+func (e ValidationError) Error() string {
+	details := make([]string, len(e.Violations))
+	for i, violation := range e.Violations {
+		details[i] = violation.Field + " " + violation.Detail
+	}
+
+	return strings.Join(details, "; ")
+}
+
+/*
+ValidateUser checks the user against the rules in the `validate` tags of User, which mirror the constraints of the users
+table. If any rule is broken, returns ValidationError.
+*/
+func ValidateUser(user User) error {
+	err := userValidator().Struct(user)
+
+	var fieldErrs validator.ValidationErrors
+	if !errors.As(err, &fieldErrs) {
+		return err //nolint:wrapcheck // Only returned for programming errors such as bad tags
+	}
+
+	violations := make([]Violation, len(fieldErrs))
+	for i, fieldErr := range fieldErrs {
+		violations[i] = Violation{
+			Field:  fieldErr.Field(),
+			Rule:   fieldErr.Tag(),
+			Detail: violationDetail(fieldErr),
+		}
+	}
+
+	return ValidationError{Violations: violations}
+}
+
+func violationDetail(err validator.FieldError) string {
+	switch err.Tag() {
+	case "required":
+		return "is required"
+	case "max":
+		return fmt.Sprintf("must be at most %s characters long", err.Param())
+	case "gt":
+		return fmt.Sprintf("must be greater than %s", err.Param())
+	case "e164":
+		return "must be a phone number in E.164 format"
+	case "iso3166_1_alpha2":
+		return "must be an ISO 3166-1 alpha-2 country code"
+	case "personname":
+		return "must contain letters and only spaces, apostrophes, hyphens and dots besides them"
+	case "placename":
+		return "must contain letters and only digits, spaces and common punctuation besides them"
+	default:
+		return fmt.Sprintf("breaks rule %q", err.Tag())
+	}
+}
+
+func userValidator() *validator.Validate {
+	validateOnce.Do(func() {
+		validate = validator.New()
+
+		validate.RegisterTagNameFunc(func(field reflect.StructField) string {
+			return strings.SplitN(field.Tag.Get("json"), ",", 2)[0] //nolint:gomnd // Name and the rest
+		})
+
+		for tag, allowed := range map[string]func(rune) bool{
+			"personname": isPersonNameRune,
+			"placename":  isPlaceNameRune,
+		} {
+			allowed := allowed
+
+			err := validate.RegisterValidation(tag, func(fl validator.FieldLevel) bool {
+				return isMadeOf(fl.Field().String(), allowed)
+			})
+			if err != nil {
+				panic(fmt.Sprintf("registering %q validation: %s", tag, err))
+			}
+		}
+	})
+
+	return validate
+}
+
+// isMadeOf reports whether s has at least one letter and all other runes are allowed.
+func isMadeOf(s string, allowed func(rune) bool) bool {
+	hasLetter := false
+
+	for _, r := range s {
+		if unicode.IsLetter(r) {
+			hasLetter = true
+		} else if !unicode.IsMark(r) && !allowed(r) {
+			return false
+		}
+	}
+
+	return hasLetter
+}
+
+func isPersonNameRune(r rune) bool {
+	return strings.ContainsRune(" '’-.", r)
+}
+
+func isPlaceNameRune(r rune) bool {
+	return unicode.IsDigit(r) || strings.ContainsRune(" '’-.,()/", r)
+}
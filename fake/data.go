@@ -0,0 +1,182 @@
+package fake
+
+// locale is what people in a country are called and where they live.
+type locale struct {
+	FirstNames []string
+	LastNames  []string
+	Cities     []string
+}
+
+// locales are the countries users can be generated for, by ISO 3166-1 alpha-2 code.
+//
+//nolint:gochecknoglobals // Read-only lookup table
+var locales = map[string]locale{
+	"US": {
+		FirstNames: []string{
+			"James", "Mary", "Robert", "Patricia", "John", "Jennifer", "Michael", "Linda", "David", "Elizabeth",
+			"William", "Barbara", "Richard", "Susan", "Joseph", "Jessica", "Thomas", "Sarah", "Christopher", "Karen",
+		},
+		LastNames: []string{
+			"Smith", "Johnson", "Williams", "Brown", "Jones", "Garcia", "Miller", "Davis", "Rodriguez", "Martinez",
+			"Hernandez", "Lopez", "Gonzalez", "Wilson", "Anderson", "Thomas", "Taylor", "Moore", "Jackson", "O'Brien",
+		},
+		Cities: []string{
+			"New York", "Los Angeles", "Chicago", "Houston", "Phoenix", "Philadelphia", "San Antonio", "San Diego",
+			"Dallas", "San Jose", "Austin", "Jacksonville", "Columbus", "Seattle", "Denver", "Boston",
+		},
+	},
+	"CA": {
+		FirstNames: []string{
+			"Liam", "Olivia", "Noah", "Emma", "William", "Charlotte", "Benjamin", "Amelia", "Lucas", "Chloé",
+			"Félix", "Léa", "Samuel", "Zoé", "Ethan", "Maëlle",
+		},
+		LastNames: []string{
+			"Tremblay", "Gagnon", "Roy", "Côté", "Bouchard", "Gauthier", "Morin", "Lavoie", "Fortin", "Smith",
+			"Brown", "Wilson", "MacDonald", "Campbell", "Anderson", "Taylor",
+		},
+		Cities: []string{
+			"Toronto", "Montréal", "Vancouver", "Calgary", "Edmonton", "Ottawa", "Winnipeg", "Québec City", "Hamilton",
+			"Halifax", "Victoria", "Saskatoon",
+		},
+	},
+	"GB": {
+		FirstNames: []string{
+			"Oliver", "Amelia", "George", "Isla", "Harry", "Ava", "Jack", "Mia", "Jacob", "Ivy", "Charlie", "Lily",
+			"Thomas", "Isabella", "Oscar", "Rosie",
+		},
+		LastNames: []string{
+			"Smith", "Jones", "Taylor", "Brown", "Williams", "Wilson", "Johnson", "Davies", "Robinson", "Wright",
+			"Thompson", "Evans", "Walker", "White", "Roberts", "Green",
+		},
+		Cities: []string{
+			"London", "Birmingham", "Manchester", "Leeds", "Glasgow", "Liverpool", "Bristol", "Sheffield", "Edinburgh",
+			"Cardiff", "Leicester", "Belfast", "Nottingham", "Newcastle upon Tyne",
+		},
+	},
+	"DE": {
+		FirstNames: []string{
+			"Lukas", "Mia", "Leon", "Emma", "Finn", "Hannah", "Jonas", "Sophia", "Paul", "Lea", "Felix", "Jürgen",
+			"Maximilian", "Lena", "Elias", "Käthe",
+		},
+		LastNames: []string{
+			"Müller", "Schmidt", "Schneider", "Fischer", "Weber", "Meyer", "Wagner", "Becker", "Schulz", "Hoffmann",
+			"Schäfer", "Koch", "Bauer", "Richter", "Klein", "Wolf",
+		},
+		Cities: []string{
+			"Berlin", "Hamburg", "München", "Köln", "Frankfurt am Main", "Stuttgart", "Düsseldorf", "Leipzig",
+			"Dortmund", "Essen", "Bremen", "Dresden", "Hannover", "Nürnberg",
+		},
+	},
+	"FR": {
+		FirstNames: []string{
+			"Gabriel", "Louise", "Léo", "Jade", "Raphaël", "Ambre", "Arthur", "Alba", "Louis", "Emma", "Jules", "Rose",
+			"Adam", "Chloé", "Maël", "Inès",
+		},
+		LastNames: []string{
+			"Martin", "Bernard", "Thomas", "Petit", "Robert", "Richard", "Durand", "Dubois", "Moreau", "Laurent",
+			"Simon", "Michel", "Lefèvre", "Leroy", "Roux", "David",
+		},
+		Cities: []string{
+			"Paris", "Marseille", "Lyon", "Toulouse", "Nice", "Nantes", "Montpellier", "Strasbourg", "Bordeaux",
+			"Lille", "Rennes", "Reims", "Saint-Étienne", "Le Havre",
+		},
+	},
+	"ES": {
+		FirstNames: []string{
+			"Hugo", "Lucía", "Martín", "Sofía", "Lucas", "Martina", "Mateo", "María", "Leo", "Julia", "Daniel", "Paula",
+			"Alejandro", "Valeria", "Pablo", "Noa",
+		},
+		LastNames: []string{
+			"García", "Rodríguez", "González", "Fernández", "López", "Martínez", "Sánchez", "Pérez", "Gómez",
+			"Martín", "Jiménez", "Ruiz", "Hernández", "Díaz", "Moreno", "Muñoz",
+		},
+		Cities: []string{
+			"Madrid", "Barcelona", "Valencia", "Sevilla", "Zaragoza", "Málaga", "Murcia", "Palma", "Las Palmas",
+			"Bilbao", "Alicante", "Córdoba", "Valladolid", "A Coruña",
+		},
+	},
+	"IT": {
+		FirstNames: []string{
+			"Leonardo", "Sofia", "Francesco", "Aurora", "Alessandro", "Giulia", "Lorenzo", "Ginevra", "Mattia",
+			"Vittoria", "Andrea", "Beatrice", "Gabriele", "Alice", "Riccardo", "Ludovica",
+		},
+		LastNames: []string{
+			"Rossi", "Russo", "Ferrari", "Esposito", "Bianchi", "Romano", "Colombo", "Ricci", "Marino", "Greco",
+			"Bruno", "Gallo", "Conti", "De Luca", "Mancini", "Costa",
+		},
+		Cities: []string{
+			"Roma", "Milano", "Napoli", "Torino", "Palermo", "Genova", "Bologna", "Firenze", "Bari", "Catania",
+			"Venezia", "Verona", "Messina", "Padova",
+		},
+	},
+	"PL": {
+		FirstNames: []string{
+			"Antoni", "Zofia", "Jan", "Zuzanna", "Aleksander", "Hanna", "Franciszek", "Julia", "Jakub", "Maja",
+			"Szymon", "Łucja", "Filip", "Małgorzata", "Mikołaj", "Alicja",
+		},
+		LastNames: []string{
+			"Nowak", "Kowalski", "Wiśniewski", "Wójcik", "Kowalczyk", "Kamiński", "Lewandowski", "Zieliński",
+			"Szymański", "Woźniak", "Dąbrowski", "Kozłowski", "Jankowski", "Mazur", "Kwiatkowski", "Krawczyk",
+		},
+		Cities: []string{
+			"Warszawa", "Kraków", "Łódź", "Wrocław", "Poznań", "Gdańsk", "Szczecin", "Bydgoszcz", "Lublin",
+			"Białystok", "Katowice", "Gdynia", "Częstochowa", "Toruń",
+		},
+	},
+	"UA": {
+		FirstNames: []string{
+			"Oleksandr", "Olena", "Andriy", "Iryna", "Dmytro", "Natalia", "Serhiy", "Tetiana", "Mykola", "Oksana",
+			"Ivan", "Yulia", "Volodymyr", "Kateryna", "Maksym", "Anastasia",
+		},
+		LastNames: []string{
+			"Melnyk", "Shevchenko", "Boyko", "Kovalenko", "Bondarenko", "Tkachenko", "Kovalchuk", "Kravchenko",
+			"Oliynyk", "Shevchuk", "Koval", "Polishchuk", "Bondar", "Tkachuk", "Moroz", "Marchenko",
+		},
+		Cities: []string{
+			"Kyiv", "Kharkiv", "Odesa", "Dnipro", "Lviv", "Zaporizhzhia", "Kryvyi Rih", "Mykolaiv", "Vinnytsia",
+			"Poltava", "Chernihiv", "Cherkasy", "Zhytomyr", "Ivano-Frankivsk",
+		},
+	},
+	"BR": {
+		FirstNames: []string{
+			"Miguel", "Helena", "Arthur", "Alice", "Gael", "Laura", "Théo", "Maria Alice", "Heitor", "Valentina",
+			"Ravi", "Heloísa", "Davi", "Maria Clara", "Bernardo", "Cecília",
+		},
+		LastNames: []string{
+			"Silva", "Santos", "Oliveira", "Souza", "Rodrigues", "Ferreira", "Alves", "Pereira", "Lima", "Gomes",
+			"Costa", "Ribeiro", "Martins", "Carvalho", "Araújo", "Conceição",
+		},
+		Cities: []string{
+			"São Paulo", "Rio de Janeiro", "Brasília", "Salvador", "Fortaleza", "Belo Horizonte", "Manaus", "Curitiba",
+			"Recife", "Goiânia", "Belém", "Porto Alegre", "Florianópolis", "Natal",
+		},
+	},
+	"JP": {
+		FirstNames: []string{
+			"Haruto", "Himari", "Sota", "Tsumugi", "Minato", "Mei", "Yuto", "Sakura", "Riku", "Yui", "Hinata", "Aoi",
+			"Ren", "Rin", "Kaito", "Hana",
+		},
+		LastNames: []string{
+			"Sato", "Suzuki", "Takahashi", "Tanaka", "Watanabe", "Ito", "Yamamoto", "Nakamura", "Kobayashi", "Kato",
+			"Yoshida", "Yamada", "Sasaki", "Yamaguchi", "Matsumoto", "Inoue",
+		},
+		Cities: []string{
+			"Tokyo", "Yokohama", "Osaka", "Nagoya", "Sapporo", "Fukuoka", "Kobe", "Kawasaki", "Kyoto", "Saitama",
+			"Hiroshima", "Sendai", "Chiba", "Kitakyushu",
+		},
+	},
+	"IN": {
+		FirstNames: []string{
+			"Aarav", "Saanvi", "Vihaan", "Aadhya", "Vivaan", "Ananya", "Aditya", "Diya", "Arjun", "Pari", "Sai",
+			"Anika", "Reyansh", "Navya", "Krishna", "Ishita",
+		},
+		LastNames: []string{
+			"Sharma", "Verma", "Gupta", "Singh", "Kumar", "Patel", "Reddy", "Iyer", "Nair", "Rao", "Das", "Mehta",
+			"Joshi", "Chopra", "Banerjee", "Menon",
+		},
+		Cities: []string{
+			"Mumbai", "Delhi", "Bengaluru", "Hyderabad", "Ahmedabad", "Chennai", "Kolkata", "Surat", "Pune", "Jaipur",
+			"Lucknow", "Kanpur", "Nagpur", "Indore",
+		},
+	},
+}
@@ -0,0 +1,170 @@
+/*
+Package fake generates realistic users for tests and demos. Names and cities are real ones from the user's country and
+phone numbers are valid mobile numbers of that country, so generated users pass every check of an import. The same
+seed always generates the same users.
+*/
+package fake
+
+import (
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/m-kuzmin/simple-rest-api/db"
+	"github.com/nyaruka/phonenumbers"
+)
+
+const (
+	// phoneAttempts is how many random numbers are tried before the example number of the country is used.
+	phoneAttempts = 100
+	// uniqueAttempts is how many users are tried before one that duplicates an earlier user is accepted.
+	uniqueAttempts = 20
+	// randomDigits is how many trailing digits of the example number are replaced, at most.
+	randomDigits = 7
+)
+
+// Countries returns the ISO 3166-1 alpha-2 codes of the countries users can be generated for, sorted.
+func Countries() []string {
+	codes := make([]string, 0, len(locales))
+	for code := range locales {
+		codes = append(codes, code)
+	}
+
+	sort.Strings(codes)
+
+	return codes
+}
+
+type unsupportedCountryError struct {
+	Country string
+}
+
+func (e unsupportedCountryError) Error() string {
+	return "cannot generate users from " + e.Country + ", expected one of " + strings.Join(Countries(), ", ")
+}
+
+// Generator generates users. It is not safe for concurrent use.
+type Generator struct {
+	rand      *rand.Rand
+	countries []string
+	seen      map[string]bool // Phone numbers and folded name and city pairs of generated users
+}
+
+/*
+NewGenerator returns a generator of users from the countries, which are ISO 3166-1 alpha-2 codes from Countries. No
+countries means all of them.
+*/
+func NewGenerator(seed int64, countries ...string) (*Generator, error) {
+	codes := Countries()
+
+	if len(countries) != 0 {
+		codes = make([]string, len(countries))
+
+		for i, code := range countries {
+			codes[i] = strings.ToUpper(code)
+
+			if _, found := locales[codes[i]]; !found {
+				return nil, unsupportedCountryError{Country: code}
+			}
+		}
+	}
+
+	return &Generator{
+		rand:      rand.New(rand.NewSource(seed)), //nolint:gosec // Reproducible test data, not secrets
+		countries: codes,
+		seen:      map[string]bool{},
+	}, nil
+}
+
+/*
+User returns a new user without an ID. Users are not probable duplicates (see db.ProbableDuplicates) of earlier users
+of the same generator, unless the countries run out of name and city combinations.
+*/
+func (g *Generator) User() db.User {
+	var user db.User
+
+	for attempt := 0; attempt < uniqueAttempts; attempt++ {
+		user = g.randomUser(attempt > uniqueAttempts/2) //nolint:gomnd // Try plain names first
+		if !g.seen[user.PhoneNumber] && !g.seen[nameAndCity(user)] {
+			break
+		}
+	}
+
+	g.seen[user.PhoneNumber] = true
+	g.seen[nameAndCity(user)] = true
+
+	return user
+}
+
+// Users returns n users, see User.
+func (g *Generator) Users(n int) []db.User {
+	users := make([]db.User, n)
+	for i := range users {
+		users[i] = g.User()
+	}
+
+	return users
+}
+
+func nameAndCity(user db.User) string {
+	return db.FoldText(user.Name) + "\x00" + db.FoldText(user.City)
+}
+
+// randomUser returns a user from a random country. With initial the name gets a middle initial.
+func (g *Generator) randomUser(initial bool) db.User {
+	code := g.countries[g.rand.Intn(len(g.countries))]
+	loc := locales[code]
+
+	name := g.pick(loc.FirstNames)
+	if initial {
+		name += " " + string(rune('A'+g.rand.Intn('Z'-'A'+1))) + "."
+	}
+
+	name += " " + g.pick(loc.LastNames)
+	number := g.phoneNumber(code)
+
+	return db.User{
+		Name:           name,
+		PhoneNumber:    phonenumbers.Format(number, phonenumbers.E164),
+		PhoneNumberRaw: phonenumbers.Format(number, phonenumbers.NATIONAL),
+		Country:        code,
+		City:           g.pick(loc.Cities),
+		ID:             0,
+	}
+}
+
+func (g *Generator) pick(list []string) string {
+	return list[g.rand.Intn(len(list))]
+}
+
+/*
+phoneNumber returns a valid mobile number of the country. The trailing digits of the example number from the numbering
+plan are replaced with random ones until the number is valid in the country.
+*/
+func (g *Generator) phoneNumber(country string) *phonenumbers.PhoneNumber {
+	example := phonenumbers.GetExampleNumberForType(country, phonenumbers.MOBILE)
+	national := phonenumbers.GetNationalSignificantNumber(example)
+	replaced := len(national) / 2 //nolint:gomnd // Keep at least the operator code
+
+	if replaced > randomDigits {
+		replaced = randomDigits
+	}
+
+	prefix := national[:len(national)-replaced]
+	callingCode := phonenumbers.GetCountryCodeForRegion(country)
+
+	for attempt := 0; attempt < phoneAttempts; attempt++ {
+		digits := []byte(prefix)
+		for len(digits) < len(national) {
+			digits = append(digits, byte('0'+g.rand.Intn(10))) //nolint:gomnd // Decimal digits
+		}
+
+		number, err := phonenumbers.Parse("+"+strconv.Itoa(callingCode)+string(digits), country)
+		if err == nil && phonenumbers.IsValidNumberForRegion(number, country) {
+			return number
+		}
+	}
+
+	return example
+}
@@ -0,0 +1,64 @@
+package fake_test
+
+import (
+	"testing"
+
+	"github.com/m-kuzmin/simple-rest-api/api"
+	"github.com/m-kuzmin/simple-rest-api/db"
+	"github.com/m-kuzmin/simple-rest-api/fake"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGeneratedUsersShouldPassValidation(t *testing.T) {
+	t.Parallel()
+
+	generator, err := fake.NewGenerator(1)
+	assert.Nil(t, err)
+
+	users := generator.Users(1000)
+	seen := map[string]bool{}
+
+	for _, user := range users {
+		prepared, err := api.PrepareUser(db.User{
+			Name:        user.Name,
+			PhoneNumber: user.PhoneNumberRaw,
+			Country:     user.Country,
+			City:        user.City,
+		})
+		assert.Nil(t, err, user)
+		assert.Equal(t, user.PhoneNumber, prepared.PhoneNumber, user)
+
+		nameAndCity := db.FoldText(user.Name) + "," + db.FoldText(user.City)
+		assert.False(t, seen[user.PhoneNumber] || seen[nameAndCity], "%v is a duplicate", user)
+
+		seen[user.PhoneNumber], seen[nameAndCity] = true, true
+	}
+}
+
+func TestGeneratorShouldBeReproducible(t *testing.T) {
+	t.Parallel()
+
+	first, err := fake.NewGenerator(42, "de", "UA")
+	assert.Nil(t, err)
+
+	second, err := fake.NewGenerator(42, "DE", "UA")
+	assert.Nil(t, err)
+
+	users := first.Users(100)
+	assert.Equal(t, users, second.Users(100))
+
+	for _, user := range users {
+		assert.Contains(t, []string{"DE", "UA"}, user.Country)
+	}
+
+	other, err := fake.NewGenerator(43, "DE", "UA")
+	assert.Nil(t, err)
+	assert.NotEqual(t, users, other.Users(100))
+}
+
+func TestShouldRejectUnsupportedCountry(t *testing.T) {
+	t.Parallel()
+
+	_, err := fake.NewGenerator(1, "US", "XX")
+	assert.NotNil(t, err)
+}
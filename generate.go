@@ -0,0 +1,192 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/m-kuzmin/simple-rest-api/db"
+	"github.com/m-kuzmin/simple-rest-api/fake"
+	"github.com/m-kuzmin/simple-rest-api/logging"
+)
+
+// generateBatchSize is how many generated users are saved with one CreateUsers call.
+const generateBatchSize = 1000
+
+type unknownFormatError struct {
+	Format string
+}
+
+func (e unknownFormatError) Error() string {
+	return fmt.Sprintf("unknown format %q, expected csv, json or ndjson", e.Format)
+}
+
+/*
+RunGenerate is the generate subcommand. It writes fake users to a file in one of the upload formats, or saves them to
+a database.
+*/
+func RunGenerate(args []string) {
+	flags := flag.NewFlagSet("generate", flag.ExitOnError)
+	count := flags.Int("n", 100, "How many users to generate") //nolint:gomnd // Documented default
+	seed := flags.Int64("random-seed", time.Now().UnixNano(),
+		"Generate the same users every time for the same seed. Random by default")
+	countries := flags.String("countries", "",
+		"Comma separated country codes to generate users from, one of "+strings.Join(fake.Countries(), ",")+
+			". All by default")
+	format := flags.String("format", "csv", "csv, json or ndjson")
+	output := flags.String("o", "-", "The file to write the users to, - for stdout")
+	dsn := flags.String("db", "", "Save the users to this database instead of writing them, see the --db flag")
+	flags.Parse(args) //nolint:errcheck,gosec // ExitOnError
+
+	logging.GlobalLogger = logging.StdLogger{}
+
+	// Checked before anything is generated or the output file is created
+	if err := checkFormat(*format); err != nil {
+		logging.Fatalf("bad -format: %s", err)
+	}
+
+	var codes []string
+	if *countries != "" {
+		codes = strings.Split(*countries, ",")
+	}
+
+	generator, err := fake.NewGenerator(*seed, codes...)
+	if err != nil {
+		logging.Fatalf("bad -countries: %s", err)
+	}
+
+	logging.Infof("Generating %d users with -random-seed %d", *count, *seed)
+
+	if *dsn != "" {
+		database := MustOpenStore(context.Background(), *dsn)
+
+		if err = saveGenerated(context.Background(), database, generator, *count); err != nil {
+			logging.Fatalf("failed to save users: %s", err)
+		}
+
+		if err = database.Close(); err != nil {
+			logging.Fatalf("failed to close the database: %s", err)
+		}
+
+		return
+	}
+
+	if err = writeGenerated(*output, *format, generator.Users(*count)); err != nil {
+		logging.Fatalf("failed to write users: %s", err)
+	}
+}
+
+// saveGenerated saves count users from the generator in batches of generateBatchSize.
+func saveGenerated(ctx context.Context, database db.Querier, generator *fake.Generator, count int) error {
+	for saved := 0; saved < count; {
+		batch := generator.Users(minInt(generateBatchSize, count-saved))
+
+		if err := database.CreateUsers(ctx, batch); err != nil {
+			return fmt.Errorf("after %d users: %w", saved, err)
+		}
+
+		saved += len(batch)
+		logging.Infof("Saved %d of %d users", saved, count)
+	}
+
+	return nil
+}
+
+/*
+writeGenerated writes the users to the file at path, or to stdout if path is "-". If writing fails, the file is
+removed, so that a partial file is not mistaken for a complete one.
+*/
+func writeGenerated(path, format string, users []db.User) (err error) {
+	out := os.Stdout
+
+	if path != "-" {
+		if out, err = os.Create(path); err != nil { //nolint:gosec // The path is given by whoever runs the command
+			return fmt.Errorf("error creating output file: %w", err)
+		}
+
+		defer func() {
+			if closeErr := out.Close(); err == nil && closeErr != nil {
+				err = fmt.Errorf("error closing output file: %w", closeErr)
+			}
+
+			if err == nil {
+				return
+			}
+
+			if removeErr := os.Remove(path); removeErr != nil {
+				logging.Errorf("Failed to remove the partial output file: %s", removeErr)
+			}
+		}()
+	}
+
+	buffered := bufio.NewWriter(out)
+
+	if err = encodeUsers(buffered, format, users); err != nil {
+		return err
+	}
+
+	if err = buffered.Flush(); err != nil {
+		return fmt.Errorf("error writing users: %w", err)
+	}
+
+	return nil
+}
+
+// encodeUsers writes the users as CSV or JSON for PUT /users, or as NDJSON with a JSON user per line.
+func encodeUsers(out io.Writer, format string, users []db.User) error {
+	switch format {
+	case "csv":
+		writer := csv.NewWriter(out)
+		for _, user := range users {
+			if err := writer.Write([]string{user.Name, user.PhoneNumber, user.Country, user.City}); err != nil {
+				return fmt.Errorf("error writing CSV record: %w", err)
+			}
+		}
+
+		writer.Flush()
+
+		if err := writer.Error(); err != nil {
+			return fmt.Errorf("error writing CSV records: %w", err)
+		}
+	case "json":
+		if err := json.NewEncoder(out).Encode(users); err != nil {
+			return fmt.Errorf("error writing JSON: %w", err)
+		}
+	case "ndjson":
+		encoder := json.NewEncoder(out)
+		for _, user := range users {
+			if err := encoder.Encode(user); err != nil {
+				return fmt.Errorf("error writing JSON: %w", err)
+			}
+		}
+	default:
+		return unknownFormatError{Format: format}
+	}
+
+	return nil
+}
+
+// checkFormat returns unknownFormatError if encodeUsers does not support the format.
+func checkFormat(format string) error {
+	switch format {
+	case "csv", "json", "ndjson":
+		return nil
+	default:
+		return unknownFormatError{Format: format}
+	}
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+
+	return b
+}
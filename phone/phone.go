@@ -0,0 +1,140 @@
+/*
+Package phone parses and normalizes phone numbers to E.164 using the libphonenumber numbering plan that is embedded in
+github.com/nyaruka/phonenumbers.
+*/
+package phone
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/nyaruka/phonenumbers"
+)
+
+// Number is a phone number that passed validation.
+type Number struct {
+	// E164 is the canonical form, for example "+18001234567".
+	E164 string
+	// Region is the ISO 3166-1 alpha-2 code of the region the number belongs to. It is empty if the calling code is
+	// shared by several regions and the number does not match any of their numbering plans exactly.
+	Region string
+	// CallingCode is the international calling code, for example 1 for the US and Canada.
+	CallingCode int
+}
+
+// Regions returns all ISO 3166-1 alpha-2 codes of the regions that use the number's calling code.
+func (n Number) Regions() []string {
+	return phonenumbers.GetRegionCodesForCountryCode(n.CallingCode)
+}
+
+// InvalidError is returned by Parse when the input is not a phone number.
+type InvalidError struct {
+	Reason string
+	Input  string
+}
+
+func (e InvalidError) Error() string {
+	return fmt.Sprintf("%q is not a valid phone number: %s", e.Input, e.Reason)
+}
+
+/*
+Parse validates raw and converts it to E.164. Numbers starting with "+" are parsed as international. Other numbers are
+tried both in the national format of defaultRegion, which is an ISO 3166-1 alpha-2 code and may be empty, and as an
+international number without the leading "+". So "+1 (800) 223-4567", "1-800-223-4567" and "18002234567" are the
+same number. If the digits start with the calling code of defaultRegion the international reading is preferred, so
+"491701234567" in Germany is "+491701234567" and not a national number that happens to start with 49.
+
+A number is accepted if its calling code exists and its length is possible for that calling code. Whether the number is
+actually assigned to anyone is not checked.
+*/
+func Parse(raw, defaultRegion string) (Number, error) {
+	raw = strings.TrimSpace(raw)
+	if raw == "" {
+		return Number{}, InvalidError{Reason: "empty", Input: raw}
+	}
+
+	region := strings.ToUpper(defaultRegion)
+	if !phonenumbers.GetSupportedRegions()[region] {
+		region = ""
+	}
+
+	national := func() (*phonenumbers.PhoneNumber, string) { return parsePossible(raw, region) }
+	international := func() (*phonenumbers.PhoneNumber, string) { return parsePossible("+"+raw, "") }
+
+	var attempts []func() (*phonenumbers.PhoneNumber, string)
+
+	switch {
+	case strings.HasPrefix(raw, "+"):
+		attempts = append(attempts, national) // The region is ignored for international numbers
+	case region == "":
+		attempts = append(attempts, international)
+	case strings.HasPrefix(digitsOf(raw), strconv.Itoa(phonenumbers.GetCountryCodeForRegion(region))):
+		attempts = append(attempts, international, national)
+	default:
+		attempts = append(attempts, national, international)
+	}
+
+	reason := ""
+
+	for _, attempt := range attempts {
+		number, why := attempt()
+		if number != nil {
+			return newNumber(number), nil
+		}
+
+		if reason == "" {
+			reason = why
+		}
+	}
+
+	return Number{}, InvalidError{Reason: reason, Input: raw}
+}
+
+func newNumber(number *phonenumbers.PhoneNumber) Number {
+	callingCode := int(number.GetCountryCode())
+
+	region := ""
+	if regions := phonenumbers.GetRegionCodesForCountryCode(callingCode); len(regions) == 1 {
+		region = regions[0]
+	} else if phonenumbers.IsValidNumber(number) {
+		region = phonenumbers.GetRegionCodeForNumber(number)
+	}
+
+	return Number{
+		E164:        phonenumbers.Format(number, phonenumbers.E164),
+		Region:      region,
+		CallingCode: callingCode,
+	}
+}
+
+// parsePossible returns the parsed number, or nil and the reason it was rejected.
+func parsePossible(raw, region string) (*phonenumbers.PhoneNumber, string) {
+	number, err := phonenumbers.Parse(raw, region)
+	if err != nil {
+		return nil, err.Error()
+	}
+
+	switch phonenumbers.IsPossibleNumberWithReason(number) {
+	case phonenumbers.IS_POSSIBLE, phonenumbers.IS_POSSIBLE_LOCAL_ONLY:
+		return number, ""
+	case phonenumbers.INVALID_COUNTRY_CODE:
+		return nil, "unknown calling code"
+	case phonenumbers.TOO_SHORT:
+		return nil, "too short"
+	case phonenumbers.TOO_LONG:
+		return nil, "too long"
+	default:
+		return nil, "wrong length"
+	}
+}
+
+func digitsOf(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= '0' && r <= '9' {
+			return r
+		}
+
+		return -1
+	}, s)
+}
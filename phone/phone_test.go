@@ -0,0 +1,63 @@
+package phone_test
+
+import (
+	"testing"
+
+	"github.com/m-kuzmin/simple-rest-api/phone"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestShouldNormalizeToE164(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		raw, region, e164 string
+	}{
+		{raw: "18001234567", region: "", e164: "+18001234567"},
+		{raw: "+1 (800) 123-4567", region: "", e164: "+18001234567"},
+		{raw: "1-800-123-4567", region: "US", e164: "+18001234567"},
+		{raw: "(800) 123-4567", region: "US", e164: "+18001234567"},
+		{raw: "030 1234567", region: "DE", e164: "+49301234567"},
+		{raw: "491701234567", region: "DE", e164: "+491701234567"},
+		{raw: "+44 20 7946 0958", region: "US", e164: "+442079460958"},
+		{raw: "+44 20 7946 0958", region: "Not a region", e164: "+442079460958"},
+	}
+
+	for _, test := range tests {
+		number, err := phone.Parse(test.raw, test.region)
+		assert.Nil(t, err, test.raw)
+		assert.Equal(t, test.e164, number.E164, test.raw)
+	}
+}
+
+func TestShouldDetectRegion(t *testing.T) {
+	t.Parallel()
+
+	number, err := phone.Parse("+44 20 7946 0958", "")
+	assert.Nil(t, err)
+	assert.Equal(t, "GB", number.Region)
+	assert.Equal(t, 44, number.CallingCode)
+
+	number, err = phone.Parse("+1 613 555 0123", "")
+	assert.Nil(t, err)
+	assert.Equal(t, "CA", number.Region)
+
+	// Possible but not valid in any of the regions that share calling code 1
+	number, err = phone.Parse("+1 800 123 4567", "")
+	assert.Nil(t, err)
+	assert.Equal(t, "", number.Region)
+	assert.Contains(t, number.Regions(), "US")
+	assert.Contains(t, number.Regions(), "CA")
+}
+
+func TestShouldRejectInvalidNumbers(t *testing.T) {
+	t.Parallel()
+
+	for _, raw := range []string{"", "  ", "12", "abc", "+999 1234567", "+1 800 123 4567 890 123"} {
+		_, err := phone.Parse(raw, "")
+
+		var invalid phone.InvalidError
+
+		assert.ErrorAs(t, err, &invalid, raw)
+	}
+}
@@ -0,0 +1,151 @@
+/*
+Package retry calls a function again after it fails, waiting exponentially longer between attempts. The waits are
+randomized so that many clients that failed at the same time do not retry at the same time either.
+*/
+package retry
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"time"
+)
+
+/*
+Policy decides whether and when a failed call is retried. The n-th wait is InitialInterval * Multiplier^(n-1), at most
+MaxInterval, randomly changed by up to Jitter of itself. Retries stop at whichever limit comes first: MaxAttempts,
+MaxElapsedTime or the context being done.
+*/
+type Policy struct {
+	// InitialInterval is the wait after the first failed attempt.
+	InitialInterval time.Duration
+	// MaxInterval caps the wait between attempts, 0 for no cap.
+	MaxInterval time.Duration
+	// Multiplier is how much longer each wait is than the previous one. Values below 1 are treated as 1.
+	Multiplier float64
+	// Jitter is the fraction of each wait that is random, from 0 (exact waits) to 1 (anywhere from 0 to twice as long).
+	Jitter float64
+	// MaxElapsedTime stops retrying when the next attempt would start later than this after the first one, 0 for no
+	// limit.
+	MaxElapsedTime time.Duration
+	// MaxAttempts stops retrying after this many attempts including the first one, 0 for no limit. 1 disables retries.
+	MaxAttempts uint
+	// Retryable tells transient errors that are worth retrying from permanent ones. nil retries every error.
+	Retryable func(err error) bool
+	// OnRetry is called before waiting to retry the attempt that failed with err. It may be nil.
+	OnRetry func(attempt uint, err error, wait time.Duration)
+}
+
+// ExhaustedError is returned when the last attempt failed and the Policy does not allow another one.
+type ExhaustedError struct {
+	Attempts uint
+	Err      error // The error of the last attempt
+}
+
+func (e *ExhaustedError) Error() string {
+	return fmt.Sprintf("gave up after %d attempts: %s", e.Attempts, e.Err)
+}
+
+func (e *ExhaustedError) Unwrap() error {
+	return e.Err
+}
+
+/*
+StoppedError is returned when the context is done before a retry. errors.Is matches both the context error and the
+error of the last attempt.
+*/
+type StoppedError struct {
+	Attempts uint
+	Cause    error // Why the context is done
+	Err      error // The error of the last attempt
+}
+
+func (e *StoppedError) Error() string {
+	return fmt.Sprintf("stopped retrying after %d attempts: %s: %s", e.Attempts, e.Cause, e.Err)
+}
+
+func (e *StoppedError) Unwrap() []error {
+	return []error{e.Cause, e.Err}
+}
+
+/*
+Do calls fn until it succeeds, fails with an error that is not Retryable, or the Policy gives up. Errors that are not
+retried are returned as they are, otherwise the error is an ExhaustedError or StoppedError wrapping the last one. Do
+never waits after the last attempt.
+*/
+func Do(ctx context.Context, policy Policy, fn func(ctx context.Context) error) error {
+	start := time.Now()
+	interval := policy.InitialInterval
+
+	for attempt := uint(1); ; attempt++ {
+		err := fn(ctx)
+		if err == nil || (policy.Retryable != nil && !policy.Retryable(err)) {
+			return err
+		}
+
+		if ctx.Err() != nil {
+			return &StoppedError{Attempts: attempt, Cause: ctx.Err(), Err: err}
+		}
+
+		wait := policy.jitter(interval)
+
+		if policy.MaxAttempts != 0 && attempt >= policy.MaxAttempts ||
+			policy.MaxElapsedTime != 0 && time.Since(start)+wait > policy.MaxElapsedTime {
+			return &ExhaustedError{Attempts: attempt, Err: err}
+		}
+
+		if policy.OnRetry != nil {
+			policy.OnRetry(attempt, err, wait)
+		}
+
+		if cause := sleep(ctx, wait); cause != nil {
+			return &StoppedError{Attempts: attempt, Cause: cause, Err: err}
+		}
+
+		interval = policy.next(interval)
+	}
+}
+
+// next is the wait after interval, before jitter.
+func (p Policy) next(interval time.Duration) time.Duration {
+	multiplier := p.Multiplier
+	if multiplier < 1 {
+		multiplier = 1
+	}
+
+	next := time.Duration(float64(interval) * multiplier)
+	if p.MaxInterval != 0 && next > p.MaxInterval {
+		return p.MaxInterval
+	}
+
+	return next
+}
+
+// jitter randomly changes interval by up to Jitter of itself.
+func (p Policy) jitter(interval time.Duration) time.Duration {
+	if p.Jitter <= 0 {
+		return interval
+	}
+
+	jitter := p.Jitter
+	if jitter > 1 {
+		jitter = 1
+	}
+
+	random := rand.Float64() //nolint:gosec // Spreading retries out does not need a secure source
+
+	return time.Duration(float64(interval) * (1 - jitter + 2*jitter*random))
+}
+
+// sleep waits for d or until ctx is done, in which case it returns the context error.
+func sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err() //nolint:wrapcheck // Returned as the Cause of a StoppedError
+	}
+}
@@ -0,0 +1,168 @@
+package retry_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/m-kuzmin/simple-rest-api/retry"
+	"github.com/stretchr/testify/assert"
+)
+
+//nolint:gochecknoglobals // Read-only test fixture
+var errPermanent = errors.New("permanent")
+
+// failing returns a fn that fails with err the first times it is called and then succeeds.
+func failing(times int, err error) (fn func(context.Context) error, calls *int) {
+	calls = new(int)
+
+	return func(context.Context) error {
+		*calls++
+		if *calls <= times {
+			return err
+		}
+
+		return nil
+	}, calls
+}
+
+func TestShouldRetryUntilSuccess(t *testing.T) {
+	t.Parallel()
+
+	var waits []time.Duration
+
+	policy := retry.Policy{
+		InitialInterval: time.Millisecond,
+		MaxInterval:     4 * time.Millisecond,
+		Multiplier:      2,
+		Jitter:          0,
+		MaxElapsedTime:  0,
+		MaxAttempts:     0,
+		Retryable:       nil,
+		OnRetry:         func(_ uint, _ error, wait time.Duration) { waits = append(waits, wait) },
+	}
+
+	fn, calls := failing(4, io.EOF)
+	assert.Nil(t, retry.Do(context.Background(), policy, fn))
+	assert.Equal(t, 5, *calls)
+	assert.Equal(t, []time.Duration{time.Millisecond, 2 * time.Millisecond, 4 * time.Millisecond, 4 * time.Millisecond},
+		waits, "waits double up to MaxInterval")
+}
+
+func TestShouldNotRetryPermanentErrors(t *testing.T) {
+	t.Parallel()
+
+	policy := retry.Policy{
+		InitialInterval: time.Millisecond,
+		MaxInterval:     0,
+		Multiplier:      2,
+		Jitter:          0,
+		MaxElapsedTime:  0,
+		MaxAttempts:     0,
+		Retryable:       func(err error) bool { return !errors.Is(err, errPermanent) },
+		OnRetry:         nil,
+	}
+
+	fn, calls := failing(10, errPermanent)
+	assert.Equal(t, errPermanent, retry.Do(context.Background(), policy, fn), "returned as it is")
+	assert.Equal(t, 1, *calls)
+}
+
+func TestShouldGiveUpWithoutWaitingAfterLastAttempt(t *testing.T) {
+	t.Parallel()
+
+	policy := retry.Policy{
+		InitialInterval: time.Millisecond,
+		MaxInterval:     0,
+		Multiplier:      1,
+		Jitter:          0,
+		MaxElapsedTime:  0,
+		MaxAttempts:     3,
+		Retryable:       nil,
+		OnRetry:         nil,
+	}
+
+	fn, calls := failing(10, io.EOF)
+	err := retry.Do(context.Background(), policy, fn)
+
+	var exhausted *retry.ExhaustedError
+
+	assert.ErrorAs(t, err, &exhausted)
+	assert.ErrorIs(t, err, io.EOF)
+	assert.Equal(t, uint(3), exhausted.Attempts)
+	assert.Equal(t, 3, *calls)
+
+	// A wait that would end past MaxElapsedTime is not started
+	policy.InitialInterval = time.Hour
+	policy.MaxElapsedTime = time.Minute
+	policy.MaxAttempts = 0
+
+	fn, calls = failing(10, io.EOF)
+	start := time.Now()
+	err = retry.Do(context.Background(), policy, fn)
+
+	assert.ErrorAs(t, err, &exhausted)
+	assert.Equal(t, 1, *calls)
+	assert.Less(t, time.Since(start), time.Second)
+}
+
+func TestShouldStopRetryingWhenContextIsDone(t *testing.T) {
+	t.Parallel()
+
+	policy := retry.Policy{
+		InitialInterval: time.Hour,
+		MaxInterval:     0,
+		Multiplier:      2,
+		Jitter:          0.5,
+		MaxElapsedTime:  0,
+		MaxAttempts:     0,
+		Retryable:       nil,
+		OnRetry:         nil,
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	fn, calls := failing(10, io.EOF)
+	err := retry.Do(ctx, policy, fn)
+
+	var stopped *retry.StoppedError
+
+	assert.ErrorAs(t, err, &stopped)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.ErrorIs(t, err, io.EOF)
+	assert.Equal(t, 1, *calls)
+}
+
+func TestShouldJitterWaits(t *testing.T) {
+	t.Parallel()
+
+	var waits []time.Duration
+
+	policy := retry.Policy{
+		InitialInterval: 100 * time.Microsecond,
+		MaxInterval:     0,
+		Multiplier:      1,
+		Jitter:          0.5,
+		MaxElapsedTime:  0,
+		MaxAttempts:     50,
+		Retryable:       nil,
+		OnRetry:         func(_ uint, _ error, wait time.Duration) { waits = append(waits, wait) },
+	}
+
+	fn, _ := failing(100, io.EOF)
+	assert.NotNil(t, retry.Do(context.Background(), policy, fn))
+
+	distinct := map[time.Duration]bool{}
+
+	for _, wait := range waits {
+		assert.GreaterOrEqual(t, wait, 50*time.Microsecond)
+		assert.LessOrEqual(t, wait, 150*time.Microsecond)
+
+		distinct[wait] = true
+	}
+
+	assert.Greater(t, len(distinct), 1, "waits must be randomized")
+}